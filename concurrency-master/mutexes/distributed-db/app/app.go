@@ -5,8 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"distributed-db/auth"
 	"distributed-db/clients"
 	"distributed-db/controllers"
 	"distributed-db/models"
@@ -15,63 +21,282 @@ import (
 	"distributed-db/workers"
 )
 
+// Config is everything a node needs to start
+type Config struct {
+	Port                 int
+	DataDir              string
+	Nodes                models.NodesMap
+	ReplicationFactor    int
+	TombstoneGrace       time.Duration
+	CompactionThroughput int64
+	MaxHintAge           time.Duration
+	MaxHints             int
+	ProbeTimeout         time.Duration
+	SuspicionTimeout     time.Duration
+	Transport            string
+	TCPPortOffset        int
+	IndirectProbes       int
+	WatchBuffer          int
+	ClusterSecretFile    string
+	MemoryLimit          int64
+	EvictionPolicy       string
+	BackupDir            string
+	// the backup restored into the empty node at startup, see services.CacheSvc.Restore
+	Restore string
+	// the nodes whose parts of the backup are restored, comma separated,
+	// or all for every part. Defaults to the node itself
+	RestoreNodes string
+	// when set, the http api and the binary protocol are served on these
+	// listeners instead of listening on the port and on the tcp port.
+	// The port of the listener is the port of the node
+	Listener    net.Listener
+	TCPListener net.Listener
+	// when set, wraps the handler of the http api
+	Middleware func(http.Handler) http.Handler
+	// when set, Start does not run the workers, the caller runs their rounds
+	ManualWorkers bool
+}
+
+// New creates the node described by the command line flags
 func New() (*App, error) {
-	nodesMap := models.NodesMap{}
-	port := flag.Int("port", 8080, "the port of the running server")
-	dataDir := flag.String("data", "", "the data directory of the running server")
-	flag.Var(&nodesMap, "node", "the list of nodes to talk to")
+	cfg := Config{Nodes: models.NodesMap{}}
+	flag.IntVar(&cfg.Port, "port", 8080, "the port of the running server")
+	flag.StringVar(&cfg.DataDir, "data", "", "the data directory of the running server")
+	flag.IntVar(&cfg.ReplicationFactor, "replication-factor", models.DefaultReplicationFactor, "the replication factor of the requests which don't specify one")
+	flag.DurationVar(&cfg.TombstoneGrace, "tombstone-grace", 10*time.Minute, "how long deleted items are kept around before getting purged")
+	flag.Int64Var(&cfg.CompactionThroughput, "compaction-throughput", 16, "the max compaction write throughput in MB/s, 0 disables throttling")
+	flag.DurationVar(&cfg.MaxHintAge, "max-hint-age", 3*time.Hour, "how long writes for unreachable nodes are kept around")
+	flag.IntVar(&cfg.MaxHints, "max-hints", 10000, "the max number of writes kept around for an unreachable node")
+	flag.DurationVar(&cfg.ProbeTimeout, "probe-timeout", 500*time.Millisecond, "how long a node has to answer a ping")
+	flag.DurationVar(&cfg.SuspicionTimeout, "suspicion-timeout", 5*time.Second, "how long a suspect node has to refute the suspicion before being declared down")
+	flag.StringVar(&cfg.Transport, "transport", "http", "the protocol used between the nodes, http or tcp")
+	flag.IntVar(&cfg.TCPPortOffset, "tcp-port-offset", 1000, "the binary protocol is served on the port plus this offset, it must be the same on all the nodes")
+	flag.IntVar(&cfg.IndirectProbes, "indirect-probes", 3, "the number of nodes asked to ping a node which did not answer")
+	flag.IntVar(&cfg.WatchBuffer, "watch-buffer", 4096, "the number of recent changes kept, watchers which reconnect resume from them")
+	flag.StringVar(&cfg.ClusterSecretFile, "cluster-secret-file", "", "the file holding the secret shared by the nodes, which signs the node-only requests")
+	flag.Int64Var(&cfg.MemoryLimit, "memory-limit", 0, "the max memory taken by the items in MB, 0 means unlimited")
+	flag.StringVar(&cfg.EvictionPolicy, "eviction-policy", models.EvictionSpill, "what happens to the least recently used items over the memory limit, spill to disk or drop")
+	flag.StringVar(&cfg.BackupDir, "backup-dir", "", "the directory the node writes its part of the backups into, shared by the nodes. Without it the node can't take backups")
+	flag.StringVar(&cfg.Restore, "restore", "", "the backup restored into the empty node at startup: latest, a backup id, or an RFC3339 time to restore the newest backup taken by then")
+	flag.StringVar(&cfg.RestoreNodes, "restore-nodes", "", "the nodes whose parts of the backup are restored, comma separated, or all. Defaults to the node itself")
+	flag.Var(&cfg.Nodes, "node", "the list of nodes to talk to")
 
 	flag.Parse()
 
-	addr := fmt.Sprintf("localhost:%d", *port)
-	if *dataDir == "" {
-		*dataDir = fmt.Sprintf(".data/%s", addr)
+	return NewWithConfig(cfg)
+}
+
+// NewWithConfig creates the node described by the config
+func NewWithConfig(cfg Config) (*App, error) {
+	if cfg.Listener != nil {
+		cfg.Port = cfg.Listener.Addr().(*net.TCPAddr).Port
+	}
+	addr := fmt.Sprintf("localhost:%d", cfg.Port)
+	if cfg.DataDir == "" {
+		cfg.DataDir = fmt.Sprintf(".data/%s", addr)
 	}
 
-	delete(nodesMap, addr)
+	nodesMap := models.NodesMap{}
+	for node, status := range cfg.Nodes {
+		if node != addr {
+			nodesMap[node] = status
+		}
+	}
 	if len(nodesMap) < 1 {
 		return nil, fmt.Errorf("need at least 1 node to talk to")
 	}
 
+	signer, err := newSigner(cfg.ClusterSecretFile)
+	if err != nil {
+		return nil, err
+	}
+
 	nodes := models.NewNodes(addr, nodesMap)
 	tokens := models.NewTokens(nodes, 256)
-	cacheRepo := repositories.NewCache(*dataDir)
-	httpClient := clients.NewHTTP(addr)
-	svc := services.NewCache(cacheRepo, httpClient, tokens)
-	router := controllers.NewRouter(svc)
+	cacheRepo, err := repositories.NewCache(cfg.DataDir, cfg.MemoryLimit<<20, cfg.EvictionPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the database: %w", err)
+	}
+	hintsRepo, err := repositories.NewHints(filepath.Join(cfg.DataDir, "hints"), cfg.MaxHintAge, cfg.MaxHints)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the hints: %w", err)
+	}
+	keyspacesRepo, err := repositories.NewKeyspaces(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	// the interface must stay nil without a backup directory
+	var backupsRepo services.BackupRepository
+	if cfg.BackupDir != "" {
+		backupsRepo, err = repositories.NewBackups(cfg.BackupDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var nodeClient interface {
+		services.HTTPClient
+		closer
+	}
+	switch cfg.Transport {
+	case "http":
+		nodeClient = clients.NewHTTP(addr, signer)
+	case "tcp":
+		nodeClient = clients.NewTCP(addr, cfg.TCPPortOffset, signer)
+	default:
+		return nil, fmt.Errorf("unknown transport: %s", cfg.Transport)
+	}
+	metrics := models.NewMetrics()
+	svc := services.NewCache(cacheRepo, hintsRepo, backupsRepo, keyspacesRepo, nodeClient, tokens, models.NewChanges(cfg.WatchBuffer), metrics, cfg.ReplicationFactor)
+	nodes.Subscribe(svc.NodeStatusChanged)
+	if cfg.Restore != "" {
+		err = restore(svc, cfg.Restore, cfg.RestoreNodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	router := controllers.NewRouter(svc, signer, metrics)
+	if cfg.Middleware != nil {
+		router = cfg.Middleware(router)
+	}
+	// the watch streams never end on their own, they are cut when shutting down
+	streamsCtx, cancelStreams := context.WithCancel(context.Background())
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: router,
+		Addr:        addr,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return streamsCtx },
+	}
+	srv.RegisterOnShutdown(cancelStreams)
+	listener := cfg.Listener
+	if listener == nil {
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on: %s, %w", addr, err)
+		}
+	}
+	// the binary protocol is always served, so nodes can pick either transport
+	tcpListener := cfg.TCPListener
+	if tcpListener == nil {
+		tcpAddr := fmt.Sprintf("localhost:%d", cfg.Port+cfg.TCPPortOffset)
+		tcpListener, err = net.Listen("tcp", tcpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on: %s, %w", tcpAddr, err)
+		}
 	}
+	tcpServer := controllers.NewTCPServer(svc, signer, metrics)
 	gossipWorker := workers.NewGossip(svc)
 	streamerWorker := workers.NewStreamer(svc)
+	sweeperWorker := workers.NewSweeper(svc, cfg.TombstoneGrace)
+	reaperWorker := workers.NewReaper(svc)
+	compactorWorker := workers.NewCompactor(svc, cfg.TombstoneGrace, cfg.CompactionThroughput<<20)
+	handoffWorker := workers.NewHandoff(svc)
+	repairerWorker := workers.NewRepairer(svc)
+	failureDetectorWorker := workers.NewFailureDetector(svc, cfg.ProbeTimeout, cfg.SuspicionTimeout, cfg.IndirectProbes)
 	a := &App{
-		Server:         srv,
-		GossipWorker:   gossipWorker,
-		StreamerWorker: streamerWorker,
-		cacheRepo:      cacheRepo,
+		Server:                srv,
+		Service:               svc,
+		TCPServer:             tcpServer,
+		listener:              listener,
+		tcpListener:           tcpListener,
+		GossipWorker:          gossipWorker,
+		StreamerWorker:        streamerWorker,
+		SweeperWorker:         sweeperWorker,
+		ReaperWorker:          reaperWorker,
+		CompactorWorker:       compactorWorker,
+		HandoffWorker:         handoffWorker,
+		RepairerWorker:        repairerWorker,
+		FailureDetectorWorker: failureDetectorWorker,
+		decommissioned:        svc.Decommissioned(),
+		cacheRepo:             cacheRepo,
+		nodeClient:            nodeClient,
+		manualWorkers:         cfg.ManualWorkers,
 	}
 
 	return a, nil
 }
 
-type snapshotter interface {
-	Snapshot() error
+// restore imports the backup before the node starts serving, the streamer
+// then hands the items the node does not own over to their owners
+func restore(svc services.CacheSvc, backup, nodes string) error {
+	req := models.RestoreRequest{Backup: backup}
+	switch nodes {
+	case "":
+	case "all":
+		req.AllNodes = true
+	default:
+		req.Nodes = strings.Split(nodes, ",")
+	}
+
+	res, err := svc.Restore(req)
+	if err != nil {
+		return fmt.Errorf("could not restore the backup: %w", err)
+	}
+	log.Printf("restored %d item(s) of node(s): %s from backup: %s", res.Items, strings.Join(res.Nodes, ","), res.ID)
+	return nil
+}
+
+func newSigner(secretFile string) (*auth.Signer, error) {
+	if secretFile == "" {
+		log.Println("no cluster secret, anyone can call the node-only api")
+		return auth.NewSigner(""), nil
+	}
+
+	bs, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the cluster secret: %w", err)
+	}
+	secret := strings.TrimSpace(string(bs))
+	if secret == "" {
+		return nil, fmt.Errorf("the cluster secret file: %s is empty", secretFile)
+	}
+	return auth.NewSigner(secret), nil
+}
+
+type closer interface {
+	Close() error
 }
 
 type App struct {
-	Server         *http.Server
-	GossipWorker   workers.Gossip
-	StreamerWorker workers.Streamer
-	cacheRepo      snapshotter
+	Server                *http.Server
+	Service               services.CacheSvc
+	TCPServer             *controllers.TCPServer
+	GossipWorker          workers.Gossip
+	StreamerWorker        workers.Streamer
+	SweeperWorker         workers.Sweeper
+	ReaperWorker          workers.Reaper
+	CompactorWorker       workers.Compactor
+	HandoffWorker         workers.Handoff
+	RepairerWorker        workers.Repairer
+	FailureDetectorWorker workers.FailureDetector
+	cacheRepo             closer
+	nodeClient            closer
+	decommissioned        <-chan struct{}
+	listener              net.Listener
+	tcpListener           net.Listener
+	manualWorkers         bool
 }
 
 func (a App) Start(ctx context.Context) error {
-	go a.GossipWorker.Start(ctx)
-	go a.StreamerWorker.Start(ctx)
+	if !a.manualWorkers {
+		go a.GossipWorker.Start(ctx)
+		go a.StreamerWorker.Start(ctx)
+		go a.SweeperWorker.Start(ctx)
+		go a.ReaperWorker.Start(ctx)
+		go a.CompactorWorker.Start(ctx)
+		go a.HandoffWorker.Start(ctx)
+		go a.RepairerWorker.Start(ctx)
+		go a.FailureDetectorWorker.Start(ctx)
+	}
+
+	go func() {
+		log.Println("tcp server started on address", a.tcpListener.Addr())
+		err := a.TCPServer.Serve(a.tcpListener)
+		if err != nil {
+			log.Printf("could not serve tcp: %v", err)
+		}
+	}()
 
 	log.Println("server started on address", a.Server.Addr)
-	err := a.Server.ListenAndServe()
+	err := a.Server.Serve(a.listener)
 	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
@@ -79,6 +304,11 @@ func (a App) Start(ctx context.Context) error {
 	return nil
 }
 
+// Decommissioned is closed once the node left the cluster
+func (a App) Decommissioned() <-chan struct{} {
+	return a.decommissioned
+}
+
 func (a App) Stop(ctx context.Context) error {
 	log.Println("shutting down the http server")
 	err := a.Server.Shutdown(ctx)
@@ -86,10 +316,22 @@ func (a App) Stop(ctx context.Context) error {
 		return fmt.Errorf("could not stop the http server: %w", err)
 	}
 
-	log.Println("taking a snapshot of the database")
-	err = a.cacheRepo.Snapshot()
+	log.Println("shutting down the tcp server")
+	err = a.TCPServer.Close()
+	if err != nil {
+		return fmt.Errorf("could not stop the tcp server: %w", err)
+	}
+
+	log.Println("closing the connections to the other nodes")
+	err = a.nodeClient.Close()
+	if err != nil {
+		return fmt.Errorf("could not close the connections to the other nodes: %w", err)
+	}
+
+	log.Println("flushing the database to disk")
+	err = a.cacheRepo.Close()
 	if err != nil {
-		return fmt.Errorf("could not take database snapshot: %w", err)
+		return fmt.Errorf("could not close the database: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+const (
+	TimestampHeader = "X-Node-Timestamp"
+	SignatureHeader = "X-Node-Signature"
+	NonceHeader     = "X-Node-Nonce"
+	// carries the cluster secret of the operators, as a bearer token
+	AuthorizationHeader = "Authorization"
+	// signed messages older or newer than this are rejected
+	MaxClockSkew = 5 * time.Minute
+	nonceSize    = 16
+)
+
+// NewSigner creates a signer with the secret shared by all the nodes of the cluster.
+// Without a secret nothing gets signed or verified
+func NewSigner(secret string) *Signer {
+	return &Signer{
+		secret: []byte(secret),
+		nonces: map[string]struct{}{},
+	}
+}
+
+// Signer signs the traffic between the nodes with HMAC-SHA256, so only
+// the nodes which know the cluster secret can use the node-only api
+type Signer struct {
+	secret []byte
+	mu     sync.Mutex
+	// the nonces seen while their messages are fresh, in the order they were seen
+	nonces map[string]struct{}
+	seen   []seenNonce
+}
+
+type seenNonce struct {
+	nonce  string
+	seenAt time.Time
+}
+
+func (s *Signer) Enabled() bool {
+	return len(s.secret) > 0
+}
+
+// Sign returns the MAC of the parts. Every part is prefixed by its length,
+// so moving bytes from a part to the next one changes the MAC
+func (s *Signer) Sign(parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	length := make([]byte, 8)
+	for _, part := range parts {
+		binary.BigEndian.PutUint64(length, uint64(len(part)))
+		mac.Write(length)
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func (s *Signer) Verify(mac []byte, parts ...[]byte) bool {
+	return hmac.Equal(mac, s.Sign(parts...))
+}
+
+// SignRequest signs the method, path, query, sender and body of an http request
+// sent to another node, with a nonce so the request can't be sent again
+func (s *Signer) SignRequest(req *http.Request, body []byte) {
+	if !s.Enabled() {
+		return
+	}
+
+	nonce := make([]byte, nonceSize)
+	_, _ = rand.Read(nonce)
+	timestamp, n := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(nonce)
+	mac := s.Sign([]byte(req.Method), []byte(req.URL.Path), []byte(req.URL.RawQuery), []byte(req.Host), []byte(timestamp), []byte(n), body)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, n)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(mac))
+}
+
+// VerifyRequest checks the http request was signed by another node. The sender
+// (the host) is part of the signature, so it can't be impersonated. A nonce is
+// accepted only once, so recorded requests can't be replayed
+func (s *Signer) VerifyRequest(r *http.Request, body []byte) error {
+	timestamp, nonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	err := checkTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	if n, err := hex.DecodeString(nonce); err != nil || len(n) != nonceSize {
+		return fmt.Errorf("%w: invalid nonce", models.ErrUnauthorized)
+	}
+
+	mac, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || !s.Verify(mac, []byte(r.Method), []byte(r.URL.Path), []byte(r.URL.RawQuery), []byte(r.Host), []byte(timestamp), []byte(nonce), body) {
+		return fmt.Errorf("%w: invalid signature", models.ErrUnauthorized)
+	}
+	if !s.remember(nonce) {
+		return fmt.Errorf("%w: replayed request", models.ErrUnauthorized)
+	}
+	return nil
+}
+
+// VerifyAdmin checks the request of an operator carries the cluster secret
+// as a bearer token. The MACs of the tokens are compared, so the time taken
+// doesn't tell how much of the secret was guessed, not even its length
+func (s *Signer) VerifyAdmin(r *http.Request) error {
+	token := strings.TrimPrefix(r.Header.Get(AuthorizationHeader), "Bearer ")
+	if !s.Verify(s.Sign(s.secret), []byte(token)) {
+		return fmt.Errorf("%w: the cluster secret is required", models.ErrUnauthorized)
+	}
+	return nil
+}
+
+// Hello returns the payload of the frame which opens a connection of the binary
+// protocol and the nonce of the connection, which is part of the MAC of its frames
+func (s *Signer) Hello(host string) ([]byte, []byte) {
+	if !s.Enabled() {
+		return []byte(host), nil
+	}
+
+	nonce := make([]byte, nonceSize)
+	_, _ = rand.Read(nonce)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := s.Sign([]byte("hello"), []byte(host), []byte(timestamp), nonce)
+	payload := strings.Join([]string{host, timestamp, hex.EncodeToString(nonce), hex.EncodeToString(mac)}, "\n")
+	return []byte(payload), nonce
+}
+
+// VerifyHello returns the node which opened the connection and the nonce of the
+// connection. A nonce is accepted only once, so recorded connections can't be replayed
+func (s *Signer) VerifyHello(payload []byte) (string, []byte, error) {
+	if !s.Enabled() {
+		return string(payload), nil, nil
+	}
+
+	parts := strings.Split(string(payload), "\n")
+	if len(parts) != 4 {
+		return "", nil, fmt.Errorf("%w: unsigned hello", models.ErrUnauthorized)
+	}
+	host, timestamp := parts[0], parts[1]
+	err := checkTimestamp(timestamp)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := hex.DecodeString(parts[2])
+	if err != nil || len(nonce) != nonceSize {
+		return "", nil, fmt.Errorf("%w: invalid nonce", models.ErrUnauthorized)
+	}
+	mac, err := hex.DecodeString(parts[3])
+	if err != nil || !s.Verify(mac, []byte("hello"), []byte(host), []byte(timestamp), nonce) {
+		return "", nil, fmt.Errorf("%w: invalid signature", models.ErrUnauthorized)
+	}
+
+	if !s.remember(parts[2]) {
+		return "", nil, fmt.Errorf("%w: replayed hello", models.ErrUnauthorized)
+	}
+	return host, nonce, nil
+}
+
+// remember records the nonce and tells whether it was not seen yet. The nonces are
+// forgotten once their messages are too old to pass the timestamp check anyway
+func (s *Signer) remember(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for len(s.seen) > 0 && now.Sub(s.seen[0].seenAt) > 2*MaxClockSkew {
+		delete(s.nonces, s.seen[0].nonce)
+		s.seen = s.seen[1:]
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+	s.nonces[nonce] = struct{}{}
+	s.seen = append(s.seen, seenNonce{nonce: nonce, seenAt: now})
+	return true
+}
+
+func checkTimestamp(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing timestamp", models.ErrUnauthorized)
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("%w: timestamp is off by %v", models.ErrUnauthorized, skew.Round(time.Second))
+	}
+	return nil
+}
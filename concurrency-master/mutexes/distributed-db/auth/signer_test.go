@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"distributed-db/models"
+)
+
+func TestSignedRequests(t *testing.T) {
+	signer := NewSigner("secret")
+	body := []byte(`{"members":{}}`)
+
+	req := httptest.NewRequest("POST", "http://localhost:9001/gossip", bytes.NewReader(body))
+	req.Host = "localhost:9002"
+	signer.SignRequest(req, body)
+	if err := signer.VerifyRequest(req, body); err != nil {
+		t.Fatalf("signed request rejected: %v", err)
+	}
+
+	if err := signer.VerifyRequest(req, []byte(`{"members":null}`)); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("tampered body accepted: %v", err)
+	}
+	req.Host = "localhost:9003"
+	if err := signer.VerifyRequest(req, body); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("impersonated sender accepted: %v", err)
+	}
+	req.Host = "localhost:9002"
+	if err := NewSigner("other").VerifyRequest(req, body); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("request signed with another secret accepted: %v", err)
+	}
+}
+
+func TestRequestReplay(t *testing.T) {
+	signer := NewSigner("secret")
+
+	req := httptest.NewRequest("GET", "http://localhost:9001/watch/changes?key=a", nil)
+	req.Host = "localhost:9002"
+	signer.SignRequest(req, nil)
+	req.URL.RawQuery = "key=b"
+	if err := signer.VerifyRequest(req, nil); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("tampered query accepted: %v", err)
+	}
+	req.URL.RawQuery = "key=a"
+	if err := signer.VerifyRequest(req, nil); err != nil {
+		t.Fatalf("signed request rejected: %v", err)
+	}
+	if err := signer.VerifyRequest(req, nil); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("replayed request accepted: %v", err)
+	}
+}
+
+func TestHelloReplay(t *testing.T) {
+	signer := NewSigner("secret")
+
+	hello, nonce := signer.Hello("localhost:9002")
+	host, got, err := signer.VerifyHello(hello)
+	if err != nil {
+		t.Fatalf("hello rejected: %v", err)
+	}
+	if host != "localhost:9002" || !bytes.Equal(got, nonce) {
+		t.Fatalf("unexpected hello: %s, nonce: %x", host, got)
+	}
+
+	if _, _, err := signer.VerifyHello(hello); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("replayed hello accepted: %v", err)
+	}
+	if _, _, err := signer.VerifyHello([]byte("localhost:9002")); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("unsigned hello accepted: %v", err)
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	signer := NewSigner("secret")
+
+	req := httptest.NewRequest("POST", "http://localhost:9001/decommission", nil)
+	if err := signer.VerifyAdmin(req); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("request without the secret accepted: %v", err)
+	}
+	req.Header.Set(AuthorizationHeader, "Bearer secre")
+	if err := signer.VerifyAdmin(req); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("request with the wrong secret accepted: %v", err)
+	}
+	req.Header.Set(AuthorizationHeader, "Bearer secret")
+	if err := signer.VerifyAdmin(req); err != nil {
+		t.Fatalf("request with the secret rejected: %v", err)
+	}
+}
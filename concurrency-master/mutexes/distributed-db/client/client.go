@@ -0,0 +1,309 @@
+// Package client is the Go library of the applications using the database.
+// It keeps a copy of the token ring and sends the requests straight to the nodes
+// owning the keys, which saves the hop through a node forwarding them. The ring is
+// read from /ring, since /tokens is node-only once the cluster secret is set, and it
+// is read again whenever a response carries a checksum of a different ring.
+// The requests go to any other node which is up when the owner can't be reached
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+const (
+	// idle connections kept open to every node
+	maxIdleConnsPerNode = 64
+	// writes of a batch sent at the same time
+	maxConcurrentSets = 16
+	// how long reading the ring again can take
+	refreshTimeout = 5 * time.Second
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// New reads the ring from the first seed node which answers
+func New(ctx context.Context, seeds []string) (*Client, error) {
+	c := &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: maxIdleConnsPerNode,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		ring:   &ring{},
+		failed: map[string]bool{},
+	}
+
+	err := fmt.Errorf("no seed nodes")
+	for _, seed := range seeds {
+		err = c.refresh(ctx, seed)
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("could not read the ring: %w", err)
+}
+
+type Client struct {
+	httpClient *http.Client
+	mu         sync.Mutex
+	ring       *ring
+	// the nodes which could not be reached since the ring was last read
+	failed     map[string]bool
+	refreshing bool
+}
+
+// Get reads the keys from their owners, the keys of every owner in a single request
+func (c *Client) Get(ctx context.Context, req models.GetRequest) ([]models.CacheItem, error) {
+	type result struct {
+		items []models.CacheItem
+		err   error
+	}
+	groups := c.group(req.Keyspace, req.Keys)
+	results := make(chan result, len(groups))
+	for owner, keys := range groups {
+		go func(owner string, keys []string) {
+			ownerReq := req
+			ownerReq.Keys = keys
+			var items []models.CacheItem
+			err := c.call(ctx, owner, http.MethodGet, "get", ownerReq, &items)
+			results <- result{items: items, err: err}
+		}(owner, keys)
+	}
+
+	items, errs := make([]models.CacheItem, 0, len(req.Keys)), make([]error, 0)
+	for range groups {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		items = append(items, res.items...)
+	}
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return items, nil
+}
+
+// Set writes the item through its owner
+func (c *Client) Set(ctx context.Context, req models.SetRequest) (models.CacheItem, error) {
+	var item models.CacheItem
+	err := c.call(ctx, c.owner(req.Keyspace, req.Key), http.MethodPost, "set", req, &item)
+	if err != nil {
+		return models.CacheItem{}, err
+	}
+	return item, nil
+}
+
+// SetBatch writes the items through their owners, a few at a time. Batch writes are
+// node-only, so every item is a write of its own. The items which were written are
+// returned, along with an error when some of them were not
+func (c *Client) SetBatch(ctx context.Context, reqs []models.SetRequest) ([]models.CacheItem, error) {
+	var mu sync.Mutex
+	items, errs := make([]models.CacheItem, 0, len(reqs)), make([]error, 0)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentSets)
+	for _, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(req models.SetRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			item, err := c.Set(ctx, req)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			items = append(items, item)
+		}(req)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return items, fmt.Errorf("could not set %d out of %d item(s), %w", len(errs), len(reqs), errs[0])
+	}
+	return items, nil
+}
+
+// Delete deletes the keys through their owners, the keys of every owner in a single request
+func (c *Client) Delete(ctx context.Context, req models.DeleteRequest) error {
+	groups := c.group(req.Keyspace, req.Keys)
+	errs := make(chan error, len(groups))
+	for owner, keys := range groups {
+		go func(owner string, keys []string) {
+			ownerReq := req
+			ownerReq.Keys = keys
+			errs <- c.call(ctx, owner, http.MethodPost, "delete", ownerReq, nil)
+		}(owner, keys)
+	}
+
+	var err error
+	for range groups {
+		if groupErr := <-errs; groupErr != nil && err == nil {
+			err = groupErr
+		}
+	}
+	return err
+}
+
+// Close closes the idle connections to the nodes
+func (c *Client) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// owner returns the owner of the key of the keyspace, the keys of the
+// named keyspaces are placed on the ring under their stored key
+func (c *Client) owner(keyspace, key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ring.owner(models.KeyspaceKey(keyspace, key))
+}
+
+// group splits the keys of the keyspace by owner
+func (c *Client) group(keyspace string, keys []string) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	groups := map[string][]string{}
+	for _, key := range keys {
+		owner := c.ring.owner(models.KeyspaceKey(keyspace, key))
+		groups[owner] = append(groups[owner], key)
+	}
+	return groups
+}
+
+// call sends the request to the owner, then to the other nodes which are up until
+// one of them serves it. Only the nodes which can't be reached or can't reach
+// enough replicas are skipped, the other errors are returned right away
+func (c *Client) call(ctx context.Context, owner, method, path string, body, v interface{}) error {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	nodes := c.ring.candidates(owner, c.failed)
+	c.mu.Unlock()
+
+	err = fmt.Errorf("%w: no node is up", models.ErrUnavailable)
+	for _, node := range nodes {
+		var checksum string
+		checksum, err = c.send(ctx, node, method, path, bs, v)
+		c.checkRing(node, checksum)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, errUnreachable) {
+			c.mu.Lock()
+			c.failed[node] = true
+			c.mu.Unlock()
+			continue
+		}
+		if !errors.Is(err, models.ErrUnavailable) {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends the request to the node and returns the checksum of the ring of the node
+func (c *Client) send(ctx context.Context, node, method, path string, bs []byte, v interface{}) (string, error) {
+	u := url.URL{Scheme: "http", Host: node, Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(bs))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: node: %s, %v", errUnreachable, node, err)
+	}
+	defer func() {
+		// the connection only goes back to the pool once the body is read
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+	checksum := res.Header.Get(models.RingChecksumHeader)
+
+	if res.StatusCode != http.StatusOK {
+		var errRes models.ErrorResponse
+		_ = json.NewDecoder(res.Body).Decode(&errRes)
+		if errRes.Error == "" {
+			errRes.Error = http.StatusText(res.StatusCode)
+		}
+		err = fmt.Errorf("node: %s responded with status: %d, %s", node, res.StatusCode, errRes.Error)
+		switch res.StatusCode {
+		case http.StatusBadRequest:
+			return checksum, fmt.Errorf("%w: %v", models.ErrInvalidRequest, err)
+		case http.StatusUnauthorized:
+			return checksum, fmt.Errorf("%w: %v", models.ErrUnauthorized, err)
+		case http.StatusServiceUnavailable:
+			return checksum, fmt.Errorf("%w: %v", models.ErrUnavailable, err)
+		}
+		return checksum, err
+	}
+
+	if v == nil {
+		return checksum, nil
+	}
+	return checksum, json.NewDecoder(res.Body).Decode(v)
+}
+
+// checkRing reads the ring again from the node when its checksum changed.
+// The requests keep using the old ring in the meantime
+func (c *Client) checkRing(node, checksum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if checksum == "" || checksum == c.ring.checksum || c.refreshing {
+		return
+	}
+	c.refreshing = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		_ = c.refresh(ctx, node)
+
+		c.mu.Lock()
+		c.refreshing = false
+		c.mu.Unlock()
+	}()
+}
+
+func (c *Client) refresh(ctx context.Context, node string) error {
+	var res models.RingResponse
+	_, err := c.send(ctx, node, http.MethodGet, "ring", nil, &res)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ring, c.failed = newRing(res), map[string]bool{}
+	return nil
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/clustertest"
+	"distributed-db/models"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// similar keys get similar tokens, they are spread with a hash so every node owns some
+func key(i int) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(i))))
+}
+
+// requests returns how many requests of the route the nodes served
+func requests(c *clustertest.Cluster, route string) uint64 {
+	count := uint64(0)
+	for _, node := range c.Nodes() {
+		for _, req := range node.Service.Metrics().Counters.Requests {
+			if req.Route == route {
+				count += req.Count
+			}
+		}
+	}
+	return count
+}
+
+// TestRoutesToOwners checks the requests reach the owners of the keys
+// without being forwarded to other nodes
+func TestRoutesToOwners(t *testing.T) {
+	c := clustertest.New(t, 3, 1)
+	ctx := context.Background()
+	cl, err := New(ctx, []string{c.Node(0).Addr})
+	if err != nil {
+		t.Fatalf("could not create the client: %v", err)
+	}
+	defer cl.Close()
+
+	reqs, keys := make([]models.SetRequest, 0), make([]string, 0)
+	for i := 0; i < 50; i++ {
+		reqs, keys = append(reqs, models.SetRequest{Key: key(i), Value: "value"}), append(keys, key(i))
+	}
+	_, err = cl.SetBatch(ctx, reqs)
+	if err != nil {
+		t.Fatalf("could not set the items: %v", err)
+	}
+	items, err := cl.Get(ctx, models.GetRequest{Keys: keys})
+	if err != nil || len(items) != len(keys) {
+		t.Fatalf("could not get the items: %d, %v", len(items), err)
+	}
+
+	if forwarded := requests(c, "/set/batch"); forwarded > 0 {
+		t.Fatalf("%d write(s) were forwarded", forwarded)
+	}
+	if gets, owners := requests(c, "/get"), len(cl.group("", keys)); gets != uint64(owners) {
+		t.Fatalf("expected a read per owner: %d, got: %d", owners, gets)
+	}
+
+	err = cl.Delete(ctx, models.DeleteRequest{Keys: keys})
+	if err != nil {
+		t.Fatalf("could not delete the items: %v", err)
+	}
+	items, err = cl.Get(ctx, models.GetRequest{Keys: keys})
+	if err != nil || len(items) != 0 {
+		t.Fatalf("expected the items to be deleted: %d, %v", len(items), err)
+	}
+}
+
+// TestFallbackAndRefresh writes while a node is down, the writes it owns go through
+// the other nodes. The client must then notice a node joined from the ring checksums
+func TestFallbackAndRefresh(t *testing.T) {
+	c := clustertest.New(t, 3, 2)
+	ctx := context.Background()
+	cl, err := New(ctx, []string{c.Node(0).Addr})
+	if err != nil {
+		t.Fatalf("could not create the client: %v", err)
+	}
+	defer cl.Close()
+
+	c.Kill(1)
+	for i := 0; i < 30; i++ {
+		_, err = cl.Set(ctx, models.SetRequest{Key: key(i), Value: "value"})
+		if err != nil {
+			t.Fatalf("could not set key: %d with a node down, %v", i, err)
+		}
+	}
+	if !cl.failed[c.Node(1).Addr] {
+		t.Fatalf("the node which is down was not tried")
+	}
+
+	c.Add(0)
+	if !c.Converge(20) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	expected := c.Node(0).Service.RingChecksum()
+	for start := time.Now(); ; {
+		_, err = cl.Get(ctx, models.GetRequest{Keys: []string{key(0)}})
+		if err != nil {
+			t.Fatalf("could not get the key: %v", err)
+		}
+		cl.mu.Lock()
+		checksum := cl.ring.checksum
+		cl.mu.Unlock()
+		if checksum == expected {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the client did not read the new ring")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
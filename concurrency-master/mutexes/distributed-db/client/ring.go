@@ -0,0 +1,68 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+
+	"distributed-db/models"
+)
+
+// ring is the copy of the token ring of the cluster, it is replaced as a whole
+type ring struct {
+	checksum string
+	tokens   []models.RingToken
+	// the nodes which are up
+	up []string
+}
+
+func newRing(res models.RingResponse) *ring {
+	r := &ring{
+		checksum: res.Checksum,
+		tokens:   append([]models.RingToken{}, res.Tokens...),
+		up:       make([]string, 0, len(res.Nodes)),
+	}
+	sort.Slice(r.tokens, func(i, j int) bool {
+		return r.tokens[i].Token < r.tokens[j].Token
+	})
+	for _, node := range res.Nodes {
+		if node.Status == models.NodeStatusText(models.NodeStatusUp) {
+			r.up = append(r.up, node.Node)
+		}
+	}
+	return r
+}
+
+// owner returns the node owning the key, the first token after the token
+// of the key, wrapping around the ring, like the nodes do
+func (r *ring) owner(key string) string {
+	if len(r.tokens) == 0 {
+		return ""
+	}
+
+	token := int(models.HashKey(key))
+	idx := sort.Search(len(r.tokens), func(i int) bool {
+		return r.tokens[i].Token >= token
+	})
+	if idx == len(r.tokens) {
+		idx = 0
+	}
+	return r.tokens[idx].Node
+}
+
+// candidates returns the node followed by the other nodes which are up, in random order,
+// the nodes which failed recently come last
+func (r *ring) candidates(node string, failed map[string]bool) []string {
+	nodes := make([]string, 0, len(r.up)+1)
+	if node != "" {
+		nodes = append(nodes, node)
+	}
+	for _, i := range rand.Perm(len(r.up)) {
+		if r.up[i] != node {
+			nodes = append(nodes, r.up[i])
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return !failed[nodes[i]] && failed[nodes[j]]
+	})
+	return nodes
+}
@@ -2,16 +2,21 @@ package clients
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
+	"distributed-db/auth"
 	"distributed-db/models"
 )
 
-func NewHTTP(host string) *HTTPClient {
+func NewHTTP(host string, signer *auth.Signer) *HTTPClient {
 	client := HTTPClient{
 		host:       host,
+		signer:     signer,
 		httpClient: &http.Client{},
 	}
 	return &client
@@ -19,23 +24,18 @@ func NewHTTP(host string) *HTTPClient {
 
 type HTTPClient struct {
 	host       string
+	signer     *auth.Signer
 	httpClient *http.Client
 }
 
-func (c *HTTPClient) Get(node string, keys []string) ([]models.CacheItem, error) {
-	body := models.GetRequest{Keys: keys}
-	req, err := c.makeRequest(http.MethodGet, c.url(node, "get"), body)
-	if err != nil {
-		return []models.CacheItem{}, err
-	}
-
-	res, err := c.httpClient.Do(req)
+func (c *HTTPClient) Get(node string, body models.GetRequest) ([]models.CacheItem, error) {
+	req, err := c.makeRequest(http.MethodGet, c.url(node, "get/replica"), body)
 	if err != nil {
 		return []models.CacheItem{}, err
 	}
 
 	var cacheItems []models.CacheItem
-	err = json.NewDecoder(res.Body).Decode(&cacheItems)
+	err = c.do(req, &cacheItems)
 	if err != nil {
 		return []models.CacheItem{}, err
 	}
@@ -43,23 +43,14 @@ func (c *HTTPClient) Get(node string, keys []string) ([]models.CacheItem, error)
 	return cacheItems, nil
 }
 
-func (c *HTTPClient) Set(node string, key, value string) (models.CacheItem, error) {
-	body := models.SetRequest{
-		Key:   key,
-		Value: value,
-	}
+func (c *HTTPClient) Set(node string, body models.SetRequest) (models.CacheItem, error) {
 	req, err := c.makeRequest(http.MethodPost, c.url(node, "set"), body)
 	if err != nil {
 		return models.CacheItem{}, err
 	}
 
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return models.CacheItem{}, err
-	}
-
 	var item models.CacheItem
-	err = json.NewDecoder(res.Body).Decode(&item)
+	err = c.do(req, &item)
 	if err != nil {
 		return models.CacheItem{}, err
 	}
@@ -75,13 +66,8 @@ func (c *HTTPClient) SetBatch(node string, items map[int]models.CacheItem) ([]mo
 		return []models.CacheItem{}, err
 	}
 
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return []models.CacheItem{}, err
-	}
-
 	var cacheItems []models.CacheItem
-	err = json.NewDecoder(res.Body).Decode(&items)
+	err = c.do(req, &cacheItems)
 	if err != nil {
 		return []models.CacheItem{}, err
 	}
@@ -89,28 +75,46 @@ func (c *HTTPClient) SetBatch(node string, items map[int]models.CacheItem) ([]mo
 	return cacheItems, nil
 }
 
-func (c *HTTPClient) Gossip(node string, nodes models.NodesMap, tokensChecksum string) (models.NodesMap, error) {
-	body := models.GossipRequest{
-		Nodes:          nodes,
-		TokensChecksum: tokensChecksum,
-	}
+func (c *HTTPClient) Gossip(node string, body models.GossipRequest) (models.GossipResponse, error) {
 	req, err := c.makeRequest(http.MethodPost, c.url(node, "gossip"), body)
 	if err != nil {
-		return models.NodesMap{}, err
+		return models.GossipResponse{}, err
 	}
 
-	res, err := c.httpClient.Do(req)
+	var gossipRes models.GossipResponse
+	err = c.do(req, &gossipRes)
 	if err != nil {
-		return models.NodesMap{}, err
+		return models.GossipResponse{}, err
 	}
 
-	var gossipRes models.GossipResponse
-	err = json.NewDecoder(res.Body).Decode(&gossipRes)
+	return gossipRes, nil
+}
+
+// Ping probes the node, giving up after the timeout
+func (c *HTTPClient) Ping(node string, body models.PingRequest, timeout time.Duration) (models.PingResponse, error) {
+	return c.ping(c.url(node, "ping"), body, timeout)
+}
+
+// IndirectPing asks the node to probe the target on behalf of the current node
+func (c *HTTPClient) IndirectPing(node string, body models.IndirectPingRequest, timeout time.Duration) (models.PingResponse, error) {
+	return c.ping(c.url(node, "ping/indirect"), body, timeout)
+}
+
+func (c *HTTPClient) ping(url string, body interface{}, timeout time.Duration) (models.PingResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, url, body)
+	if err != nil {
+		return models.PingResponse{}, err
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	var pingRes models.PingResponse
+	err = c.do(req.WithContext(ctx), &pingRes)
 	if err != nil {
-		return models.NodesMap{}, err
+		return models.PingResponse{}, err
 	}
 
-	return gossipRes.Nodes, nil
+	return pingRes, nil
 }
 
 func (c *HTTPClient) Tokens(node string) (models.TokenMappings, error) {
@@ -119,18 +123,156 @@ func (c *HTTPClient) Tokens(node string) (models.TokenMappings, error) {
 		return models.TokenMappings{}, err
 	}
 
-	res, err := c.httpClient.Do(req)
+	var tokensRes models.TokensResponse
+	err = c.do(req, &tokensRes)
 	if err != nil {
 		return models.TokenMappings{}, err
 	}
 
-	var tokensRes models.TokensResponse
-	err = json.NewDecoder(res.Body).Decode(&tokensRes)
+	return tokensRes.Tokens, nil
+}
+
+func (c *HTTPClient) MerkleTree(node string, body models.MerkleRequest) (models.MerkleTree, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "merkle"), body)
 	if err != nil {
-		return models.TokenMappings{}, err
+		return models.MerkleTree{}, err
 	}
 
-	return tokensRes.Tokens, nil
+	var tree models.MerkleTree
+	err = c.do(req, &tree)
+	if err != nil {
+		return models.MerkleTree{}, err
+	}
+
+	return tree, nil
+}
+
+func (c *HTTPClient) RangeItems(node string, ranges []models.TokenRange) (map[int]models.CacheItem, error) {
+	body := models.RangeItemsRequest{Ranges: ranges}
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "merkle/items"), body)
+	if err != nil {
+		return map[int]models.CacheItem{}, err
+	}
+
+	var res models.RangeItemsResponse
+	err = c.do(req, &res)
+	if err != nil {
+		return map[int]models.CacheItem{}, err
+	}
+
+	return res.Items, nil
+}
+
+func (c *HTTPClient) Scan(node string, body models.ScanRequest) (models.ScanResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "scan/local"), body)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+
+	var scanRes models.ScanResponse
+	err = c.do(req, &scanRes)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+
+	return scanRes, nil
+}
+
+func (c *HTTPClient) CAS(node string, body models.CASRequest) (models.CASResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "cas/local"), body)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+
+	var casRes models.CASResponse
+	err = c.do(req, &casRes)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+
+	return casRes, nil
+}
+
+func (c *HTTPClient) Prepare(node string, body models.PrepareRequest) (models.PrepareResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "cas/prepare"), body)
+	if err != nil {
+		return models.PrepareResponse{}, err
+	}
+
+	var prepareRes models.PrepareResponse
+	err = c.do(req, &prepareRes)
+	if err != nil {
+		return models.PrepareResponse{}, err
+	}
+
+	return prepareRes, nil
+}
+
+func (c *HTTPClient) Propose(node string, body models.ProposeRequest) (models.ProposeResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "cas/propose"), body)
+	if err != nil {
+		return models.ProposeResponse{}, err
+	}
+
+	var proposeRes models.ProposeResponse
+	err = c.do(req, &proposeRes)
+	if err != nil {
+		return models.ProposeResponse{}, err
+	}
+
+	return proposeRes, nil
+}
+
+func (c *HTTPClient) Commit(node string, body models.CommitRequest) (models.CommitResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "cas/commit"), body)
+	if err != nil {
+		return models.CommitResponse{}, err
+	}
+
+	var commitRes models.CommitResponse
+	err = c.do(req, &commitRes)
+	if err != nil {
+		return models.CommitResponse{}, err
+	}
+
+	return commitRes, nil
+}
+
+func (c *HTTPClient) Changes(ctx context.Context, node string, body models.ChangesRequest) (models.ChangesResponse, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "watch/changes"), body)
+	if err != nil {
+		return models.ChangesResponse{}, err
+	}
+	req = req.WithContext(ctx)
+
+	var changesRes models.ChangesResponse
+	err = c.do(req, &changesRes)
+	if err != nil {
+		return models.ChangesResponse{}, err
+	}
+
+	return changesRes, nil
+}
+
+func (c *HTTPClient) BackupPart(node string, body models.BackupRequest) (models.BackupManifest, error) {
+	req, err := c.makeRequest(http.MethodPost, c.url(node, "backup/node"), body)
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+
+	var backupRes models.BackupManifest
+	err = c.do(req, &backupRes)
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+
+	return backupRes, nil
+}
+
+// Close closes the idle connections to the nodes
+func (c *HTTPClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
 }
 
 func (c *HTTPClient) url(node, path string) string {
@@ -153,6 +295,29 @@ func (c *HTTPClient) makeRequest(method, url string, body interface{}) (*http.Re
 		return nil, err
 	}
 	req.Host = c.host
+	c.signer.SignRequest(req, bs)
 
 	return req, nil
 }
+
+// do sends the request and decodes the response body into v.
+// Error responses are turned into errors, so the callers
+// don't mistake them for successful responses
+func (c *HTTPClient) do(req *http.Request, v interface{}) error {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var errRes models.ErrorResponse
+		_ = json.NewDecoder(res.Body).Decode(&errRes)
+		if errRes.Error == "" {
+			errRes.Error = http.StatusText(res.StatusCode)
+		}
+		return fmt.Errorf("node: %s responded with status: %d, %s", req.URL.Host, res.StatusCode, errRes.Error)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,469 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-db/auth"
+	"distributed-db/models"
+	"distributed-db/protocol"
+)
+
+const (
+	tcpPoolSize    = 4
+	tcpDialTimeout = 5 * time.Second
+	// calls don't hang forever on a connection which stopped answering
+	tcpCallTimeout = time.Minute
+	// backups copy the tables when they can't be linked, which takes longer
+	tcpBackupTimeout = 30 * time.Minute
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// NewTCP creates a client talking the binary protocol to the other nodes.
+// Nodes are still identified by their http address, the binary protocol
+// is served on the http port plus the port offset
+func NewTCP(host string, portOffset int, signer *auth.Signer) *TCPClient {
+	client := TCPClient{
+		host:       host,
+		portOffset: portOffset,
+		signer:     signer,
+		pools:      map[string]*tcpPool{},
+	}
+	return &client
+}
+
+type TCPClient struct {
+	host       string
+	portOffset int
+	signer     *auth.Signer
+	mu         sync.Mutex
+	pools      map[string]*tcpPool
+}
+
+func (c *TCPClient) Get(node string, body models.GetRequest) ([]models.CacheItem, error) {
+	var cacheItems []models.CacheItem
+	err := c.call(node, protocol.OpGet, body, &cacheItems, tcpCallTimeout)
+	if err != nil {
+		return []models.CacheItem{}, err
+	}
+
+	return cacheItems, nil
+}
+
+func (c *TCPClient) Set(node string, body models.SetRequest) (models.CacheItem, error) {
+	var item models.CacheItem
+	err := c.call(node, protocol.OpSet, body, &item, tcpCallTimeout)
+	if err != nil {
+		return models.CacheItem{}, err
+	}
+	item.Node = node
+
+	return item, nil
+}
+
+func (c *TCPClient) SetBatch(node string, items map[int]models.CacheItem) ([]models.CacheItem, error) {
+	body := models.SetBatchRequest{Items: items}
+	var cacheItems []models.CacheItem
+	err := c.call(node, protocol.OpSetBatch, body, &cacheItems, tcpCallTimeout)
+	if err != nil {
+		return []models.CacheItem{}, err
+	}
+
+	return cacheItems, nil
+}
+
+func (c *TCPClient) Gossip(node string, body models.GossipRequest) (models.GossipResponse, error) {
+	var gossipRes models.GossipResponse
+	err := c.call(node, protocol.OpGossip, body, &gossipRes, tcpCallTimeout)
+	if err != nil {
+		return models.GossipResponse{}, err
+	}
+
+	return gossipRes, nil
+}
+
+func (c *TCPClient) Ping(node string, body models.PingRequest, timeout time.Duration) (models.PingResponse, error) {
+	var pingRes models.PingResponse
+	err := c.call(node, protocol.OpPing, body, &pingRes, timeout)
+	if err != nil {
+		return models.PingResponse{}, err
+	}
+
+	return pingRes, nil
+}
+
+func (c *TCPClient) IndirectPing(node string, body models.IndirectPingRequest, timeout time.Duration) (models.PingResponse, error) {
+	var pingRes models.PingResponse
+	err := c.call(node, protocol.OpIndirectPing, body, &pingRes, timeout)
+	if err != nil {
+		return models.PingResponse{}, err
+	}
+
+	return pingRes, nil
+}
+
+func (c *TCPClient) Tokens(node string) (models.TokenMappings, error) {
+	var tokensRes models.TokensResponse
+	err := c.call(node, protocol.OpTokens, nil, &tokensRes, tcpCallTimeout)
+	if err != nil {
+		return models.TokenMappings{}, err
+	}
+
+	return tokensRes.Tokens, nil
+}
+
+func (c *TCPClient) MerkleTree(node string, body models.MerkleRequest) (models.MerkleTree, error) {
+	var tree models.MerkleTree
+	err := c.call(node, protocol.OpMerkleTree, body, &tree, tcpCallTimeout)
+	if err != nil {
+		return models.MerkleTree{}, err
+	}
+
+	return tree, nil
+}
+
+func (c *TCPClient) RangeItems(node string, ranges []models.TokenRange) (map[int]models.CacheItem, error) {
+	body := models.RangeItemsRequest{Ranges: ranges}
+	var res models.RangeItemsResponse
+	err := c.call(node, protocol.OpRangeItems, body, &res, tcpCallTimeout)
+	if err != nil {
+		return map[int]models.CacheItem{}, err
+	}
+
+	return res.Items, nil
+}
+
+func (c *TCPClient) Scan(node string, body models.ScanRequest) (models.ScanResponse, error) {
+	var scanRes models.ScanResponse
+	err := c.call(node, protocol.OpScan, body, &scanRes, tcpCallTimeout)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+
+	return scanRes, nil
+}
+
+func (c *TCPClient) CAS(node string, body models.CASRequest) (models.CASResponse, error) {
+	var casRes models.CASResponse
+	err := c.call(node, protocol.OpCAS, body, &casRes, tcpCallTimeout)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+
+	return casRes, nil
+}
+
+func (c *TCPClient) Prepare(node string, body models.PrepareRequest) (models.PrepareResponse, error) {
+	var prepareRes models.PrepareResponse
+	err := c.call(node, protocol.OpPrepare, body, &prepareRes, tcpCallTimeout)
+	if err != nil {
+		return models.PrepareResponse{}, err
+	}
+
+	return prepareRes, nil
+}
+
+func (c *TCPClient) Propose(node string, body models.ProposeRequest) (models.ProposeResponse, error) {
+	var proposeRes models.ProposeResponse
+	err := c.call(node, protocol.OpPropose, body, &proposeRes, tcpCallTimeout)
+	if err != nil {
+		return models.ProposeResponse{}, err
+	}
+
+	return proposeRes, nil
+}
+
+func (c *TCPClient) Commit(node string, body models.CommitRequest) (models.CommitResponse, error) {
+	var commitRes models.CommitResponse
+	err := c.call(node, protocol.OpCommit, body, &commitRes, tcpCallTimeout)
+	if err != nil {
+		return models.CommitResponse{}, err
+	}
+
+	return commitRes, nil
+}
+
+// Changes is a long poll, the call waits longer than the node holds it,
+// unless the context is done first
+func (c *TCPClient) Changes(ctx context.Context, node string, body models.ChangesRequest) (models.ChangesResponse, error) {
+	var changesRes models.ChangesResponse
+	err := c.callContext(ctx, node, protocol.OpChanges, body, &changesRes, tcpCallTimeout+time.Duration(body.Wait))
+	if err != nil {
+		return models.ChangesResponse{}, err
+	}
+
+	return changesRes, nil
+}
+
+func (c *TCPClient) BackupPart(node string, body models.BackupRequest) (models.BackupManifest, error) {
+	var backupRes models.BackupManifest
+	err := c.call(node, protocol.OpBackup, body, &backupRes, tcpBackupTimeout)
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+
+	return backupRes, nil
+}
+
+// Close closes the connections to all the nodes
+func (c *TCPClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, pool := range c.pools {
+		pool.close()
+	}
+	c.pools = map[string]*tcpPool{}
+	return nil
+}
+
+// call sends the request to the node and waits for the response to be
+// decoded into res. A nil body sends a request without payload
+func (c *TCPClient) call(node string, op protocol.Op, body, res interface{}, timeout time.Duration) error {
+	return c.callContext(context.Background(), node, op, body, res, timeout)
+}
+
+// callContext is call giving up on the response once the context is done
+func (c *TCPClient) callContext(ctx context.Context, node string, op protocol.Op, body, res interface{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	conn, err := c.pool(node).get(deadline)
+	if err != nil {
+		return fmt.Errorf("could not connect to node: %s, %w", node, err)
+	}
+
+	done, err := conn.send(op, body, res)
+	if err != nil {
+		return fmt.Errorf("could not send request to node: %s, %w", node, err)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("node: %s responded with: %w", node, err)
+		}
+		return nil
+	case <-timer.C:
+		// the response is still decoded when it arrives, the stream depends on it
+		return fmt.Errorf("node: %s did not respond in %v", node, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *TCPClient) pool(node string) *tcpPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pool, ok := c.pools[node]
+	if !ok {
+		pool = &tcpPool{
+			host:   c.host,
+			signer: c.signer,
+			addr:   c.tcpAddr(node),
+			conns:  make([]*tcpConn, tcpPoolSize),
+		}
+		c.pools[node] = pool
+	}
+	return pool
+}
+
+func (c *TCPClient) tcpAddr(node string) string {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return node
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return node
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+c.portOffset))
+}
+
+// tcpPool keeps persistent connections to a node. Calls are spread over
+// the connections round robin and broken connections get redialed
+type tcpPool struct {
+	host   string
+	signer *auth.Signer
+	addr   string
+	mu     sync.Mutex
+	conns  []*tcpConn
+	next   int
+}
+
+func (p *tcpPool) get(deadline time.Time) (*tcpConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if conn := p.conns[i]; conn != nil && !conn.isClosed() {
+		return conn, nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout > tcpDialTimeout {
+		timeout = tcpDialTimeout
+	}
+	conn, err := dialTCP(p.addr, p.host, p.signer, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[i] = conn
+	return conn, nil
+}
+
+func (p *tcpPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		if conn != nil {
+			conn.close(errConnClosed)
+		}
+	}
+}
+
+type tcpCall struct {
+	res  interface{}
+	done chan error
+}
+
+// tcpConn pipelines requests: any number of them can be in flight,
+// a single goroutine reads the responses and hands them to their callers
+type tcpConn struct {
+	conn    net.Conn
+	codec   *protocol.Codec
+	signer  *auth.Signer
+	nonce   []byte
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*tcpCall
+	err     error
+}
+
+func dialTCP(addr, host string, signer *auth.Signer, timeout time.Duration) (*tcpConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, nonce := signer.Hello(host)
+	err = protocol.WriteFrame(conn, protocol.Frame{Op: protocol.OpHello, Payload: hello})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &tcpConn{
+		conn:    conn,
+		codec:   protocol.NewCodec(),
+		signer:  signer,
+		nonce:   nonce,
+		pending: map[uint64]*tcpCall{},
+	}
+	go c.read()
+	return c, nil
+}
+
+// send writes the request and returns the channel its response is handed to.
+// The ids are taken in the order the requests are written, the server rejects
+// a request whose id is not greater than the previous one
+func (c *tcpConn) send(op protocol.Op, body, res interface{}) (<-chan error, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	call := &tcpCall{res: res, done: make(chan error, 1)}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = call
+	c.mu.Unlock()
+
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = c.codec.Encode(body)
+		if err != nil {
+			// the encoder may have been left halfway through a type definition
+			c.close(err)
+			return nil, err
+		}
+	}
+	f := protocol.Seal(c.signer, c.nonce, protocol.ToServer, protocol.Frame{ID: id, Op: op, Payload: payload})
+	err := protocol.WriteFrame(c.conn, f)
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	return call.done, nil
+}
+
+func (c *tcpConn) read() {
+	for {
+		f, err := protocol.ReadFrame(c.conn)
+		if err == nil {
+			f, err = protocol.Open(c.signer, c.nonce, protocol.ToClient, f)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+		call, ok := c.pending[f.ID]
+		delete(c.pending, f.ID)
+		c.mu.Unlock()
+		if !ok {
+			c.close(fmt.Errorf("unexpected response: %d", f.ID))
+			return
+		}
+
+		if f.Status != protocol.StatusOK {
+			call.done <- errors.New(string(f.Payload))
+			continue
+		}
+		err = c.codec.Decode(f.Payload, call.res)
+		call.done <- err
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *tcpConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil
+}
+
+// close fails all the calls in flight, the connection can't be used anymore
+func (c *tcpConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, call := range c.pending {
+		call.done <- err
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,258 @@
+package clients
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-db/auth"
+	"distributed-db/controllers"
+	"distributed-db/models"
+	"distributed-db/protocol"
+)
+
+const testHost = "localhost:9000"
+
+// fakeNode answers the reads and the pings of the client. The reads of the held keys
+// and the pings, while pings are held, wait until they are released
+type fakeNode struct {
+	controllers.NodeService
+	mu       sync.Mutex
+	held     map[string]chan struct{}
+	pings    chan struct{}
+	received chan string
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{held: map[string]chan struct{}{}, received: make(chan string, 100)}
+}
+
+func (n *fakeNode) Get(req models.GetRequest) (models.GetResponse, error) {
+	n.mu.Lock()
+	release := n.held[req.Keys[0]]
+	n.mu.Unlock()
+	n.received <- req.Keys[0]
+	if release != nil {
+		<-release
+	}
+	return models.GetResponse{Items: []models.CacheItem{{Key: req.Keys[0], Value: "value"}}}, nil
+}
+
+func (n *fakeNode) Ping(req models.PingRequest) models.PingResponse {
+	n.mu.Lock()
+	release := n.pings
+	n.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return models.PingResponse{}
+}
+
+func (n *fakeNode) hold(key string) chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	release := make(chan struct{})
+	n.held[key] = release
+	return release
+}
+
+// serveTCP serves the node on the address, an ephemeral port when the address is empty,
+// and returns the address the server listens on
+func serveTCP(t *testing.T, addr string, signer *auth.Signer, node controllers.NodeService) (*controllers.TCPServer, string) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not listen on: %s, %v", addr, err)
+	}
+	srv := controllers.NewTCPServer(node, signer, models.NewMetrics())
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv, listener.Addr().String()
+}
+
+// newSingleConnTCP returns a client which sends all its calls to the node over a single connection
+func newSingleConnTCP(signer *auth.Signer, node string) *TCPClient {
+	client := NewTCP(testHost, 0, signer)
+	client.pools[node] = &tcpPool{host: testHost, signer: signer, addr: node, conns: make([]*tcpConn, 1)}
+	return client
+}
+
+func get(client *TCPClient, node, key string) (string, error) {
+	items, err := client.Get(node, models.GetRequest{Keys: []string{key}})
+	if err != nil {
+		return "", err
+	}
+	if len(items) != 1 {
+		return "", fmt.Errorf("expected 1 item, got: %d", len(items))
+	}
+	return items[0].Key, nil
+}
+
+// TestTCPPipelining sends many calls at once over a single connection while the first
+// one is held by the server. The responses come back out of order, every caller must
+// get the response to its own request, and the held call must not block the others
+func TestTCPPipelining(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	signer, node := auth.NewSigner("secret"), newFakeNode()
+	_, addr := serveTCP(t, "", signer, node)
+	client := newSingleConnTCP(signer, addr)
+	defer client.Close()
+
+	release := node.hold("slow")
+	slow := make(chan string, 1)
+	go func() {
+		key, err := get(client, addr, "slow")
+		if err != nil {
+			t.Errorf("could not get the slow key: %v", err)
+		}
+		slow <- key
+	}()
+	if key := <-node.received; key != "slow" {
+		t.Fatalf("expected the slow call first, got: %s", key)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			got, err := get(client, addr, key)
+			if err != nil || got != key {
+				t.Errorf("expected key: %s, got: %s, %v", key, got, err)
+			}
+		}(fmt.Sprintf("key:%d", i))
+	}
+	wg.Wait()
+
+	select {
+	case key := <-slow:
+		t.Fatalf("the slow call returned before it was released: %s", key)
+	default:
+	}
+	close(release)
+	if key := <-slow; key != "slow" {
+		t.Fatalf("expected the slow key, got: %s", key)
+	}
+}
+
+// TestTCPTimeout gives up on a call the server holds. The late response must be
+// dropped without breaking the connection, which keeps serving the next calls
+func TestTCPTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	signer, node := auth.NewSigner("secret"), newFakeNode()
+	node.pings = make(chan struct{})
+	_, addr := serveTCP(t, "", signer, node)
+	client := newSingleConnTCP(signer, addr)
+	defer client.Close()
+
+	start := time.Now()
+	_, err := client.Ping(addr, models.PingRequest{}, 50*time.Millisecond)
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expected the ping to time out, got: %v after: %v", err, time.Since(start))
+	}
+	conn := client.pools[addr].conns[0]
+
+	close(node.pings)
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if got, err := get(client, addr, key); err != nil || got != key {
+			t.Fatalf("expected key: %s after the timeout, got: %s, %v", key, got, err)
+		}
+	}
+	if client.pools[addr].conns[0] != conn || conn.isClosed() {
+		t.Fatal("the connection was not kept after the timeout")
+	}
+}
+
+// TestTCPReconnect stops the server under an open connection. The calls fail while
+// the server is down, and the client dials again once it is back on the same address
+func TestTCPReconnect(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	signer, node := auth.NewSigner("secret"), newFakeNode()
+	srv, addr := serveTCP(t, "", signer, node)
+	client := newSingleConnTCP(signer, addr)
+	defer client.Close()
+
+	if _, err := get(client, addr, "key"); err != nil {
+		t.Fatalf("could not get the key: %v", err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("could not stop the server: %v", err)
+	}
+	if _, err := get(client, addr, "key"); err == nil {
+		t.Fatal("expected the call to fail while the server is down")
+	}
+
+	serveTCP(t, addr, signer, node)
+	if _, err := get(client, addr, "key"); err != nil {
+		t.Fatalf("could not get the key once the server is back: %v", err)
+	}
+}
+
+// TestTCPReplayedFrame writes a request frame twice on the same connection,
+// as an attacker replaying a recorded frame would. The server must answer the
+// requests and drop the connection on the replayed one
+func TestTCPReplayedFrame(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	signer := auth.NewSigner("secret")
+	_, addr := serveTCP(t, "", signer, newFakeNode())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	hello, nonce := signer.Hello(testHost)
+	if err = protocol.WriteFrame(conn, protocol.Frame{Op: protocol.OpHello, Payload: hello}); err != nil {
+		t.Fatalf("could not say hello: %v", err)
+	}
+	// the first payload of the codec carries the type definitions, the second one
+	// decodes again, so only the id tells the replayed frame apart
+	codec, frames := protocol.NewCodec(), make([]protocol.Frame, 0, 2)
+	for id := uint64(1); id <= 2; id++ {
+		payload, err := codec.Encode(models.GetRequest{Keys: []string{"key"}})
+		if err != nil {
+			t.Fatalf("could not encode the request: %v", err)
+		}
+		frames = append(frames, protocol.Seal(signer, nonce, protocol.ToServer, protocol.Frame{ID: id, Op: protocol.OpGet, Payload: payload}))
+	}
+	for _, f := range frames {
+		if err = protocol.WriteFrame(conn, f); err != nil {
+			t.Fatalf("could not send the request: %v", err)
+		}
+		res, err := protocol.ReadFrame(conn)
+		if err == nil {
+			res, err = protocol.Open(signer, nonce, protocol.ToClient, res)
+		}
+		if err != nil || res.ID != f.ID || res.Status != protocol.StatusOK {
+			t.Fatalf("expected the response to request: %d, got: %+v, %v", f.ID, res, err)
+		}
+	}
+
+	f := frames[1]
+	if err = protocol.WriteFrame(conn, f); err != nil {
+		t.Fatalf("could not send the request again: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err := protocol.ReadFrame(conn); err == nil {
+		t.Fatalf("expected the connection to be dropped, got: %+v", res)
+	}
+}
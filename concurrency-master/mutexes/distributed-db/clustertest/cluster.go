@@ -0,0 +1,227 @@
+// Package clustertest boots clusters of nodes in a single process, on ephemeral
+// localhost ports, so the interactions between the nodes can be tested.
+// The workers don't run, the tests run their rounds on the services of the
+// nodes, and faults can be injected in the traffic between the nodes
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-db/app"
+	"distributed-db/models"
+	"distributed-db/services"
+)
+
+// New boots n nodes which all know each other. The replication factor
+// is used for the requests which don't specify one.
+// The nodes are stopped when the test ends
+func New(t testing.TB, n, replicationFactor int) *Cluster {
+	c := &Cluster{
+		t:                 t,
+		replicationFactor: replicationFactor,
+		faults:            newFaults(),
+		dir:               t.TempDir(),
+	}
+	// registered after the data directory, so the nodes stop before it gets removed
+	t.Cleanup(c.stop)
+
+	listeners := make([]net.Listener, 0, n)
+	seeds := models.NodesMap{}
+	for i := 0; i < n; i++ {
+		listener := c.listen("localhost:0")
+		listeners = append(listeners, listener)
+		seeds[addrOf(listener)] = models.NodeStatusUp
+	}
+	for _, listener := range listeners {
+		c.start(listener, seeds)
+	}
+	return c
+}
+
+// Cluster is a set of nodes running in the test process
+type Cluster struct {
+	t                 testing.TB
+	replicationFactor int
+	nodes             []*Node
+	faults            *faults
+	dir               string
+}
+
+// Node is a node of the cluster, its service is replaced when it gets restarted
+type Node struct {
+	Addr    string
+	Service services.CacheSvc
+	app     *app.App
+	dataDir string
+	seeds   models.NodesMap
+	cancel  context.CancelFunc
+	running bool
+}
+
+// Node returns the i-th node, in the order the nodes were started
+func (c *Cluster) Node(i int) *Node {
+	return c.nodes[i]
+}
+
+// Nodes returns the nodes which are running
+func (c *Cluster) Nodes() []*Node {
+	nodes := make([]*Node, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if node.running {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Add boots a new node which only knows the given nodes,
+// it joins the cluster once they gossiped about it
+func (c *Cluster) Add(seeds ...int) *Node {
+	nodes := models.NodesMap{}
+	for _, i := range seeds {
+		nodes[c.nodes[i].Addr] = models.NodeStatusUp
+	}
+	return c.start(c.listen("localhost:0"), nodes)
+}
+
+// Kill stops the i-th node, the other nodes can no longer reach it.
+// Its data is kept for a restart
+func (c *Cluster) Kill(i int) {
+	node := c.nodes[i]
+	if !node.running {
+		return
+	}
+	node.running = false
+	node.cancel()
+
+	// the requests in flight are not waited for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := node.app.Stop(ctx)
+	if err != nil {
+		c.t.Fatalf("could not stop node: %s, %v", node.Addr, err)
+	}
+}
+
+// Restart boots the i-th node again on the same address, with the data it had
+func (c *Cluster) Restart(i int) {
+	c.Kill(i)
+	node := c.nodes[i]
+	c.run(node, c.listen(node.Addr))
+}
+
+// Partition splits the given nodes from the others, the nodes
+// on each side can only reach the nodes on the same side
+func (c *Cluster) Partition(nodes ...int) {
+	addrs := make([]string, 0, len(nodes))
+	for _, i := range nodes {
+		addrs = append(addrs, c.nodes[i].Addr)
+	}
+	c.faults.partition(addrs)
+}
+
+// Delay holds the requests sent to and by the i-th node for d before serving them
+func (c *Cluster) Delay(i int, d time.Duration) {
+	c.faults.delay(c.nodes[i].Addr, d)
+}
+
+// Heal removes the partitions and the delays
+func (c *Cluster) Heal() {
+	c.faults.heal()
+}
+
+// Converge runs gossip rounds on all the running nodes until they all know
+// the same members and the same ring, and reports whether they did within the rounds
+func (c *Cluster) Converge(rounds int) bool {
+	for round := 0; round < rounds; round++ {
+		if c.converged() {
+			return true
+		}
+		for _, node := range c.Nodes() {
+			node.Service.Gossip()
+		}
+	}
+	return c.converged()
+}
+
+func (c *Cluster) converged() bool {
+	nodes := c.Nodes()
+	if len(nodes) == 0 {
+		return true
+	}
+
+	first := nodes[0].Service.Ring()
+	for _, node := range nodes[1:] {
+		ring := node.Service.Ring()
+		if fmt.Sprint(ring.Nodes) != fmt.Sprint(first.Nodes) || fmt.Sprint(ring.Tokens) != fmt.Sprint(first.Tokens) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cluster) start(listener net.Listener, seeds models.NodesMap) *Node {
+	node := &Node{
+		Addr:    addrOf(listener),
+		dataDir: filepath.Join(c.dir, fmt.Sprint(len(c.nodes))),
+		seeds:   seeds,
+	}
+	c.faults.add(node.Addr)
+	c.nodes = append(c.nodes, node)
+	c.run(node, listener)
+	return node
+}
+
+func (c *Cluster) run(node *Node, listener net.Listener) {
+	a, err := app.NewWithConfig(app.Config{
+		DataDir:           node.dataDir,
+		BackupDir:         filepath.Join(c.dir, "backups"),
+		Nodes:             node.seeds,
+		ReplicationFactor: c.replicationFactor,
+		MaxHintAge:        time.Hour,
+		MaxHints:          10000,
+		Transport:         "http",
+		WatchBuffer:       1024,
+		EvictionPolicy:    models.EvictionSpill,
+		Listener:          listener,
+		TCPListener:       c.listen("localhost:0"),
+		Middleware:        c.faults.middleware(node.Addr),
+		ManualWorkers:     true,
+	})
+	if err != nil {
+		c.t.Fatalf("could not create node: %s, %v", node.Addr, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	node.app, node.Service, node.cancel, node.running = a, a.Service, cancel, true
+	go func() {
+		err := a.Start(ctx)
+		if err != nil {
+			c.t.Errorf("could not start node: %s, %v", node.Addr, err)
+		}
+	}()
+}
+
+func (c *Cluster) listen(addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.t.Fatalf("could not listen on: %s, %v", addr, err)
+	}
+	return listener
+}
+
+// addrOf returns the address the node listening on the listener is known by
+func addrOf(listener net.Listener) string {
+	return fmt.Sprintf("localhost:%d", listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (c *Cluster) stop() {
+	for i := range c.nodes {
+		c.Kill(i)
+	}
+}
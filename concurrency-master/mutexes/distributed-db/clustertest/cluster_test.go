@@ -0,0 +1,527 @@
+package clustertest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// TestJoinStreamsItems adds a node to a cluster holding single copies of the items.
+// Once gossip spread the new node and the ring, the old owners must stream
+// the items of the new node to it and forget them
+func TestJoinStreamsItems(t *testing.T) {
+	c := New(t, 3, 1)
+	// similar keys get similar tokens, they are spread with a hash so every node gets some
+	key := func(i int) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 200; i++ {
+		_, err := c.Node(0).Service.Set(models.SetRequest{Key: key(i), Value: "value"})
+		if err != nil {
+			t.Fatalf("could not set key: %d, %v", i, err)
+		}
+	}
+
+	joined := c.Add(0)
+	if !c.Converge(20) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	if ring := c.Node(1).Service.Ring(); len(ring.Nodes) != 4 {
+		t.Fatalf("the new node did not join the ring: %+v", ring.Nodes)
+	}
+	for _, node := range c.Nodes() {
+		if failed := node.Service.Stream(map[string]map[int]models.CacheItem{}); len(failed) > 0 {
+			t.Fatalf("node: %s could not stream to: %d node(s)", node.Addr, len(failed))
+		}
+	}
+
+	keys := 0
+	for _, node := range c.Nodes() {
+		keys += node.Service.Metrics().Keys
+	}
+	if owned := joined.Service.Metrics().Keys; owned == 0 || keys != 200 {
+		t.Fatalf("expected 200 keys, some on the new node, got: %d with: %d on the new node", keys, owned)
+	}
+	for i := 0; i < 200; i++ {
+		res, err := c.Node(i % 4).Service.Get(models.GetRequest{Keys: []string{key(i)}})
+		if err != nil || len(res.Items) != 1 {
+			t.Fatalf("could not get key: %d, %+v, %v", i, res, err)
+		}
+	}
+}
+
+// TestPartitionAndDelay checks a node which can't be reached, or answers
+// too late, gets suspected, and that it clears the suspicion once it answers again
+func TestPartitionAndDelay(t *testing.T) {
+	c := New(t, 3, 3)
+	// probes the nodes from the first node and returns the status it sees the node in
+	probe := func(node *Node) string {
+		// the probes go round robin, every node gets probed in 2 rounds
+		for i := 0; i < 2; i++ {
+			c.Node(0).Service.Probe(100*time.Millisecond, time.Minute, 1)
+		}
+		for _, member := range c.Node(0).Service.Ring().Nodes {
+			if member.Node == node.Addr {
+				return member.Status
+			}
+		}
+		return ""
+	}
+	up, suspect := models.NodeStatusText(models.NodeStatusUp), models.NodeStatusText(models.NodeStatusSuspect)
+
+	c.Partition(2)
+	if status := probe(c.Node(2)); status != suspect {
+		t.Fatalf("the partitioned node is: %s", status)
+	}
+	c.Node(2).Service.Gossip()
+	if failures := c.Node(2).Service.Metrics().Counters.GossipFailures; failures != 2 {
+		t.Fatalf("expected the 2 gossips of the partitioned node to fail, %d did", failures)
+	}
+
+	c.Heal()
+	if status := probe(c.Node(2)); status != up {
+		t.Fatalf("the healed node is: %s", status)
+	}
+
+	c.Delay(1, 300*time.Millisecond)
+	if status := probe(c.Node(1)); status != suspect {
+		t.Fatalf("the delayed node is: %s", status)
+	}
+}
+
+// TestKillAndRestart writes while a replica is down. The write is kept
+// as a hint, which reaches the replica once it is restarted
+func TestKillAndRestart(t *testing.T) {
+	c := New(t, 3, 3)
+	c.Kill(2)
+
+	_, err := c.Node(0).Service.Set(models.SetRequest{Key: "key", Value: "value", ConsistencyLevel: models.ConsistencyLevelQuorum})
+	if err != nil {
+		t.Fatalf("could not write with a replica down: %v", err)
+	}
+	_, err = c.Node(0).Service.Set(models.SetRequest{Key: "key", Value: "value", ConsistencyLevel: models.ConsistencyLevelAll})
+	if err == nil {
+		t.Fatalf("expected the write to all the replicas to fail")
+	}
+
+	c.Restart(2)
+	if res, _ := c.Node(2).Service.Scan(models.ScanRequest{Local: true}); len(res.Items) != 0 {
+		t.Fatalf("the restarted node already has the key: %+v", res.Items)
+	}
+	c.Node(0).Service.ReplayHints()
+	res, err := c.Node(2).Service.Scan(models.ScanRequest{Local: true})
+	if err != nil || len(res.Items) != 1 || res.Items[0].Value != "value" {
+		t.Fatalf("the hint did not reach the restarted node: %+v, %v", res, err)
+	}
+}
+
+// TestStolenTokens forwards a batch to the owner of its key while the owner is down.
+// The node which got the batch keeps the item and gossips that it holds it, so the
+// other nodes read the item from it besides the owner, until it hands the item back.
+// The holder doesn't answer in place of the owner and its copy only wins when newer
+func TestStolenTokens(t *testing.T) {
+	c := New(t, 3, 1)
+	owner := func(token int) string {
+		tokens := c.Node(0).Service.Ring().Tokens
+		for _, t := range tokens {
+			if token <= t.Token {
+				return t.Node
+			}
+		}
+		return tokens[0].Node
+	}
+	key := ""
+	for i := 0; key == "" || owner(int(models.HashKey(key))) != c.Node(2).Addr; i++ {
+		key = fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(i))))
+	}
+	token := int(models.HashKey(key))
+	get := func(node *Node) models.CacheItem {
+		res, err := node.Service.Get(models.GetRequest{Keys: []string{key}})
+		if err != nil || len(res.Items) != 1 {
+			t.Fatalf("could not get the key from node: %s, %+v, %v", node.Addr, res, err)
+		}
+		return res.Items[0]
+	}
+
+	c.Kill(2)
+	item := models.CacheItem{Key: key, Value: "value", UpdatedAt: time.Now().UTC(), ReplicationFactor: 1}
+	items, err := c.Node(0).Service.SetBatch(map[int]models.CacheItem{token: item})
+	if err != nil || len(items) != 1 || items[0].Node != c.Node(0).Addr {
+		t.Fatalf("expected the first node to keep the item: %+v, %v", items, err)
+	}
+	if !c.Converge(10) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	_, err = c.Node(1).Service.Get(models.GetRequest{Keys: []string{key}})
+	if !errors.Is(err, models.ErrUnavailable) {
+		t.Fatalf("expected the holder not to answer for the owner, got: %v", err)
+	}
+
+	c.Restart(2)
+	if item := get(c.Node(1)); item.Node != c.Node(0).Addr {
+		t.Fatalf("expected the item from the node holding it, got it from: %s", item.Node)
+	}
+	_, err = c.Node(1).Service.Set(models.SetRequest{Key: key, Value: "newer"})
+	if err != nil {
+		t.Fatalf("could not update the key: %v", err)
+	}
+	if item := get(c.Node(1)); item.Node != c.Node(2).Addr || item.Value != "newer" {
+		t.Fatalf("expected the newer item of the owner, got: %+v", item)
+	}
+	if failed := c.Node(0).Service.Stream(map[string]map[int]models.CacheItem{}); len(failed) > 0 {
+		t.Fatalf("could not hand the item back to the owner: %+v", failed)
+	}
+	if !c.Converge(10) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	for _, member := range c.Node(1).Service.Ring().Nodes {
+		if member.ForeignTokens != 0 {
+			t.Fatalf("node: %s still holds %d token(s)", member.Node, member.ForeignTokens)
+		}
+	}
+	if item := get(c.Node(1)); item.Node != c.Node(2).Addr || item.Value != "newer" {
+		t.Fatalf("expected the item from its owner, got: %+v", item)
+	}
+}
+
+// TestDecommissionTimeout decommissions a node while a replica of its items is down.
+// The decommission can't hand over the items nor the hints of the down node, so it
+// times out and the node stays with its hints. Once the replica is back, it leaves
+func TestDecommissionTimeout(t *testing.T) {
+	c := New(t, 3, 3)
+	node := c.Node(0)
+	wait := func(status string) models.DecommissionResponse {
+		for i := 0; i < 100; i++ {
+			if res := node.Service.DecommissionStatus(); res.Status == status {
+				return res
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("the decommission is not %s: %+v", status, node.Service.DecommissionStatus())
+		return models.DecommissionResponse{}
+	}
+
+	c.Kill(2)
+	_, err := node.Service.Set(models.SetRequest{Key: "key", Value: "value", ConsistencyLevel: models.ConsistencyLevelOne})
+	if err != nil {
+		t.Fatalf("could not set the key: %v", err)
+	}
+
+	_, err = node.Service.Decommission(models.DecommissionRequest{Timeout: models.Duration(2 * time.Second)})
+	if err != nil {
+		t.Fatalf("could not start the decommission: %v", err)
+	}
+	res := wait("failed")
+	if !strings.Contains(res.Error, "timed out") || !strings.Contains(res.Error, c.Node(2).Addr) {
+		t.Fatalf("expected the decommission to time out on the hints of node: %s, got: %s", c.Node(2).Addr, res.Error)
+	}
+	select {
+	case <-node.Service.Decommissioned():
+		t.Fatal("the node left the cluster")
+	default:
+	}
+
+	c.Restart(2)
+	_, err = node.Service.Decommission(models.DecommissionRequest{Timeout: models.Duration(10 * time.Second)})
+	if err != nil {
+		t.Fatalf("could not start the decommission again: %v", err)
+	}
+	wait("done")
+	scan, err := c.Node(2).Service.Scan(models.ScanRequest{Local: true})
+	if err != nil || len(scan.Items) != 1 || scan.Items[0].Value != "value" {
+		t.Fatalf("the item did not reach the restarted node: %+v, %v", scan, err)
+	}
+}
+
+// TestGetTombstonesIsNodeOnly asks the client api for tombstones and for the stored
+// form of the key of a keyspace. The flag is only honoured on the node-only route,
+// so the keys must still be resolved in their keyspace and the deleted ones hidden
+func TestGetTombstonesIsNodeOnly(t *testing.T) {
+	c := New(t, 2, 2)
+
+	if _, err := c.Node(0).Service.CreateKeyspace(models.Keyspace{Name: "orders"}); err != nil {
+		t.Fatalf("could not create the keyspace: %v", err)
+	}
+	for _, req := range []models.SetRequest{{Keyspace: "orders", Key: "order:1", Value: "paid"}, {Key: "deleted", Value: "value"}} {
+		if _, err := c.Node(0).Service.Set(req); err != nil {
+			t.Fatalf("could not set key: %s, %v", req.Key, err)
+		}
+	}
+	if err := c.Node(0).Service.Delete(models.DeleteRequest{Keys: []string{"deleted"}}); err != nil {
+		t.Fatalf("could not delete the key: %v", err)
+	}
+
+	var items []models.CacheItem
+	status := post(t, c.Node(0), "/get", `{"keys":["deleted"],"tombstones":true}`, &items)
+	if status != http.StatusOK || len(items) != 0 {
+		t.Fatalf("expected the deleted key to stay hidden, got: %d, %+v", status, items)
+	}
+	var res models.ErrorResponse
+	status = post(t, c.Node(0), "/get", `{"keys":["orders\u0000order:1"],"tombstones":true}`, &res)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected the stored form of the key to be rejected, got: %d, %+v", status, res)
+	}
+}
+
+// TestRestoreStreams backs up a cluster twice, then restores the parts into new
+// nodes, picking the backups by name and by time and the parts by node. Only empty
+// nodes accept a restore, and the restored items the new nodes do not own must be
+// streamed to their owners, so every item ends up on a single node again
+func TestRestoreStreams(t *testing.T) {
+	c := New(t, 2, 1)
+	key := func(i int) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(i))))
+	}
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := c.Node(0).Service.Set(models.SetRequest{Key: key(i), Value: "value"}); err != nil {
+				t.Fatalf("could not set key: %d, %v", i, err)
+			}
+		}
+	}
+	backup := func() models.BackupSet {
+		// the ids have a millisecond resolution
+		time.Sleep(5 * time.Millisecond)
+		set, err := c.Node(0).Service.Backup()
+		if err != nil || len(set.Parts) != 2 {
+			t.Fatalf("could not back up the cluster: %+v, %v", set, err)
+		}
+		return set
+	}
+	keys := func() int {
+		keys := 0
+		for _, node := range c.Nodes() {
+			keys += node.Service.Metrics().Keys
+		}
+		return keys
+	}
+	stream := func() {
+		for _, node := range c.Nodes() {
+			if failed := node.Service.Stream(map[string]map[int]models.CacheItem{}); len(failed) > 0 {
+				t.Fatalf("node: %s could not stream to: %d node(s)", node.Addr, len(failed))
+			}
+		}
+	}
+
+	if _, err := c.Node(0).Service.CreateKeyspace(models.Keyspace{Name: "orders"}); err != nil {
+		t.Fatalf("could not create the keyspace: %v", err)
+	}
+	write(0, 50)
+	first := backup()
+	write(50, 100)
+	second := backup()
+	owned := c.Node(1).Service.Metrics().Keys
+
+	// the latest backup, only the part of the second node
+	joined := c.Add(0)
+	res, err := joined.Service.Restore(models.RestoreRequest{Backup: models.RestoreLatest, Nodes: []string{c.Node(1).Addr}})
+	if err != nil || res.ID != second.ID || len(res.Nodes) != 1 || res.Items != owned {
+		t.Fatalf("expected the %d items of the second node from backup: %s, got: %+v, %v", owned, second.ID, res, err)
+	}
+	if _, err = joined.Service.KeyspaceStats("orders"); err != nil {
+		t.Fatalf("the keyspaces of the backup were not restored: %v", err)
+	}
+	_, err = joined.Service.Restore(models.RestoreRequest{Backup: second.ID})
+	if !errors.Is(err, models.ErrInvalidRequest) {
+		t.Fatalf("expected the restore into a node holding items to be refused, got: %v", err)
+	}
+
+	if !c.Converge(20) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	stream()
+	if held, total := joined.Service.Metrics().Keys, keys(); held == 0 || held == owned || total != 100 {
+		t.Fatalf("expected the new node to keep the items it owns out of 100, got: %d of %d", held, total)
+	}
+
+	// the backup taken by the time, the parts of all the nodes
+	for _, backup := range []string{first.ID, first.Time.Add(time.Millisecond).Format(time.RFC3339Nano)} {
+		joined = c.Add(0)
+		res, err = joined.Service.Restore(models.RestoreRequest{Backup: backup, AllNodes: true})
+		if err != nil || res.ID != first.ID || len(res.Nodes) != 2 || res.Items != 50 {
+			t.Fatalf("expected the 50 items of backup: %s, got: %+v, %v", first.ID, res, err)
+		}
+	}
+	if !c.Converge(20) {
+		t.Fatalf("the nodes did not agree on the ring")
+	}
+	stream()
+	if total := keys(); total != 100 {
+		t.Fatalf("expected every item on a single node, found: %d", total)
+	}
+}
+
+// TestCASLocalIsNodeOnly sends a compare-and-set asking to skip the consensus
+// to the client api. The flag is only honoured on the node-only route,
+// so the write must still reach all the replicas
+func TestCASLocalIsNodeOnly(t *testing.T) {
+	c := New(t, 3, 3)
+
+	var res models.CASResponse
+	status := post(t, c.Node(0), "/cas", `{"key":"counter","value":"1","if_absent":true,"local":true}`, &res)
+	if status != http.StatusOK || !res.Applied || res.Item.ReplicationFactor != 3 {
+		t.Fatalf("expected the write on the 3 replicas, got: %d, %+v", status, res)
+	}
+	for _, node := range c.Nodes() {
+		if keys := node.Service.Metrics().Keys; keys != 1 {
+			t.Fatalf("expected the key on node: %s, found %d key(s)", node.Addr, keys)
+		}
+	}
+}
+
+// TestScanLocalIsNodeOnly asks the client api for the keys of a single node.
+// The flag is only honoured on the node-only route, so the scan must still
+// list the keys of the whole cluster, without the tombstones
+func TestScanLocalIsNodeOnly(t *testing.T) {
+	c := New(t, 3, 1)
+
+	for i := 0; i < 20; i++ {
+		if _, err := c.Node(0).Service.Set(models.SetRequest{Key: fmt.Sprintf("key:%02d", i), Value: "value"}); err != nil {
+			t.Fatalf("could not set key: %d, %v", i, err)
+		}
+	}
+	if err := c.Node(0).Service.Delete(models.DeleteRequest{Keys: []string{"key:00"}}); err != nil {
+		t.Fatalf("could not delete the key: %v", err)
+	}
+
+	var res models.ScanResponse
+	status := post(t, c.Node(0), "/scan", `{"prefix":"key:","local":true}`, &res)
+	if status != http.StatusOK || len(res.Items) != 19 {
+		t.Fatalf("expected the 19 keys of the cluster, got: %d, %d item(s)", status, len(res.Items))
+	}
+}
+
+// TestMetrics scrapes the metrics of a node after serving some writes. Every
+// histogram must have cumulative buckets, in order, ending with the +Inf bucket
+// which counts all the requests, and the gauges must follow the stored keys
+func TestMetrics(t *testing.T) {
+	c := New(t, 2, 2)
+
+	for i := 0; i < 10; i++ {
+		var item models.CacheItem
+		if status := post(t, c.Node(0), "/set", fmt.Sprintf(`{"key":"key:%d","value":"value"}`, i), &item); status != http.StatusOK {
+			t.Fatalf("could not set key: %d, status: %d", i, status)
+		}
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://%s/metrics", c.Node(0).Addr))
+	if err != nil {
+		t.Fatalf("could not scrape the metrics: %v", err)
+	}
+	defer res.Body.Close()
+	bs, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("could not read the metrics: %v", err)
+	}
+
+	type histogram struct {
+		bounds []float64
+		counts []uint64
+		count  uint64
+	}
+	histograms, gauges := map[string]*histogram{}, map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			t.Fatalf("could not parse: %q, %v", line, err)
+		}
+
+		series := labels["route"] + " " + labels["transport"]
+		switch name {
+		case "ddb_request_duration_seconds_bucket":
+			h, ok := histograms[series]
+			if !ok {
+				h = &histogram{}
+				histograms[series] = h
+			}
+			bound, err := strconv.ParseFloat(labels["le"], 64)
+			if err != nil {
+				t.Fatalf("invalid bucket bound: %q, %v", line, err)
+			}
+			h.bounds, h.counts = append(h.bounds, bound), append(h.counts, uint64(value))
+		case "ddb_request_duration_seconds_count":
+			histograms[series].count = uint64(value)
+		default:
+			gauges[name] = value
+		}
+	}
+
+	for series, h := range histograms {
+		last := len(h.bounds) - 1
+		if last < 0 || !math.IsInf(h.bounds[last], 1) || h.counts[last] != h.count {
+			t.Fatalf("series: %s must end with the +Inf bucket of all the requests: %+v", series, h)
+		}
+		for i := 1; i < len(h.bounds); i++ {
+			if h.bounds[i] <= h.bounds[i-1] || h.counts[i] < h.counts[i-1] {
+				t.Fatalf("series: %s does not have cumulative buckets in order: %+v", series, h)
+			}
+		}
+	}
+	if h, ok := histograms["/set http"]; !ok || h.count != 10 {
+		t.Fatalf("expected the 10 writes in the histogram of /set, got: %+v", h)
+	}
+	if keys := gauges["ddb_keys"]; keys != 10 {
+		t.Fatalf("expected 10 keys, got: %v", keys)
+	}
+}
+
+// parseSample parses a sample of the prometheus text format
+func parseSample(line string) (string, map[string]string, float64, error) {
+	open, end := strings.Index(line, "{"), strings.LastIndex(line, "}")
+	if open < 0 || end < open {
+		return "", nil, 0, errors.New("missing labels")
+	}
+
+	labels, rest := map[string]string{}, line[open+1:end]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return "", nil, 0, fmt.Errorf("invalid labels: %s", rest)
+		}
+		value, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return "", nil, 0, err
+		}
+		labels[rest[:eq]], _ = strconv.Unquote(value)
+		rest = strings.TrimPrefix(rest[eq+1+len(value):], ",")
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(line[end+1:]), 64)
+	return line[:open], labels, value, err
+}
+
+// post sends the body to the client api of the node and decodes the response into v
+func post(t *testing.T, node *Node, route, body string, v interface{}) int {
+	res, err := http.Post(fmt.Sprintf("http://%s%s", node.Addr, route), "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("could not call: %s on node: %s, %v", route, node.Addr, err)
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("could not decode the response of: %s, %v", route, err)
+	}
+	return res.StatusCode
+}
@@ -0,0 +1,107 @@
+package clustertest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+func newFaults() *faults {
+	return &faults{
+		nodes:  map[string]struct{}{},
+		sides:  map[string]int{},
+		delays: map[string]time.Duration{},
+	}
+}
+
+// faults are injected on the receiving side of the traffic between the nodes.
+// The nodes send their own address as the host of their requests,
+// which tells the requests of the other nodes from the requests of the clients
+type faults struct {
+	mu     sync.Mutex
+	nodes  map[string]struct{}
+	sides  map[string]int
+	delays map[string]time.Duration
+	// the last side created by a partition, the nodes start on side 0
+	side int
+}
+
+func (f *faults) add(node string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nodes[node] = struct{}{}
+}
+
+// partition moves the nodes to a new side, away from all the other nodes
+func (f *faults) partition(nodes []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.side++
+	for _, node := range nodes {
+		f.sides[node] = f.side
+	}
+}
+
+func (f *faults) delay(node string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.delays[node] = d
+}
+
+func (f *faults) heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sides, f.delays = map[string]int{}, map[string]time.Duration{}
+}
+
+// check returns whether the request between the nodes can't get through and how long it is held
+func (f *faults) check(from, to string) (bool, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.nodes[from]; !ok || from == to {
+		return false, 0
+	}
+
+	d := f.delays[from]
+	if f.delays[to] > d {
+		d = f.delays[to]
+	}
+	return f.sides[from] != f.sides[to], d
+}
+
+// middleware applies the faults to the requests received by the node.
+// The connection of a request which can't get through is closed,
+// the sender sees the same error as when the node can't be reached
+func (f *faults) middleware(node string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			blocked, d := f.check(r.Host, node)
+			if d > 0 {
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if blocked {
+				hijacker, ok := w.(http.Hijacker)
+				if !ok {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				conn, _, err := hijacker.Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+
+	"distributed-db/auth"
+)
+
+// adminOnly only lets the operators knowing the cluster secret change the cluster,
+// reading its state stays open to everyone
+func adminOnly(signer *auth.Signer, next http.HandlerFunc) http.HandlerFunc {
+	if !signer.Enabled() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			err := signer.VerifyAdmin(r)
+			if err != nil {
+				log.Printf("rejected %s %s from: %s, %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+				writeError(w, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// nodeOnly rejects the requests which are not signed by another node of the cluster
+func nodeOnly(signer *auth.Signer, next http.HandlerFunc) http.HandlerFunc {
+	if !signer.Enabled() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("could not read request body: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err = signer.VerifyRequest(r, body)
+		if err != nil {
+			log.Printf("rejected %s %s from: %s (host: %s), %v", r.Method, r.URL.Path, r.RemoteAddr, r.Host, err)
+			writeError(w, err)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type backuper interface {
+	Backup() (models.BackupSet, error)
+}
+
+type partBackuper interface {
+	BackupPart(req models.BackupRequest) (models.BackupManifest, error)
+}
+
+// backup takes a backup of the whole cluster and answers once it is complete
+func backup(svc backuper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		set, err := svc.Backup()
+		if err != nil {
+			log.Printf("could not back up the cluster: %v", err)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(set)
+		if err != nil {
+			log.Printf("could not encode backup response: %v", err)
+		}
+	}
+}
+
+func backupPart(svc partBackuper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.BackupRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode backup request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		m, err := svc.BackupPart(req)
+		if err != nil {
+			log.Printf("could not write the part of backup: %s, %v", req.ID, err)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(m)
+		if err != nil {
+			log.Printf("could not encode backup part response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type casWriter interface {
+	CAS(req models.CASRequest) (models.CASResponse, error)
+}
+
+type acceptor interface {
+	Prepare(req models.PrepareRequest) models.PrepareResponse
+	Propose(req models.ProposeRequest) models.ProposeResponse
+	Commit(req models.CommitRequest) (models.CommitResponse, error)
+}
+
+// cas answers with a conflict and the current item when the condition did not hold
+func cas(svc casWriter) http.HandlerFunc {
+	return casHandler(svc, false)
+}
+
+// localCAS applies the writes forwarded to the node owning the key. They always
+// get an ok, the node which forwarded them reads the outcome
+func localCAS(svc casWriter) http.HandlerFunc {
+	return casHandler(svc, true)
+}
+
+func casHandler(svc casWriter, local bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req models.CASRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode cas request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req.Local = local
+
+		res, err := svc.CAS(req)
+		if err != nil {
+			log.Printf("could not compare and set key: %s, %v", req.Key, err)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Applied && !req.Local {
+			w.WriteHeader(http.StatusConflict)
+		}
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode cas response: %v", err)
+		}
+	}
+}
+
+func prepare(svc acceptor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.PrepareRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode prepare request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := svc.Prepare(req)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode prepare response: %v", err)
+		}
+	}
+}
+
+func propose(svc acceptor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.ProposeRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode propose request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := svc.Propose(req)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode propose response: %v", err)
+		}
+	}
+}
+
+func commit(svc acceptor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.CommitRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode commit request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res, err := svc.Commit(req)
+		if err != nil {
+			log.Printf("could not commit the write of key: %s, %v", req.Proposal.Item.Key, err)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode commit response: %v", err)
+		}
+	}
+}
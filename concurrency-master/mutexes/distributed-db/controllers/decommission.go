@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type decommissioner interface {
+	Decommission(req models.DecommissionRequest) (models.DecommissionResponse, error)
+	AbortDecommission() (models.DecommissionResponse, error)
+	DecommissionStatus() models.DecommissionResponse
+}
+
+// decommission starts taking the node out of the cluster on POST, the body is optional.
+// It shows the progress on GET and aborts the decommission on DELETE
+func decommission(svc decommissioner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var res models.DecommissionResponse
+		switch r.Method {
+		case http.MethodGet:
+			res = svc.DecommissionStatus()
+		case http.MethodPost:
+			var req models.DecommissionRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil && err != io.EOF {
+				log.Printf("could not decode decommission request: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res, err = svc.Decommission(req)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+		case http.MethodDelete:
+			var err error
+			res, err = svc.AbortDecommission()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode decommission response: %v", err)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 type cacheRemover interface {
-	Delete(keys []string)
+	Delete(req models.DeleteRequest) error
 }
 
 func remove(svc cacheRemover) http.HandlerFunc {
@@ -22,7 +22,13 @@ func remove(svc cacheRemover) http.HandlerFunc {
 			return
 		}
 
-		svc.Delete(req.Keys)
+		err = svc.Delete(req)
+		if err != nil {
+			log.Printf("could not delete cache items: %v", err)
+			writeError(w, err)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, models.ErrInvalidRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, models.ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, models.ErrUnauthorized):
+		status = http.StatusUnauthorized
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(models.ErrorResponse{Error: err.Error()})
+	if err != nil {
+		log.Printf("could not encode error response: %v", err)
+	}
+}
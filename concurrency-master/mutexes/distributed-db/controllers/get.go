@@ -4,15 +4,26 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 
 	"distributed-db/models"
 )
 
 type cacheGetter interface {
-	Get(keys []string) []models.CacheItem
+	Get(req models.GetRequest) (models.GetResponse, error)
 }
 
 func get(svc cacheGetter) http.HandlerFunc {
+	return getHandler(svc, false)
+}
+
+// replicaGet reads the stored keys of the receiving node, tombstones included,
+// for the node reading the replicas
+func replicaGet(svc cacheGetter) http.HandlerFunc {
+	return getHandler(svc, true)
+}
+
+func getHandler(svc cacheGetter, tombstones bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req models.GetRequest
 		err := json.NewDecoder(r.Body).Decode(&req)
@@ -21,11 +32,18 @@ func get(svc cacheGetter) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		req.Tombstones = tombstones
 
-		items := svc.Get(req.Keys)
+		res, err := svc.Get(req)
+		if err != nil {
+			log.Printf("could not get cache items: %v", err)
+			writeError(w, err)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(items)
+		w.Header().Set("X-Read-Repairs", strconv.Itoa(res.ReadRepairs))
+		err = json.NewEncoder(w).Encode(res.Items)
 		if err != nil {
 			log.Printf("could not encode json: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -9,7 +9,7 @@ import (
 )
 
 type tokensUpdater interface {
-	UpdateTokens(node string, newNodes models.NodesMap, tokensChecksum string) (oldNodes models.NodesMap, err error)
+	UpdateTokens(node string, req models.GossipRequest) (models.GossipResponse, error)
 }
 
 func gossip(svc tokensUpdater) http.HandlerFunc {
@@ -22,7 +22,7 @@ func gossip(svc tokensUpdater) http.HandlerFunc {
 			return
 		}
 
-		oldNodes, err := svc.UpdateTokens(r.Host, req.Nodes, req.TokensChecksum)
+		res, err := svc.UpdateTokens(r.Host, req)
 		if err != nil {
 			log.Printf("could not update tokens: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -30,7 +30,6 @@ func gossip(svc tokensUpdater) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		res := models.GossipResponse{Nodes: oldNodes}
 		err = json.NewEncoder(w).Encode(res)
 		if err != nil {
 			log.Printf("could not encode gossip response: %v", err)
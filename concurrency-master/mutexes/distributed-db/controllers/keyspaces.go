@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type keyspacesManager interface {
+	Keyspaces() []models.Keyspace
+	CreateKeyspace(keyspace models.Keyspace) (models.Keyspace, error)
+}
+
+// keyspaces lists the keyspaces on GET, and creates a keyspace,
+// or replaces the defaults of an existing one, on POST
+func keyspaces(svc keyspacesManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var res interface{}
+		switch r.Method {
+		case http.MethodGet:
+			res = svc.Keyspaces()
+		case http.MethodPost:
+			var req models.Keyspace
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				log.Printf("could not decode keyspace request: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res, err = svc.CreateKeyspace(req)
+			if err != nil {
+				log.Printf("could not create keyspace: %s, %v", req.Name, err)
+				writeError(w, err)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode keyspaces response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type merkleTreeGetter interface {
+	MerkleTree(node string, req models.MerkleRequest) models.MerkleTree
+	RangeItems(node string, ranges []models.TokenRange) map[int]models.CacheItem
+}
+
+func merkleTree(svc merkleTreeGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.MerkleRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode merkle request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		tree := svc.MerkleTree(r.Host, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(tree)
+		if err != nil {
+			log.Printf("could not encode merkle response: %v", err)
+		}
+	}
+}
+
+func rangeItems(svc merkleTreeGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.RangeItemsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode range items request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := models.RangeItemsResponse{
+			Items: svc.RangeItems(r.Host, req.Ranges),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode range items response: %v", err)
+		}
+	}
+}
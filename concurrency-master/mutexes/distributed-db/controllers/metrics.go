@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"distributed-db/models"
+)
+
+type metricsGetter interface {
+	Metrics() models.MetricsResponse
+}
+
+// instrument records the latency of the requests of the route
+func instrument(metrics *models.Metrics, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next(w, r)
+		metrics.ObserveRequest(route, "http", time.Since(start))
+	}
+}
+
+// metrics exposes the metrics of the node in the prometheus text format
+func metrics(svc metricsGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := svc.Metrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		buf := bufio.NewWriter(w)
+		writeMetrics(buf, res)
+		err := buf.Flush()
+		if err != nil {
+			log.Printf("could not write metrics response: %v", err)
+		}
+	}
+}
+
+func writeMetrics(w *bufio.Writer, res models.MetricsResponse) {
+	node := label("node", res.Node)
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("ddb_request_duration_seconds", "histogram", "How long serving the requests took, by route and transport.")
+	for _, req := range res.Counters.Requests {
+		labels := node + "," + label("route", req.Route) + "," + label("transport", req.Transport)
+		for i, bound := range req.Buckets {
+			fmt.Fprintf(w, "ddb_request_duration_seconds_bucket{%s,%s} %d\n", labels, label("le", strconv.FormatFloat(bound, 'g', -1, 64)), req.Counts[i])
+		}
+		fmt.Fprintf(w, "ddb_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, req.Count)
+		fmt.Fprintf(w, "ddb_request_duration_seconds_sum{%s} %g\n", labels, req.Sum)
+		fmt.Fprintf(w, "ddb_request_duration_seconds_count{%s} %d\n", labels, req.Count)
+	}
+
+	header("ddb_gossip_rounds_total", "counter", "The gossip rounds started by the node.")
+	fmt.Fprintf(w, "ddb_gossip_rounds_total{%s} %d\n", node, res.Counters.GossipRounds)
+	header("ddb_gossip_failures_total", "counter", "The gossip calls to nodes which could not be reached.")
+	fmt.Fprintf(w, "ddb_gossip_failures_total{%s} %d\n", node, res.Counters.GossipFailures)
+
+	header("ddb_streamed_items_total", "counter", "The items streamed to their new replicas after a ring change.")
+	fmt.Fprintf(w, "ddb_streamed_items_total{%s} %d\n", node, res.Counters.StreamedItems)
+	header("ddb_stream_failed_items_total", "counter", "The items which could not be streamed to their new replicas, they are retried.")
+	fmt.Fprintf(w, "ddb_stream_failed_items_total{%s} %d\n", node, res.Counters.StreamFailedItems)
+
+	header("ddb_node_status_changes_total", "counter", "The status changes of the other nodes noticed by the node, by new status.")
+	statuses := make([]string, 0, len(res.Counters.StatusChanges))
+	for status := range res.Counters.StatusChanges {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "ddb_node_status_changes_total{%s,%s} %d\n", node, label("status", status), res.Counters.StatusChanges[status])
+	}
+
+	header("ddb_keys", "gauge", "The keys stored by the node, tombstones included.")
+	fmt.Fprintf(w, "ddb_keys{%s} %d\n", node, res.Keys)
+
+	header("ddb_memory_used_bytes", "gauge", "The approximate memory taken by the items kept in memory.")
+	fmt.Fprintf(w, "ddb_memory_used_bytes{%s} %d\n", node, res.Memory.Used)
+	header("ddb_memory_limit_bytes", "gauge", "The memory limit of the items, 0 means unlimited.")
+	fmt.Fprintf(w, "ddb_memory_limit_bytes{%s} %d\n", node, res.Memory.Limit)
+	header("ddb_memory_items", "gauge", "The items kept in memory.")
+	fmt.Fprintf(w, "ddb_memory_items{%s} %d\n", node, res.Memory.Items)
+	header("ddb_memory_reads_total", "counter", "The reads of items, by whether they were found in memory.")
+	fmt.Fprintf(w, "ddb_memory_reads_total{%s,result=\"hit\"} %d\n", node, res.Memory.Hits)
+	fmt.Fprintf(w, "ddb_memory_reads_total{%s,result=\"miss\"} %d\n", node, res.Memory.Misses)
+	header("ddb_memory_evictions_total", "counter", "The items evicted from memory, by eviction policy.")
+	fmt.Fprintf(w, "ddb_memory_evictions_total{%s,policy=\"spill\"} %d\n", node, res.Memory.Spilled)
+	fmt.Fprintf(w, "ddb_memory_evictions_total{%s,policy=\"drop\"} %d\n", node, res.Memory.Dropped)
+
+	members := make([]string, 0, len(res.Members))
+	for member := range res.Members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	header("ddb_member_status", "gauge", "The status of the nodes as seen by the node, 1 for the current status.")
+	for _, member := range members {
+		fmt.Fprintf(w, "ddb_member_status{%s,%s,%s} 1\n", node, label("member", member), label("status", models.NodeStatusText(res.Members[member].Status)))
+	}
+	header("ddb_ring_tokens", "gauge", "The virtual nodes owned by the nodes in the ring.")
+	for _, member := range members {
+		fmt.Fprintf(w, "ddb_ring_tokens{%s,%s} %d\n", node, label("member", member), res.Ring[member])
+	}
+}
+
+func label(name, value string) string {
+	return name + "=" + strconv.Quote(value)
+}
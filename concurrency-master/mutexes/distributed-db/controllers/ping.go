@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type pinger interface {
+	Ping(req models.PingRequest) models.PingResponse
+	IndirectPing(req models.IndirectPingRequest) (models.PingResponse, error)
+}
+
+func ping(svc pinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.PingRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode ping request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := svc.Ping(req)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode ping response: %v", err)
+		}
+	}
+}
+
+func indirectPing(svc pinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.IndirectPingRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode indirect ping request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res, err := svc.IndirectPing(req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode indirect ping response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type ringGetter interface {
+	Ring() models.RingResponse
+	RingChecksum() string
+}
+
+// ring shows the token ownership and the status of the nodes
+func ring(svc ringGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(svc.Ring())
+		if err != nil {
+			log.Printf("could not encode ring response: %v", err)
+		}
+	}
+}
+
+// withRingChecksum sends the checksum of the ring with every response,
+// so the clients routing the requests themselves notice the ring changes
+func withRingChecksum(svc ringGetter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(models.RingChecksumHeader, svc.RingChecksum())
+		next.ServeHTTP(w, r)
+	})
+}
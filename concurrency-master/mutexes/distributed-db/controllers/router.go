@@ -2,6 +2,9 @@ package controllers
 
 import (
 	"net/http"
+
+	"distributed-db/auth"
+	"distributed-db/models"
 )
 
 type CacheService interface {
@@ -11,18 +14,61 @@ type CacheService interface {
 	cacheRemover
 	tokensGetter
 	tokensUpdater
+	merkleTreeGetter
+	repairer
+	pinger
+	decommissioner
+	scanner
+	casWriter
+	acceptor
+	watcher
+	statsGetter
+	metricsGetter
+	ringGetter
+	backuper
+	partBackuper
+	keyspacesManager
 }
 
-func NewRouter(svc CacheService) http.Handler {
+// NewRouter mounts the client api and the node-only api. When the signer has
+// a secret, the node-only api only accepts requests signed by other nodes,
+// and the admin operations need the secret as a bearer token.
+// The latency of the requests is recorded in the metrics, except for the watch
+// streams and polls, which last until there is something to return.
+// Every response carries the checksum of the ring
+func NewRouter(svc CacheService, signer *auth.Signer, m *models.Metrics) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/get", get(svc))
-	mux.HandleFunc("/set", set(svc))
-	mux.HandleFunc("/delete", remove(svc))
-	// add a middleware that does not allow
-	// requests that do not come from other nodes
-	mux.HandleFunc("/set/batch", setBatch(svc))
-	mux.HandleFunc("/gossip", gossip(svc))
-	mux.HandleFunc("/tokens", tokens(svc))
+	handle := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, instrument(m, route, handler))
+	}
+	handle("/get", get(svc))
+	handle("/set", set(svc))
+	handle("/delete", remove(svc))
+	handle("/repair", adminOnly(signer, repair(svc)))
+	handle("/decommission", adminOnly(signer, decommission(svc)))
+	handle("/scan", scan(svc))
+	handle("/cas", cas(svc))
+	handle("/stats", stats(svc))
+	handle("/ring", ring(svc))
+	handle("/backup", adminOnly(signer, backup(svc)))
+	handle("/keyspaces", adminOnly(signer, keyspaces(svc)))
+	mux.HandleFunc("/metrics", metrics(svc))
+	mux.HandleFunc("/watch", watch(svc))
+	handle("/get/replica", nodeOnly(signer, replicaGet(svc)))
+	handle("/set/batch", nodeOnly(signer, setBatch(svc)))
+	handle("/gossip", nodeOnly(signer, gossip(svc)))
+	handle("/tokens", nodeOnly(signer, tokens(svc)))
+	handle("/merkle", nodeOnly(signer, merkleTree(svc)))
+	handle("/merkle/items", nodeOnly(signer, rangeItems(svc)))
+	handle("/ping", nodeOnly(signer, ping(svc)))
+	handle("/ping/indirect", nodeOnly(signer, indirectPing(svc)))
+	handle("/scan/local", nodeOnly(signer, localScan(svc)))
+	handle("/cas/local", nodeOnly(signer, localCAS(svc)))
+	handle("/cas/prepare", nodeOnly(signer, prepare(svc)))
+	handle("/cas/propose", nodeOnly(signer, propose(svc)))
+	handle("/cas/commit", nodeOnly(signer, commit(svc)))
+	handle("/backup/node", nodeOnly(signer, backupPart(svc)))
+	mux.HandleFunc("/watch/changes", nodeOnly(signer, changes(svc)))
 
-	return mux
+	return withRingChecksum(svc, mux)
 }
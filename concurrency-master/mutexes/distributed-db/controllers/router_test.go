@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"distributed-db/auth"
+	"distributed-db/models"
+)
+
+// fakeService only serves the repairs, the other routes must not reach it
+type fakeService struct {
+	CacheService
+	repairs int
+}
+
+func (s *fakeService) Repair() models.RepairResponse {
+	s.repairs++
+	return models.RepairResponse{}
+}
+
+func (s *fakeService) RingChecksum() string {
+	return ""
+}
+
+// TestAdminRoutes sends the admin operations without the cluster secret.
+// They must be rejected before they reach the service, and the repair
+// must only start once the secret is given
+func TestAdminRoutes(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	signer, svc := auth.NewSigner("secret"), &fakeService{}
+	router := NewRouter(svc, signer, models.NewMetrics())
+
+	for _, route := range []string{"/repair", "/decommission", "/backup", "/keyspaces"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, route, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected POST %s without the secret to be rejected, got: %d", route, w.Code)
+		}
+	}
+	if svc.repairs != 0 {
+		t.Fatal("the repair started without the secret")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/repair", nil)
+	req.Header.Set(auth.AuthorizationHeader, "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || svc.repairs != 1 {
+		t.Fatalf("expected the repair to start with the secret, got: %d, %d repair(s)", w.Code, svc.repairs)
+	}
+}
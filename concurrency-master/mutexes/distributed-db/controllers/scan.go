@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type scanner interface {
+	Scan(req models.ScanRequest) (models.ScanResponse, error)
+}
+
+func scan(svc scanner) http.HandlerFunc {
+	return scanHandler(svc, false)
+}
+
+// localScan lists the keys of the receiving node, for the node scanning the cluster
+func localScan(svc scanner) http.HandlerFunc {
+	return scanHandler(svc, true)
+}
+
+func scanHandler(svc scanner, local bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.ScanRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode scan request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req.Local = local
+
+		res, err := svc.Scan(req)
+		if err != nil {
+			log.Printf("could not scan keys: %v", err)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode json: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
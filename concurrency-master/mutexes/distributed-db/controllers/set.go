@@ -4,12 +4,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 
 	"distributed-db/models"
 )
 
 type cacheSetter interface {
-	Set(key, value string) (models.CacheItem, error)
+	Set(req models.SetRequest) (models.CacheItem, error)
 }
 
 func set(svc cacheSetter) http.HandlerFunc {
@@ -22,14 +23,14 @@ func set(svc cacheSetter) http.HandlerFunc {
 			return
 		}
 
-		item, err := svc.Set(req.Key, req.Value)
+		item, err := svc.Set(req)
 		if err != nil {
 			log.Printf("could not store cache item: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		log.Printf("successfully stored record with key: %s on: %s", item.Key, item.Node)
+		log.Printf("successfully stored record with key: %s on: %s", item.Key, strings.Join(item.Replicas, ","))
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(item)
 		if err != nil {
@@ -9,7 +9,7 @@ import (
 )
 
 type cacheBatchSetter interface {
-	SetBatch(items map[int]models.CacheItem) []models.CacheItem
+	SetBatch(items map[int]models.CacheItem) ([]models.CacheItem, error)
 }
 
 func setBatch(svc cacheBatchSetter) http.HandlerFunc {
@@ -22,7 +22,12 @@ func setBatch(svc cacheBatchSetter) http.HandlerFunc {
 			return
 		}
 
-		items := svc.SetBatch(req.Items)
+		items, err := svc.SetBatch(req.Items)
+		if err != nil {
+			log.Printf("could not store batch: %v", err)
+			writeError(w, err)
+			return
+		}
 		log.Printf("successfully stored batch")
 
 		w.Header().Set("Content-Type", "application/json")
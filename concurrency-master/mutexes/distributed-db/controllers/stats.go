@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"distributed-db/models"
+)
+
+type statsGetter interface {
+	Stats(keyspace string) (models.StatsResponse, error)
+}
+
+// stats shows the memory of the node, and the items it stores
+// for the keyspace given as the keyspace param, if any
+func stats(svc statsGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := svc.Stats(r.URL.Query().Get("keyspace"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode stats response: %v", err)
+		}
+	}
+}
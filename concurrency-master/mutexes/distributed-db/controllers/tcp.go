@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"distributed-db/auth"
+	"distributed-db/models"
+	"distributed-db/protocol"
+)
+
+// NodeService is what the other nodes can ask for over the binary protocol
+type NodeService interface {
+	cacheGetter
+	cacheSetter
+	cacheBatchSetter
+	tokensGetter
+	tokensUpdater
+	merkleTreeGetter
+	pinger
+	scanner
+	casWriter
+	acceptor
+	changesGetter
+	partBackuper
+}
+
+// NewTCPServer creates the server of the binary protocol, which carries the
+// traffic between the nodes. The clients keep using the http api
+func NewTCPServer(svc NodeService, signer *auth.Signer, metrics *models.Metrics) *TCPServer {
+	return &TCPServer{
+		svc:     svc,
+		signer:  signer,
+		metrics: metrics,
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// tcpRoutes are the http routes matching the ops, so the latency of the
+// requests is recorded under the same route whatever the transport.
+// The polls for changes are left out, like on http
+var tcpRoutes = map[protocol.Op]string{
+	protocol.OpGet:          "/get/replica",
+	protocol.OpSet:          "/set",
+	protocol.OpSetBatch:     "/set/batch",
+	protocol.OpGossip:       "/gossip",
+	protocol.OpTokens:       "/tokens",
+	protocol.OpMerkleTree:   "/merkle",
+	protocol.OpRangeItems:   "/merkle/items",
+	protocol.OpPing:         "/ping",
+	protocol.OpIndirectPing: "/ping/indirect",
+	protocol.OpScan:         "/scan/local",
+	protocol.OpCAS:          "/cas/local",
+	protocol.OpPrepare:      "/cas/prepare",
+	protocol.OpPropose:      "/cas/propose",
+	protocol.OpCommit:       "/cas/commit",
+	protocol.OpBackup:       "/backup/node",
+}
+
+type TCPServer struct {
+	svc      NodeService
+	signer   *auth.Signer
+	metrics  *models.Metrics
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// Serve accepts connections until the server is closed
+func (s *TCPServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes the open ones
+func (s *TCPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// serveConn reads the requests of a connection one by one, but handles
+// them concurrently, so a slow request does not hold back the others
+func (s *TCPServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	hello, err := protocol.ReadFrame(conn)
+	if err != nil || hello.Op != protocol.OpHello {
+		log.Printf("could not read hello frame from: %s", conn.RemoteAddr())
+		return
+	}
+	node, nonce, err := s.signer.VerifyHello(hello.Payload)
+	if err != nil {
+		log.Printf("rejected tcp connection from: %s, %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	codec := protocol.NewCodec()
+	responder := &tcpResponder{conn: conn, codec: codec, signer: s.signer, nonce: nonce}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// the long polls end with the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lastID := uint64(0)
+	for {
+		f, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		f, err = protocol.Open(s.signer, nonce, protocol.ToServer, f)
+		if err != nil {
+			log.Printf("rejected tcp frame from node: %s, %v", node, err)
+			return
+		}
+		// the clients number their requests in the order they write them,
+		// so a frame sent again on the connection is caught right away
+		if f.ID <= lastID {
+			log.Printf("rejected tcp frame from node: %s, replayed request: %d", node, f.ID)
+			return
+		}
+		lastID = f.ID
+
+		handle, err := s.decode(ctx, node, f, codec)
+		if err != nil {
+			log.Printf("could not decode request from node: %s, %v", node, err)
+			return
+		}
+
+		wg.Add(1)
+		go func(id uint64, route string) {
+			defer wg.Done()
+			start := time.Now()
+			responder.respond(id, handle)
+			if route != "" {
+				s.metrics.ObserveRequest(route, "tcp", time.Since(start))
+			}
+		}(f.ID, tcpRoutes[f.Op])
+	}
+}
+
+// decode decodes the payload of the request and returns its handler. Decoding
+// happens in the order the frames are read, as the codec requires
+func (s *TCPServer) decode(ctx context.Context, node string, f protocol.Frame, codec *protocol.Codec) (func() (interface{}, error), error) {
+	switch f.Op {
+	case protocol.OpGet:
+		var req models.GetRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			res, err := s.svc.Get(req)
+			return res.Items, err
+		}, err
+	case protocol.OpSet:
+		var req models.SetRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Set(req)
+		}, err
+	case protocol.OpSetBatch:
+		var req models.SetBatchRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.SetBatch(req.Items)
+		}, err
+	case protocol.OpGossip:
+		var req models.GossipRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.UpdateTokens(node, req)
+		}, err
+	case protocol.OpTokens:
+		return func() (interface{}, error) {
+			return models.TokensResponse{Tokens: s.svc.GetTokens()}, nil
+		}, nil
+	case protocol.OpMerkleTree:
+		var req models.MerkleRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.MerkleTree(node, req), nil
+		}, err
+	case protocol.OpRangeItems:
+		var req models.RangeItemsRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return models.RangeItemsResponse{Items: s.svc.RangeItems(node, req.Ranges)}, nil
+		}, err
+	case protocol.OpPing:
+		var req models.PingRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Ping(req), nil
+		}, err
+	case protocol.OpIndirectPing:
+		var req models.IndirectPingRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.IndirectPing(req)
+		}, err
+	case protocol.OpScan:
+		var req models.ScanRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Scan(req)
+		}, err
+	case protocol.OpCAS:
+		var req models.CASRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.CAS(req)
+		}, err
+	case protocol.OpPrepare:
+		var req models.PrepareRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Prepare(req), nil
+		}, err
+	case protocol.OpPropose:
+		var req models.ProposeRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Propose(req), nil
+		}, err
+	case protocol.OpCommit:
+		var req models.CommitRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Commit(req)
+		}, err
+	case protocol.OpChanges:
+		var req models.ChangesRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.Changes(ctx, req), nil
+		}, err
+	case protocol.OpBackup:
+		var req models.BackupRequest
+		err := codec.Decode(f.Payload, &req)
+		return func() (interface{}, error) {
+			return s.svc.BackupPart(req)
+		}, err
+	default:
+		return nil, fmt.Errorf("unknown op: %d", f.Op)
+	}
+}
+
+type tcpResponder struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	codec  *protocol.Codec
+	signer *auth.Signer
+	nonce  []byte
+}
+
+func (r *tcpResponder) respond(id uint64, handle func() (interface{}, error)) {
+	res, err := handle()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := protocol.Frame{ID: id, Status: protocol.StatusOK}
+	if err != nil {
+		f.Status, f.Payload = protocol.StatusError, []byte(err.Error())
+	} else {
+		f.Payload, err = r.codec.Encode(res)
+		if err != nil {
+			// the encoder may have been left halfway through a type definition
+			log.Printf("could not encode response: %v", err)
+			r.conn.Close()
+			return
+		}
+	}
+
+	err = protocol.WriteFrame(r.conn, protocol.Seal(r.signer, r.nonce, protocol.ToClient, f))
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("could not write response: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"distributed-db/models"
+)
+
+// how often a comment is sent on quiet streams, so proxies don't close them
+const watchHeartbeat = 15 * time.Second
+
+type changesGetter interface {
+	Changes(ctx context.Context, req models.ChangesRequest) models.ChangesResponse
+}
+
+type watcher interface {
+	changesGetter
+	Watch(ctx context.Context, req models.WatchRequest) (<-chan models.WatchEvent, error)
+}
+
+// watch streams the changes as server-sent events: the id of every event is the
+// cursor to resume from, sent back as the Last-Event-ID header or the cursor param
+func watch(svc watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		query := r.URL.Query()
+		cursor := query.Get("cursor")
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			cursor = id
+		}
+		position, err := models.ParseWatchCursor(cursor)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		req := models.WatchRequest{Keyspace: query.Get("keyspace"), Key: query.Get("key"), Prefix: query.Get("prefix"), Cursor: position}
+		events, err := svc.Watch(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = fmt.Fprint(w, ": watching\n\n")
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": ping\n\n")
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				var data []byte
+				data, err = json.Marshal(e)
+				if err != nil {
+					log.Printf("could not encode watch event: %v", err)
+					return
+				}
+				_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Cursor, e.Type, data)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func changes(svc changesGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.ChangesRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Printf("could not decode changes request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// the poll ends with the request of the watching node
+		res := svc.Changes(r.Context(), req)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Printf("could not encode changes response: %v", err)
+		}
+	}
+}
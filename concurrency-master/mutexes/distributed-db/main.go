@@ -28,10 +28,13 @@ func main() {
 
 	select {
 	case <-signals:
-		cancel()
-		err = a.Stop(ctx)
-		if err != nil {
-			log.Fatalf("could not stop the app: %v", err)
-		}
+	case <-a.Decommissioned():
+		log.Println("the node left the cluster")
+	}
+
+	cancel()
+	err = a.Stop(ctx)
+	if err != nil {
+		log.Fatalf("could not stop the app: %v", err)
 	}
 }
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+// BackupIDLayout formats the time a backup was started into its id,
+// so the ids sort like the backups
+const BackupIDLayout = "20060102T150405.000Z"
+
+// BackupRequest asks a node to write its part of the backup, used between nodes
+type BackupRequest struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// BackupManifest describes the part of a backup written by a node
+type BackupManifest struct {
+	ID       string    `json:"id"`
+	Node     string    `json:"node"`
+	Time     time.Time `json:"time"`
+	Tables   int       `json:"tables"`
+	Bytes    int64     `json:"bytes"`
+	Duration string    `json:"duration"`
+}
+
+// BackupSet lists the parts of a backup. It is only written once
+// every node wrote its part, a backup without it is incomplete
+type BackupSet struct {
+	ID    string           `json:"id"`
+	Time  time.Time        `json:"time"`
+	Parts []BackupManifest `json:"parts"`
+}
+
+// RestoreLatest restores the newest complete backup
+const RestoreLatest = "latest"
+
+// RestoreRequest selects the backup, the newest one, the one with the id, or the
+// newest one taken by the RFC3339 time, and the nodes whose parts are restored
+type RestoreRequest struct {
+	Backup   string
+	Nodes    []string
+	AllNodes bool
+}
+
+// RestoreResponse tells which backup was restored
+type RestoreResponse struct {
+	ID    string
+	Nodes []string
+	Items int
+}
@@ -4,9 +4,41 @@ import (
 	"time"
 )
 
+const DefaultReplicationFactor = 1
+
+// CacheItem represents a stored record.
+// A Deleted item is a tombstone, which wins over older values
+// until it gets purged after the tombstone grace period.
+// Items with an ExpiresAt time are short-lived and disappear once they expire.
+// The Version is incremented by every compare-and-set, plain writes reset it to 0.
+// The Keyspace is only set on the items returned to the clients of a named keyspace,
+// the stored items carry it in their key
 type CacheItem struct {
-	Key       string    `json:"key"`
-	Value     string    `json:"value"`
-	UpdatedAt time.Time `json:"updated_at,omitempty"`
-	Node      string    `json:"node,omitempty"`
+	Key               string    `json:"key"`
+	Value             string    `json:"value"`
+	UpdatedAt         time.Time `json:"updated_at,omitempty"`
+	ReplicationFactor int       `json:"replication_factor,omitempty"`
+	Deleted           bool      `json:"deleted,omitempty"`
+	Version           uint64    `json:"version,omitempty"`
+	ExpiresAt         time.Time `json:"expires_at,omitempty"`
+	Node              string    `json:"node,omitempty"`
+	Replicas          []string  `json:"replicas,omitempty"`
+	Digest            string    `json:"digest,omitempty"`
+	Keyspace          string    `json:"keyspace,omitempty"`
+}
+
+// Expired tells whether the item has an expiry time which has passed
+func (i CacheItem) Expired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+// ExpiredTombstone returns the tombstone replacing the item once it expired. It is dated
+// when the item expired, never before its last write, so the copies of the item left
+// on the other replicas don't win over it
+func (i CacheItem) ExpiredTombstone() CacheItem {
+	updatedAt := i.ExpiresAt
+	if updatedAt.Before(i.UpdatedAt) {
+		updatedAt = i.UpdatedAt
+	}
+	return CacheItem{Key: i.Key, UpdatedAt: updatedAt, ReplicationFactor: i.ReplicationFactor, Deleted: true}
 }
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChangeSet    = "set"
+	ChangeDelete = "delete"
+	// the changes of a node were missed, the watched keys have to be read again
+	ChangeReset = "reset"
+)
+
+// Change is a write applied on the node owning the key. Seq is its
+// position in the change log of the node, which restarts at every boot
+type Change struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	Item CacheItem `json:"item"`
+}
+
+// NewChanges creates the change log of the node, which keeps the last size changes
+func NewChanges(size int) *Changes {
+	return &Changes{
+		epoch:   time.Now().UnixNano(),
+		changes: make([]Change, size),
+		notify:  make(chan struct{}),
+	}
+}
+
+// Changes is a ring of the recent changes of the node. Readers ask for
+// the changes after the last one they saw and wait for the next ones
+type Changes struct {
+	mu      sync.Mutex
+	epoch   int64
+	changes []Change
+	// seq of the newest change, the ring holds the ones after seq-len(changes)
+	seq    uint64
+	notify chan struct{}
+}
+
+// Epoch tells the change logs of the node apart, the seqs of the previous boots are gone
+func (c *Changes) Epoch() int64 {
+	return c.epoch
+}
+
+func (c *Changes) Seq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seq
+}
+
+func (c *Changes) Append(items []CacheItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, item := range items {
+		c.seq++
+		change := Change{Seq: c.seq, Type: ChangeSet, Item: item}
+		if item.Deleted {
+			change.Type = ChangeDelete
+		}
+		c.changes[c.seq%uint64(len(c.changes))] = change
+	}
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// Since returns the changes after the given seq and the seq of the newest change.
+// Truncated tells whether some of the changes after seq were already dropped from the ring.
+// The channel is closed on the next change
+func (c *Changes) Since(after uint64) (changes []Change, seq uint64, truncated bool, next <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := uint64(1)
+	if c.seq > uint64(len(c.changes)) {
+		oldest = c.seq - uint64(len(c.changes)) + 1
+	}
+	if after > c.seq {
+		after = c.seq
+	}
+	if after+1 < oldest {
+		after, truncated = oldest-1, true
+	}
+
+	changes = make([]Change, 0, c.seq-after)
+	for s := after + 1; s <= c.seq; s++ {
+		changes = append(changes, c.changes[s%uint64(len(c.changes))])
+	}
+	return changes, c.seq, truncated, c.notify
+}
+
+// WatchEvent is a change sent to a watcher, with the cursor to resume after it
+type WatchEvent struct {
+	Type   string    `json:"type"`
+	Node   string    `json:"node"`
+	Item   CacheItem `json:"item"`
+	Cursor string    `json:"-"`
+}
+
+// WatchPosition is the last change of a node a watcher got
+type WatchPosition struct {
+	Epoch int64  `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// WatchCursor is where a watcher is in the change log of every node,
+// formatted as node=epoch.seq,node=epoch.seq
+type WatchCursor map[string]WatchPosition
+
+func (c WatchCursor) String() string {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, fmt.Sprintf("%s=%d.%d", node, c[node].Epoch, c[node].Seq))
+	}
+	return strings.Join(parts, ",")
+}
+
+func ParseWatchCursor(s string) (WatchCursor, error) {
+	cursor := WatchCursor{}
+	if s == "" {
+		return cursor, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		nodePosition := strings.SplitN(part, "=", 2)
+		if len(nodePosition) != 2 {
+			return nil, fmt.Errorf("%w: invalid cursor: %s", ErrInvalidRequest, s)
+		}
+		node, position := nodePosition[0], strings.SplitN(nodePosition[1], ".", 2)
+		if len(position) != 2 {
+			return nil, fmt.Errorf("%w: invalid cursor: %s", ErrInvalidRequest, s)
+		}
+		e, err := strconv.ParseInt(position[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor: %s", ErrInvalidRequest, s)
+		}
+		n, err := strconv.ParseUint(position[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor: %s", ErrInvalidRequest, s)
+		}
+		cursor[node] = WatchPosition{Epoch: e, Seq: n}
+	}
+	return cursor, nil
+}
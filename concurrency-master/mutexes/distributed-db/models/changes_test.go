@@ -0,0 +1,55 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChangesRing(t *testing.T) {
+	changes := NewChanges(4)
+	for i := 1; i <= 6; i++ {
+		changes.Append([]CacheItem{{Key: fmt.Sprintf("k%d", i), Deleted: i == 6}})
+	}
+
+	got, seq, truncated, _ := changes.Since(3)
+	if seq != 6 || truncated || len(got) != 3 || got[0].Item.Key != "k4" || got[2].Type != ChangeDelete {
+		t.Fatalf("unexpected changes after 3: %+v, seq: %d, truncated: %v", got, seq, truncated)
+	}
+
+	// the first 2 changes were dropped from the ring
+	got, _, truncated, _ = changes.Since(1)
+	if !truncated || len(got) != 4 || got[0].Seq != 3 {
+		t.Fatalf("unexpected changes after 1: %+v, truncated: %v", got, truncated)
+	}
+
+	got, _, _, next := changes.Since(6)
+	if len(got) != 0 {
+		t.Fatalf("unexpected changes after 6: %+v", got)
+	}
+	changes.Append([]CacheItem{{Key: "k7"}})
+	select {
+	case <-next:
+	default:
+		t.Fatal("the waiters were not notified of the new change")
+	}
+}
+
+func TestWatchCursorRoundTrip(t *testing.T) {
+	cursor := WatchCursor{"localhost:9001": {Epoch: 10, Seq: 3}, "localhost:9000": {Epoch: 20, Seq: 0}}
+	s := cursor.String()
+	if s != "localhost:9000=20.0,localhost:9001=10.3" {
+		t.Fatalf("unexpected cursor: %s", s)
+	}
+
+	parsed, err := ParseWatchCursor(s)
+	if err != nil {
+		t.Fatalf("could not parse cursor: %v", err)
+	}
+	if parsed.String() != s {
+		t.Fatalf("unexpected parsed cursor: %v", parsed)
+	}
+
+	if _, err = ParseWatchCursor("localhost:9000=abc"); err == nil {
+		t.Fatal("invalid cursor parsed")
+	}
+}
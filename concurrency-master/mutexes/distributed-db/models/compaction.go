@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// CompactionStats describes a single compaction run
+type CompactionStats struct {
+	Tables             int
+	BytesIn            int64
+	BytesOut           int64
+	RecordsIn          int
+	RecordsOut         int
+	DroppedOverwritten int
+	DroppedTombstones  int
+	DroppedExpired     int
+	Duration           time.Duration
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"fmt"
+)
+
+const (
+	ConsistencyLevelOne    ConsistencyLevel = "ONE"
+	ConsistencyLevelQuorum ConsistencyLevel = "QUORUM"
+	ConsistencyLevelAll    ConsistencyLevel = "ALL"
+)
+
+// ConsistencyLevel represents how many replicas have to acknowledge
+// a read or a write before replying to the client
+type ConsistencyLevel string
+
+// Acks returns the number of acknowledgements needed out of the given replicas.
+// An empty consistency level defaults to ONE
+func (l ConsistencyLevel) Acks(replicas int) (int, error) {
+	switch l {
+	case "", ConsistencyLevelOne:
+		return 1, nil
+	case ConsistencyLevelQuorum:
+		return replicas/2 + 1, nil
+	case ConsistencyLevelAll:
+		return replicas, nil
+	}
+	return 0, fmt.Errorf("%w: unknown consistency level: %s", ErrInvalidRequest, l)
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidRequest is returned when the request can't be served as is
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrUnavailable is returned when not enough replicas responded
+	// to satisfy the requested consistency level
+	ErrUnavailable = errors.New("unavailable")
+	// ErrUnauthorized is returned when a node-only request
+	// is not signed with the cluster secret
+	ErrUnauthorized = errors.New("unauthorized")
+)
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultKeyspace holds the keys of the requests which don't name a keyspace.
+// Its keys are stored as they are, so the data written before keyspaces existed
+// stays where it is. Creating it only sets the defaults of its requests
+const DefaultKeyspace = "default"
+
+// keyspaceSeparator joins the keyspace and the key into the stored key.
+// It can't be part of the name of a keyspace, nor of the keys of the clients
+const keyspaceSeparator = "\x00"
+
+var keyspaceName = regexp.MustCompile(`^[a-z0-9_-]{1,48}$`)
+
+// Keyspace is a named set of keys, with its own defaults for the requests
+// which don't specify a replication factor, a consistency level or a TTL.
+// The newest definition of a keyspace wins when the nodes gossip about it
+type Keyspace struct {
+	Name              string           `json:"name"`
+	ReplicationFactor int              `json:"replication_factor,omitempty"`
+	ConsistencyLevel  ConsistencyLevel `json:"consistency_level,omitempty"`
+	TTL               Duration         `json:"ttl,omitempty"`
+	UpdatedAt         time.Time        `json:"updated_at"`
+}
+
+// Validate checks the name and the defaults of the keyspace
+func (k Keyspace) Validate() error {
+	if !keyspaceName.MatchString(k.Name) {
+		return fmt.Errorf("%w: the name of a keyspace must be 1 to 48 lowercase letters, digits, - or _", ErrInvalidRequest)
+	}
+	if k.ReplicationFactor < 0 {
+		return fmt.Errorf("%w: the replication factor can't be negative", ErrInvalidRequest)
+	}
+	if k.TTL < 0 {
+		return fmt.Errorf("%w: the ttl can't be negative", ErrInvalidRequest)
+	}
+	_, err := k.ConsistencyLevel.Acks(1)
+	return err
+}
+
+// KeyspaceKey returns the key the key of the keyspace is stored under
+func KeyspaceKey(keyspace, key string) string {
+	if keyspace == "" || keyspace == DefaultKeyspace {
+		return key
+	}
+	return keyspace + keyspaceSeparator + key
+}
+
+// SplitKeyspaceKey returns the keyspace and the key of the client a stored key is made of
+func SplitKeyspaceKey(stored string) (string, string) {
+	i := strings.Index(stored, keyspaceSeparator)
+	if i < 0 {
+		return DefaultKeyspace, stored
+	}
+	return stored[:i], stored[i+len(keyspaceSeparator):]
+}
+
+// ValidKey tells whether the key of a client can be stored
+func ValidKey(key string) bool {
+	return !strings.Contains(key, keyspaceSeparator)
+}
+
+// KeyspaceStats describes the live items of a keyspace stored on a node, replicas included
+type KeyspaceStats struct {
+	Name  string `json:"name"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
@@ -0,0 +1,38 @@
+package models
+
+// what happens to the least recently used items when the memory limit is reached
+const (
+	// the items leave the memory but stay on disk
+	EvictionSpill = "spill"
+	// the items are removed, the node keeps as much data as fits in the memory limit
+	EvictionDrop = "drop"
+)
+
+// the fields of an item and the entries pointing to it in the memory structures
+const itemOverhead = 256
+
+// Size approximates the bytes taken by the item in memory
+func (i CacheItem) Size() int64 {
+	size := itemOverhead + len(i.Key) + len(i.Value) + len(i.Node) + len(i.Digest)
+	for _, replica := range i.Replicas {
+		size += 16 + len(replica)
+	}
+	return int64(size)
+}
+
+// MemoryStats describes the items the storage holds in memory
+type MemoryStats struct {
+	Policy string `json:"policy"`
+	// 0 means unlimited
+	Limit int64 `json:"limit"`
+	Used  int64 `json:"used"`
+	Items int   `json:"items"`
+	// items not flushed to disk yet
+	Unflushed int `json:"unflushed"`
+	// reads served from memory and from disk
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// items evicted from memory, still on disk, and items evicted and removed
+	Spilled int64 `json:"spilled"`
+	Dropped int64 `json:"dropped"`
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+)
+
+// number of levels below the root, a tree has 2^MerkleDepth leaves
+const MerkleDepth = 6
+
+// TokenRange represents all the tokens between From and To, both included
+type TokenRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+func (r TokenRange) Contains(token int) bool {
+	return token >= r.From && token <= r.To
+}
+
+// MerkleTree is a hash tree over the items of a token range.
+// The range is split into equal sub ranges, one for every leaf.
+// Hashes are stored level by level, the root first and the leaves last,
+// the children of node i being 2i+1 and 2i+2
+type MerkleTree struct {
+	Range  TokenRange `json:"range"`
+	Hashes []string   `json:"hashes"`
+}
+
+func NewMerkleTree(r TokenRange, items map[int]CacheItem) MerkleTree {
+	leaves := 1 << MerkleDepth
+	digests := make([][]string, leaves)
+	tokens := make([]int, 0, len(items))
+	for token := range items {
+		tokens = append(tokens, token)
+	}
+	sort.Ints(tokens)
+	for _, token := range tokens {
+		if !r.Contains(token) {
+			continue
+		}
+		leaf := leafOf(r, token)
+		digests[leaf] = append(digests[leaf], Digest(items[token]))
+	}
+
+	hashes := make([]string, 2*leaves-1)
+	for i := 0; i < leaves; i++ {
+		hashes[leaves-1+i] = hash(digests[i]...)
+	}
+	for i := leaves - 2; i >= 0; i-- {
+		hashes[i] = hash(hashes[2*i+1], hashes[2*i+2])
+	}
+
+	return MerkleTree{Range: r, Hashes: hashes}
+}
+
+func (t MerkleTree) Root() string {
+	if len(t.Hashes) == 0 {
+		return ""
+	}
+	return t.Hashes[0]
+}
+
+// Diff walks both trees from the root and returns
+// the token ranges of the leaves which differ
+func (t MerkleTree) Diff(other MerkleTree) []TokenRange {
+	ranges, leaves := make([]TokenRange, 0), 1<<MerkleDepth
+	if len(t.Hashes) != 2*leaves-1 || len(other.Hashes) != 2*leaves-1 {
+		if t.Root() != other.Root() {
+			ranges = append(ranges, t.Range)
+		}
+		return ranges
+	}
+
+	var walk func(i int)
+	walk = func(i int) {
+		if t.Hashes[i] == other.Hashes[i] {
+			return
+		}
+		if i >= leaves-1 {
+			ranges = append(ranges, leafRange(t.Range, i-(leaves-1)))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return ranges
+}
+
+// Digest represents the version of an item, equal digests mean equal items
+func Digest(item CacheItem) string {
+	return hash(item.Key, item.Value, item.UpdatedAt.String(), item.ExpiresAt.String(), fmt.Sprint(item.Deleted), fmt.Sprint(item.Version))
+}
+
+func hash(values ...string) string {
+	h := md5.New()
+	for _, v := range values {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// the width of a leaf is computed on unsigned integers
+// so ranges spanning most of the ring don't overflow
+func leafWidth(r TokenRange) uint64 {
+	width := (uint64(r.To)-uint64(r.From))/(1<<MerkleDepth) + 1
+	return width
+}
+
+func leafOf(r TokenRange, token int) int {
+	leaf := int((uint64(token) - uint64(r.From)) / leafWidth(r))
+	if leaf >= 1<<MerkleDepth {
+		leaf = 1<<MerkleDepth - 1
+	}
+	return leaf
+}
+
+func leafRange(r TokenRange, leaf int) TokenRange {
+	width := leafWidth(r)
+	from := uint64(r.From) + uint64(leaf)*width
+	to := from + width - 1
+	if leaf == 1<<MerkleDepth-1 || to-uint64(r.From) > uint64(r.To)-uint64(r.From) {
+		to = uint64(r.To)
+	}
+	return TokenRange{From: int(from), To: int(to)}
+}
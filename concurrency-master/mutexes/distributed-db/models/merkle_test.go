@@ -0,0 +1,56 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestMerkleTreeDiff changes a single item of a range. The trees of the range
+// must differ by exactly the leaf holding the item, on small ranges as well as
+// on the whole ring, and the trees cut to their root must compare by their root
+func TestMerkleTreeDiff(t *testing.T) {
+	now := time.Now().UTC()
+	for _, r := range []TokenRange{{From: -1000, To: 1000}, {From: math.MinInt, To: math.MaxInt}} {
+		items := map[int]CacheItem{}
+		step := int(leafWidth(r) / 3)
+		for i := 0; i < 3<<MerkleDepth; i++ {
+			token := r.From + i*step
+			items[token] = CacheItem{Key: fmt.Sprintf("key:%d", i), Value: "value", UpdatedAt: now}
+		}
+		local := NewMerkleTree(r, items)
+		if diff := local.Diff(NewMerkleTree(r, items)); len(diff) != 0 {
+			t.Fatalf("range: %+v, expected no difference between equal trees, got: %v", r, diff)
+		}
+
+		for _, changed := range []int{r.From, r.From + 100*step, r.From + (3<<MerkleDepth-1)*step} {
+			other := map[int]CacheItem{}
+			for token, item := range items {
+				other[token] = item
+			}
+			item := other[changed]
+			item.UpdatedAt = now.Add(time.Second)
+			other[changed] = item
+
+			diff := local.Diff(NewMerkleTree(r, other))
+			leaf := leafRange(r, leafOf(r, changed))
+			if len(diff) != 1 || diff[0] != leaf || !diff[0].Contains(changed) {
+				t.Fatalf("range: %+v, expected the leaf: %+v of token: %d to differ, got: %v", r, leaf, changed, diff)
+			}
+
+			// the remote tree is cut to its root when the roots match
+			remote := NewMerkleTree(r, other)
+			remote.Hashes = remote.Hashes[:1]
+			if diff = local.Diff(remote); len(diff) != 1 || diff[0] != r {
+				t.Fatalf("range: %+v, expected the whole range to differ from a different root, got: %v", r, diff)
+			}
+		}
+
+		remote := NewMerkleTree(r, items)
+		remote.Hashes = remote.Hashes[:1]
+		if diff := local.Diff(remote); len(diff) != 0 {
+			t.Fatalf("range: %+v, expected no difference with the same root, got: %v", r, diff)
+		}
+	}
+}
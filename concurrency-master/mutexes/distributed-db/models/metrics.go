@@ -0,0 +1,143 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// upper bounds of the request latency buckets, in seconds
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewMetrics creates the counters of what the node did since it started
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:      map[requestLabels]*histogram{},
+		statusChanges: map[string]uint64{},
+	}
+}
+
+// Metrics counts the requests served by the node and the work of its workers
+type Metrics struct {
+	mu                sync.Mutex
+	requests          map[requestLabels]*histogram
+	gossipRounds      uint64
+	gossipFailures    uint64
+	streamedItems     uint64
+	streamFailedItems uint64
+	statusChanges     map[string]uint64
+}
+
+type requestLabels struct {
+	route     string
+	transport string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// ObserveRequest records how long serving a request of the route took
+func (m *Metrics) ObserveRequest(route, transport string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := requestLabels{route: route, transport: transport}
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.requests[labels] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// GossipRound records a gossip round and the number of nodes which could not be reached
+func (m *Metrics) GossipRound(failures int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gossipRounds++
+	m.gossipFailures += uint64(failures)
+}
+
+// Streamed records the items streamed to their new replicas and the ones which failed
+func (m *Metrics) Streamed(items, failed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.streamedItems += uint64(items)
+	m.streamFailedItems += uint64(failed)
+}
+
+// StatusChanged records a node status change noticed by the node
+func (m *Metrics) StatusChanged(status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.statusChanges[NodeStatusText(status)]++
+}
+
+// Snapshot returns a copy of the counters
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := MetricsSnapshot{
+		Requests:          make([]RequestMetrics, 0, len(m.requests)),
+		GossipRounds:      m.gossipRounds,
+		GossipFailures:    m.gossipFailures,
+		StreamedItems:     m.streamedItems,
+		StreamFailedItems: m.streamFailedItems,
+		StatusChanges:     map[string]uint64{},
+	}
+	for labels, h := range m.requests {
+		snapshot.Requests = append(snapshot.Requests, RequestMetrics{
+			Route:     labels.route,
+			Transport: labels.transport,
+			Buckets:   latencyBuckets,
+			Counts:    append([]uint64{}, h.counts...),
+			Count:     h.count,
+			Sum:       h.sum,
+		})
+	}
+	sort.Slice(snapshot.Requests, func(i, j int) bool {
+		if snapshot.Requests[i].Route != snapshot.Requests[j].Route {
+			return snapshot.Requests[i].Route < snapshot.Requests[j].Route
+		}
+		return snapshot.Requests[i].Transport < snapshot.Requests[j].Transport
+	})
+	for status, count := range m.statusChanges {
+		snapshot.StatusChanges[status] = count
+	}
+	return snapshot
+}
+
+type MetricsSnapshot struct {
+	Requests          []RequestMetrics
+	GossipRounds      uint64
+	GossipFailures    uint64
+	StreamedItems     uint64
+	StreamFailedItems uint64
+	// by the new status
+	StatusChanges map[string]uint64
+}
+
+// RequestMetrics is the latency histogram of a route,
+// Counts[i] is the number of requests which took up to Buckets[i] seconds
+type RequestMetrics struct {
+	Route     string
+	Transport string
+	Buckets   []float64
+	Counts    []uint64
+	Count     uint64
+	Sum       float64
+}
@@ -1,114 +1,312 @@
 package models
 
 import (
-	"log"
+	"math/rand"
+	"sync"
 	"time"
 )
 
 const (
-	NodeStatusUp   = 1
-	NodeStatusDown = 0
-	gossipDeadline = 15 * time.Second
-	retryPeriod    = time.Minute
-	maxFails       = 5
+	NodeStatusUp      = 1
+	NodeStatusDown    = 0
+	NodeStatusSuspect = 2
+	NodeStatusLeaving = 3
+	NodeStatusLeft    = 4
 )
 
+// NodeStatusText returns a text for the node status
+func NodeStatusText(status int) string {
+	switch status {
+	case NodeStatusUp:
+		return "up"
+	case NodeStatusSuspect:
+		return "suspect"
+	case NodeStatusDown:
+		return "down"
+	case NodeStatusLeaving:
+		return "leaving"
+	case NodeStatusLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// Member is what a node knows about another node. The incarnation can only
+// be increased by the node itself, when it refutes a suspicion about it.
+// For the same incarnation left overrides leaving, which overrides down,
+// which overrides suspect, which overrides up
+type Member struct {
+	Status      int    `json:"status"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// overrides reports whether m is newer information than other
+func (m Member) overrides(other Member) bool {
+	if m.Incarnation != other.Incarnation {
+		return m.Incarnation > other.Incarnation
+	}
+	return statusPrecedence(m.Status) > statusPrecedence(other.Status)
+}
+
+func statusPrecedence(status int) int {
+	switch status {
+	case NodeStatusUp:
+		return 0
+	case NodeStatusSuspect:
+		return 1
+	case NodeStatusDown:
+		return 2
+	case NodeStatusLeaving:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// inRing reports whether a node with the status owns token ranges.
+// Down nodes keep their ranges, they are expected to come back
+func inRing(status int) bool {
+	return status != NodeStatusLeaving && status != NodeStatusLeft
+}
+
 func NewNodes(currentNode string, nodeMap NodesMap) *Nodes {
 	nodes := &Nodes{
-		current:      currentNode,
-		nodesStatus:  NodesMap{},
-		gossipStatus: map[string]time.Time{},
-		nodeFails:    map[string]int{},
-		nodeRetries:  map[string]time.Time{},
-	}
-	nodes.Set(nodeMap)
-	go nodes.retry()
+		current:     currentNode,
+		status:      NodeStatusUp,
+		members:     map[string]*member{},
+		subscribers: make([]func(node string, status int), 0),
+	}
+	for node := range nodeMap {
+		if node == currentNode {
+			continue
+		}
+		nodes.members[node] = &member{Member: Member{Status: NodeStatusUp}}
+	}
 	return nodes
 }
 
+type member struct {
+	Member
+	suspectedAt time.Time
+}
+
+// Nodes keeps the membership of the cluster, SWIM style. Nodes are probed
+// in a random round robin order; the ones which don't answer are suspected
+// and declared down when nobody refutes the suspicion in time.
+// The status changes are piggybacked on the gossip
 type Nodes struct {
-	current      string
-	nodesStatus  NodesMap
-	gossipStatus map[string]time.Time
-	nodeFails    map[string]int
-	nodeRetries  map[string]time.Time
+	mu          sync.RWMutex
+	current     string
+	status      int
+	incarnation uint64
+	members     map[string]*member
+	probes      []string
+	subscribers []func(node string, status int)
+}
+
+type statusChange struct {
+	node   string
+	status int
 }
 
-func (n Nodes) Current() string {
+func (n *Nodes) Current() string {
 	return n.current
 }
 
-func (n Nodes) Fail(node string) {
-	n.nodeFails[node]++
-	if n.nodeFails[node] >= maxFails {
-		log.Printf("node: %s is down, retryin in: %v", node, retryPeriod)
-		n.nodesStatus[node] = NodeStatusDown
-		n.nodeRetries[node] = time.Now().UTC()
-	}
+// Subscribe registers a function which is called every time a node changes status
+func (n *Nodes) Subscribe(fn func(node string, status int)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.subscribers = append(n.subscribers, fn)
 }
 
-func (n Nodes) retry() {
-	for {
-		time.Sleep(time.Second)
-		for node, lastTried := range n.nodeRetries {
-			now := time.Now().UTC()
-			if now.Sub(lastTried) >= retryPeriod {
-				log.Printf("retrying gossip on node: %s", node)
-				n.nodeFails[node] = 0
-				n.nodesStatus[node] = NodeStatusUp
-				delete(n.nodeRetries, node)
-				n.gossipStatus[node] = time.Now().UTC()
-			}
-		}
+// Members returns the membership, including the current node, to be gossiped
+func (n *Nodes) Members() map[string]Member {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	members := map[string]Member{n.current: {Status: n.status, Incarnation: n.incarnation}}
+	for node, m := range n.members {
+		members[node] = m.Member
 	}
+	return members
 }
 
-func (n Nodes) Gossip(node string) {
-	n.gossipStatus[node] = time.Now().UTC()
+// Member returns what is known about the node
+func (n *Nodes) Member(node string) (Member, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if node == n.current {
+		return Member{Status: n.status, Incarnation: n.incarnation}, true
+	}
+	m, ok := n.members[node]
+	if !ok {
+		return Member{}, false
+	}
+	return m.Member, true
 }
 
-func (n Nodes) Set(nodesStatus NodesMap) {
-	for node, status := range nodesStatus {
+// Merge applies the membership received from another node. Suspicions about
+// the current node are refuted by increasing its incarnation
+func (n *Nodes) Merge(members map[string]Member) {
+	n.mu.Lock()
+	changes := make([]statusChange, 0)
+	for node, m := range members {
 		if node == n.current {
+			n.refute(m)
 			continue
 		}
-		n.nodesStatus[node] = status
+		if change, ok := n.apply(node, m); ok {
+			changes = append(changes, change)
+		}
 	}
+	n.mu.Unlock()
+
+	n.notify(changes)
 }
 
-func (n Nodes) Map() NodesMap {
-	nodes := NodesMap{n.current: NodeStatusUp}
-	for node, lastGossip := range n.gossipStatus {
-		now := time.Now().UTC()
-		if now.Sub(lastGossip) < gossipDeadline {
-			nodes[node] = NodeStatusUp
+// Refute increases the incarnation of the current node when the given
+// member, what another node knows about it, disagrees with its status.
+// The new incarnation overrides the suspicion everywhere it gets gossiped to
+func (n *Nodes) Refute(m Member) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.refute(m)
+	return n.incarnation
+}
+
+// SetStatus changes the status of the current node, with a new incarnation
+// so it overrides whatever the other nodes know about it
+func (n *Nodes) SetStatus(status int) {
+	n.mu.Lock()
+	n.status = status
+	n.incarnation++
+	n.mu.Unlock()
+
+	n.notify([]statusChange{{node: n.current, status: status}})
+}
+
+// Status returns the status of the current node
+func (n *Nodes) Status() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.status
+}
+
+// Alive records that the node answered a probe with its incarnation
+func (n *Nodes) Alive(node string, incarnation uint64) {
+	n.mu.Lock()
+	change, ok := n.apply(node, Member{Status: NodeStatusUp, Incarnation: incarnation})
+	n.mu.Unlock()
+
+	if ok {
+		n.notify([]statusChange{change})
+	}
+}
+
+// Suspect marks the node as suspect, unless it is not up
+func (n *Nodes) Suspect(node string) {
+	n.mu.Lock()
+	m, ok := n.members[node]
+	if !ok || m.Status != NodeStatusUp {
+		n.mu.Unlock()
+		return
+	}
+	change, _ := n.apply(node, Member{Status: NodeStatusSuspect, Incarnation: m.Incarnation})
+	n.mu.Unlock()
+
+	n.notify([]statusChange{change})
+}
+
+// Expire declares down the nodes which have been suspect for longer than the timeout
+func (n *Nodes) Expire(timeout time.Duration) {
+	n.mu.Lock()
+	now, changes := time.Now().UTC(), make([]statusChange, 0)
+	for node, m := range n.members {
+		if m.Status != NodeStatusSuspect || now.Sub(m.suspectedAt) < timeout {
 			continue
 		}
-		nodes[node] = NodeStatusDown
+		change, _ := n.apply(node, Member{Status: NodeStatusDown, Incarnation: m.Incarnation})
+		changes = append(changes, change)
+	}
+	n.mu.Unlock()
+
+	n.notify(changes)
+}
+
+// NextProbe returns the next node to be probed. Every node is probed once
+// per round and the order is shuffled at the start of every round
+func (n *Nodes) NextProbe() (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		if len(n.probes) == 0 {
+			if len(n.members) == 0 {
+				return "", false
+			}
+			// nodes which left are probed too, so they are noticed when they rejoin
+			for node := range n.members {
+				n.probes = append(n.probes, node)
+			}
+			rand.Shuffle(len(n.probes), func(i, j int) {
+				n.probes[i], n.probes[j] = n.probes[j], n.probes[i]
+			})
+		}
+
+		node := n.probes[0]
+		n.probes = n.probes[1:]
+		// nodes can't be removed now, but the check is cheap
+		if _, ok := n.members[node]; ok {
+			return node, true
+		}
+	}
+}
+
+func (n *Nodes) Map() NodesMap {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	nodes := NodesMap{n.current: n.status}
+	for node, m := range n.members {
+		nodes[node] = m.Status
 	}
 	return nodes
 }
 
-func (n Nodes) List(x int) []string {
+func (n *Nodes) List(x int) []string {
 	return n.list(x, false)
 }
 
-func (n Nodes) ListAll() []string {
-	return n.list(len(n.nodesStatus), false)
+func (n *Nodes) ListAll() []string {
+	n.mu.RLock()
+	x := len(n.members)
+	n.mu.RUnlock()
+
+	return n.list(x, false)
 }
 
-func (n Nodes) ListActive(x int) []string {
+// ListActive lists the nodes which are neither down nor gone, suspect and leaving nodes included
+func (n *Nodes) ListActive(x int) []string {
 	return n.list(x, true)
 }
 
-func (n Nodes) list(x int, filterByNodeStatusUp bool) []string {
-	i, nodeList := 0, make([]string, 0, len(n.nodesStatus))
-	for node, status := range n.nodesStatus {
+func (n *Nodes) list(x int, filterByNodeStatusDown bool) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	i, nodeList := 0, make([]string, 0, len(n.members))
+	for node, m := range n.members {
 		if i == x {
 			break
 		}
 
-		if filterByNodeStatusUp && status != NodeStatusUp {
+		if filterByNodeStatusDown && (m.Status == NodeStatusDown || m.Status == NodeStatusLeft) {
 			continue
 		}
 
@@ -117,3 +315,45 @@ func (n Nodes) list(x int, filterByNodeStatusUp bool) []string {
 	}
 	return nodeList
 }
+
+func (n *Nodes) refute(m Member) {
+	if m.Status != n.status && m.Incarnation >= n.incarnation {
+		n.incarnation = m.Incarnation + 1
+	}
+}
+
+// apply updates the node if m overrides what is known about it and
+// reports the status change, if any. It must be called with the lock held
+func (n *Nodes) apply(node string, m Member) (statusChange, bool) {
+	current, ok := n.members[node]
+	if !ok {
+		n.members[node] = &member{Member: m, suspectedAt: time.Now().UTC()}
+		return statusChange{node: node, status: m.Status}, true
+	}
+	if !m.overrides(current.Member) {
+		return statusChange{}, false
+	}
+
+	changed := current.Status != m.Status
+	if changed && m.Status == NodeStatusSuspect {
+		current.suspectedAt = time.Now().UTC()
+	}
+	current.Member = m
+	return statusChange{node: node, status: m.Status}, changed
+}
+
+func (n *Nodes) notify(changes []statusChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	n.mu.RLock()
+	subscribers := append([]func(node string, status int){}, n.subscribers...)
+	n.mu.RUnlock()
+
+	for _, change := range changes {
+		for _, fn := range subscribers {
+			fn(change.node, change.status)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNodesConcurrentAccess(t *testing.T) {
+	nodes := NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp, "localhost:9002": NodeStatusUp})
+	var changes int
+	var changesMu sync.Mutex
+	nodes.Subscribe(func(node string, status int) {
+		changesMu.Lock()
+		changes++
+		changesMu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				node := fmt.Sprintf("localhost:%d", 9001+(i+j)%4)
+				switch j % 7 {
+				case 0:
+					nodes.Merge(map[string]Member{node: {Status: NodeStatusSuspect, Incarnation: uint64(j)}})
+				case 1:
+					nodes.Alive(node, uint64(j))
+				case 2:
+					nodes.Suspect(node)
+				case 3:
+					nodes.Expire(0)
+				case 4:
+					_, _ = nodes.NextProbe()
+				case 5:
+					_ = nodes.Members()
+					_ = nodes.Map()
+				case 6:
+					_ = nodes.ListActive(2)
+					_ = nodes.ListAll()
+					nodes.Merge(map[string]Member{nodes.Current(): {Status: NodeStatusDown, Incarnation: uint64(j)}})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if changes == 0 {
+		t.Fatal("expected the subscriber to be notified about status changes")
+	}
+	if current := nodes.Members()[nodes.Current()]; current.Status != NodeStatusUp {
+		t.Fatalf("expected the current node to be up, got: %s", NodeStatusText(current.Status))
+	}
+}
+
+func TestNodesRefuteSuspicion(t *testing.T) {
+	nodes := NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp})
+
+	incarnation := nodes.Refute(Member{Status: NodeStatusSuspect, Incarnation: 0})
+	if incarnation != 1 {
+		t.Fatalf("expected incarnation 1 after refuting, got: %d", incarnation)
+	}
+
+	nodes.Suspect("localhost:9001")
+	nodes.Expire(time.Hour)
+	if status := nodes.Map()["localhost:9001"]; status != NodeStatusSuspect {
+		t.Fatalf("expected the node to be suspect, got: %s", NodeStatusText(status))
+	}
+
+	nodes.Expire(0)
+	if status := nodes.Map()["localhost:9001"]; status != NodeStatusDown {
+		t.Fatalf("expected the node to be down, got: %s", NodeStatusText(status))
+	}
+
+	// the same incarnation can't bring the node back up, only a refutation can
+	nodes.Merge(map[string]Member{"localhost:9001": {Status: NodeStatusUp, Incarnation: 0}})
+	if status := nodes.Map()["localhost:9001"]; status != NodeStatusDown {
+		t.Fatalf("expected the node to stay down, got: %s", NodeStatusText(status))
+	}
+	nodes.Merge(map[string]Member{"localhost:9001": {Status: NodeStatusUp, Incarnation: 1}})
+	if status := nodes.Map()["localhost:9001"]; status != NodeStatusUp {
+		t.Fatalf("expected the node to be up, got: %s", NodeStatusText(status))
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+// Ballot numbers the rounds of the consensus run by compare-and-set writes.
+// The time makes the rounds of a node increasing, ties between
+// nodes starting a round at the same time are broken by the node name
+type Ballot struct {
+	Time int64  `json:"time"`
+	Node string `json:"node"`
+}
+
+func (b Ballot) Less(other Ballot) bool {
+	if b.Time != other.Time {
+		return b.Time < other.Time
+	}
+	return b.Node < other.Node
+}
+
+// Proposal is an item accepted by a replica during a round, it is not stored until committed
+type Proposal struct {
+	Ballot Ballot    `json:"ballot"`
+	Item   CacheItem `json:"item"`
+}
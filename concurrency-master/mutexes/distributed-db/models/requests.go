@@ -1,41 +1,148 @@
 package models
 
-import (
-	"time"
-)
-
 type GetRequest struct {
-	Keys []string `json:"keys"`
-	// how many reads before returning (replication factor > 1) => TO BE IMPLEMENTED
-	ConsistencyLevel int `json:"-"`
+	// the keyspace of the keys, the default one when empty
+	Keyspace string   `json:"keyspace,omitempty"`
+	Keys     []string `json:"keys"`
+	// how many copies to look the keys up from
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// how many reads before returning (replication factor > 1)
+	ConsistencyLevel ConsistencyLevel `json:"consistency_level,omitempty"`
+	// whether to return deleted items of the stored keys, used between replicas.
+	// Only set by the node-only route, the clients' keys always get resolved
+	Tombstones bool `json:"-"`
+	// whether to return digests instead of values, used between replicas
+	Digests bool `json:"digests,omitempty"`
+}
+
+// CASRequest writes the value only if the current item has the expected
+// version, or if there is no current item when IfAbsent is set
+type CASRequest struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Version  uint64 `json:"version"`
+	IfAbsent bool   `json:"if_absent,omitempty"`
+	// how many copies for this cache item, the replicas agree on the write by majority
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// for short-lived records, the item expires after TTL
+	TTL Duration `json:"ttl,omitempty"`
+	// whether the receiving node owns the key, used between nodes.
+	// Only set by the node-only route, the clients can't skip the consensus
+	Local bool `json:"-"`
+}
+
+// PrepareRequest asks a replica to take part in the round of the ballot
+type PrepareRequest struct {
+	Key    string `json:"key"`
+	Ballot Ballot `json:"ballot"`
+}
+
+// ProposeRequest asks a replica to accept the item of the round,
+// CommitRequest to store it once a majority accepted it
+type ProposeRequest struct {
+	Proposal Proposal `json:"proposal"`
+}
+
+type CommitRequest struct {
+	Proposal Proposal `json:"proposal"`
 }
 
 type DeleteRequest struct {
-	Keys []string `json:"keys"`
-	// how many deletes before returning (replication factor > 1) => TO BE IMPLEMENTED
-	ConsistencyLevel int `json:"-"`
+	Keyspace string   `json:"keyspace,omitempty"`
+	Keys     []string `json:"keys"`
+	// how many copies to delete the keys from
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// how many deletes before returning (replication factor > 1)
+	ConsistencyLevel ConsistencyLevel `json:"consistency_level,omitempty"`
 }
 
 type SetRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	// how many copies for this cache item [TO BE IMPLEMENTED]
-	ReplicationFactor int `json:"-"`
-	// how many writes before returning (replication factor > 1) => TO BE IMPLEMENTED
-	ConsistencyLevel int `json:"-"`
-	// for short-lived records [TO BE IMPLEMENTED]
-	TTL time.Duration `json:"-"`
+	Keyspace string `json:"keyspace,omitempty"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	// how many copies for this cache item
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// how many writes before returning (replication factor > 1)
+	ConsistencyLevel ConsistencyLevel `json:"consistency_level,omitempty"`
+	// for short-lived records, the item expires after TTL
+	TTL Duration `json:"ttl,omitempty"`
 }
 
 type SetBatchRequest struct {
 	Items map[int]CacheItem
-	// how many copies for this cache item [TO BE IMPLEMENTED]
-	ReplicationFactor int `json:"-"`
+	// how many copies for this cache item
+	ReplicationFactor int `json:"replication_factor,omitempty"`
 	// how many writes before returning (replication factor > 1) => TO BE IMPLEMENTED
 	ConsistencyLevel int `json:"-"`
 }
 
+// GossipRequest carries the members known by the sender, the checksum of its ring,
+// the tokens it holds for owners which were unreachable when they got written
+// and the keyspaces it knows
 type GossipRequest struct {
-	Nodes          map[string]int `json:"nodes"`
-	TokensChecksum string         `json:"tokens_checksum"`
+	Members        map[string]Member `json:"members"`
+	TokensChecksum string            `json:"tokens_checksum"`
+	ForeignTokens  []int             `json:"foreign_tokens,omitempty"`
+	Keyspaces      []Keyspace        `json:"keyspaces,omitempty"`
+}
+
+// PingRequest carries what the sender knows about the receiver,
+// so the receiver can refute a suspicion right away
+type PingRequest struct {
+	Member Member `json:"member"`
+}
+
+type IndirectPingRequest struct {
+	Target  string   `json:"target"`
+	Member  Member   `json:"member"`
+	Timeout Duration `json:"timeout"`
+}
+
+type MerkleRequest struct {
+	Range TokenRange `json:"range"`
+	// the root of the requesting node, when equal only the root is sent back
+	Root string `json:"root"`
+}
+
+type ScanRequest struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	// only the keys starting with the prefix are listed
+	Prefix string `json:"prefix,omitempty"`
+	// the cursor of the previous page, the listing continues after it
+	Cursor string `json:"cursor,omitempty"`
+	// the max number of items of the page
+	Limit int `json:"limit,omitempty"`
+	// whether to only list the keys of the receiving node, tombstones included, used between nodes.
+	// Only set by the node-only route, the clients only see the merged listing
+	Local bool `json:"-"`
+}
+
+// WatchRequest selects the key, or the keys starting with the prefix, to watch.
+// The stream resumes after the cursor of the last event received, if any
+type WatchRequest struct {
+	Keyspace string      `json:"keyspace,omitempty"`
+	Key      string      `json:"key,omitempty"`
+	Prefix   string      `json:"prefix,omitempty"`
+	Cursor   WatchCursor `json:"cursor,omitempty"`
+}
+
+// ChangesRequest asks a node for its changes after the position, waiting up to Wait
+// for new ones, used between nodes. A zero epoch starts from the newest change
+type ChangesRequest struct {
+	Key    string   `json:"key,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Epoch  int64    `json:"epoch"`
+	After  uint64   `json:"after"`
+	Wait   Duration `json:"wait"`
+}
+
+type RangeItemsRequest struct {
+	Ranges []TokenRange `json:"ranges"`
+}
+
+// DecommissionRequest bounds how long the node may take to leave the cluster,
+// a zero Timeout uses the default one
+type DecommissionRequest struct {
+	Timeout Duration `json:"timeout,omitempty"`
 }
@@ -1,9 +1,135 @@
 package models
 
 type GossipResponse struct {
-	Nodes map[string]int `json:"nodes"`
+	Members       map[string]Member `json:"members"`
+	ForeignTokens []int             `json:"foreign_tokens,omitempty"`
+	Keyspaces     []Keyspace        `json:"keyspaces,omitempty"`
+}
+
+type PingResponse struct {
+	Incarnation uint64 `json:"incarnation"`
 }
 
 type TokensResponse struct {
 	Tokens TokenMappings `json:"tokens"`
 }
+
+type GetResponse struct {
+	Items []CacheItem
+	// number of stale replicas the newest values were written back to
+	ReadRepairs int
+}
+
+type ScanResponse struct {
+	Items []CacheItem `json:"items"`
+	// where the next page starts, empty once all the keys were listed
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// CASResponse carries the written item, or the current one when the condition did not hold
+type CASResponse struct {
+	Applied bool      `json:"applied"`
+	Exists  bool      `json:"exists"`
+	Item    CacheItem `json:"item"`
+}
+
+// PrepareResponse carries the stored item, tombstones included, and the proposal
+// accepted by an unfinished round, if any. A refused ballot comes with the promised one
+type PrepareResponse struct {
+	Promised bool      `json:"promised"`
+	Ballot   Ballot    `json:"ballot"`
+	Accepted *Proposal `json:"accepted,omitempty"`
+	Found    bool      `json:"found"`
+	Item     CacheItem `json:"item"`
+}
+
+type ProposeResponse struct {
+	Accepted bool   `json:"accepted"`
+	Ballot   Ballot `json:"ballot"`
+}
+
+type CommitResponse struct {
+	Stored bool `json:"stored"`
+}
+
+// ChangesResponse carries the changes of the node and the position reached in its change log.
+// Truncated tells whether changes were missed, dropped from the ring or lost with a restart
+type ChangesResponse struct {
+	Epoch     int64    `json:"epoch"`
+	Seq       uint64   `json:"seq"`
+	Truncated bool     `json:"truncated,omitempty"`
+	Changes   []Change `json:"changes"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type RangeItemsResponse struct {
+	Items map[int]CacheItem `json:"items"`
+}
+
+type RepairResponse struct {
+	Ranges         int    `json:"ranges"`
+	RepairedRanges int    `json:"repaired_ranges"`
+	FailedRanges   int    `json:"failed_ranges"`
+	ItemsSent      int    `json:"items_sent"`
+	ItemsReceived  int    `json:"items_received"`
+	Duration       string `json:"duration"`
+}
+
+// DecommissionResponse shows the progress of the node leaving the cluster,
+// and why it stayed when the decommission failed
+type DecommissionResponse struct {
+	Status    string `json:"status"`
+	Items     int    `json:"items"`
+	Remaining int    `json:"remaining"`
+	Duration  string `json:"duration"`
+	Error     string `json:"error,omitempty"`
+}
+
+// StatsResponse shows how the node uses its memory,
+// and what it stores for the keyspace when one is asked for
+type StatsResponse struct {
+	Node     string         `json:"node"`
+	Memory   MemoryStats    `json:"memory"`
+	Keyspace *KeyspaceStats `json:"keyspace,omitempty"`
+}
+
+// MetricsResponse is everything the node exposes to the monitoring
+type MetricsResponse struct {
+	Node     string
+	Keys     int
+	Memory   MemoryStats
+	Members  map[string]Member
+	Ring     map[string]int
+	Counters MetricsSnapshot
+}
+
+// RingChecksumHeader is the response header carrying the checksum of the ring
+const RingChecksumHeader = "X-Ring-Checksum"
+
+// RingResponse shows the token ring as seen by the node
+type RingResponse struct {
+	Node     string       `json:"node"`
+	Checksum string       `json:"checksum"`
+	Nodes    []RingMember `json:"nodes"`
+	Tokens   []RingToken  `json:"tokens"`
+}
+
+type RingMember struct {
+	Node        string `json:"node"`
+	Status      string `json:"status"`
+	Incarnation uint64 `json:"incarnation"`
+	Tokens      int    `json:"tokens"`
+	// the share of the token space owned by the node, from 0 to 1
+	Ownership float64 `json:"ownership"`
+	// the tokens the node holds for owners which were unreachable
+	ForeignTokens int `json:"foreign_tokens"`
+}
+
+// RingToken is a virtual node, it owns the tokens after the previous one up to Token
+type RingToken struct {
+	Token int    `json:"token"`
+	Node  string `json:"node"`
+}
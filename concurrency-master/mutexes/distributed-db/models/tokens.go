@@ -2,135 +2,254 @@ package models
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"log"
 	"math"
-	"math/rand"
-	"reflect"
 	"sort"
-	"time"
+	"sync"
 )
 
+// NewTokens creates the token ring of the nodes. Every node owns
+// numberOfTokenRanges virtual nodes, whose tokens only depend on the node name,
+// so all the nodes which know about the same nodes build the same ring.
+// The ring is rebuilt every time a node joins or leaves
 func NewTokens(nodes *Nodes, numberOfTokenRanges int) *Tokens {
-	nodeList := append([]string{nodes.Current()}, nodes.ListAll()...)
-	tokenRange := math.MaxInt / len(nodeList) / numberOfTokenRanges
-	ranges := make([]int, 0, len(nodeList)*numberOfTokenRanges)
-	for i := 0; i < len(nodeList); i++ {
-		for j := numberOfTokenRanges * i; j < numberOfTokenRanges*(i+1); j++ {
-			r := tokenRange * (j + 1)
-			// produces a sorted ranges slice => needed for searching
-			ranges = append(ranges, r)
-		}
-	}
-
-	randomRanges := append([]int{}, ranges...)
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(randomRanges), func(i, j int) {
-		randomRanges[i], randomRanges[j] = randomRanges[j], randomRanges[i]
-	})
-
-	i, mappings := 0, map[int]string{}
-	for _, r := range randomRanges {
-		mappings[r] = nodeList[i]
-		i++
-		if i == len(nodeList) {
-			i = 0
-		}
-	}
-
 	tokens := &Tokens{
-		Mappings:            mappings,
 		Nodes:               nodes,
-		ranges:              ranges,
 		numberOfTokenRanges: numberOfTokenRanges,
+		foreignTokens:       TokenMappings{},
+		// everything stored before the start could belong to other nodes by now
+		moved: []TokenRange{{From: math.MinInt, To: math.MaxInt}},
 	}
+	tokens.rebuild()
+	nodes.Subscribe(func(node string, status int) {
+		tokens.rebuild()
+	})
 	return tokens
 }
 
 type TokenMappings map[int]string
 
+// Tokens is the token ring. The mappings and the ranges are only
+// replaced together, under the lock, so readers always see a consistent ring
 type Tokens struct {
-	Mappings            TokenMappings
-	ForeignTokens       TokenMappings
+	mu                  sync.RWMutex
+	mappings            TokenMappings
+	checksum            string
 	Nodes               *Nodes
 	ranges              []int
 	numberOfTokenRanges int
+	moved               []TokenRange
+	// the tokens whose items were written to another node while their owner was
+	// unreachable, mapped to the node holding them until they are handed back
+	foreignTokens TokenMappings
+}
+
+// Mappings returns a copy of the token mappings
+func (t *Tokens) Mappings() TokenMappings {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	mappings := make(TokenMappings, len(t.mappings))
+	for r, node := range t.mappings {
+		mappings[r] = node
+	}
+	return mappings
 }
 
 func (t *Tokens) GetNode(token int) string {
-	idx := sort.SearchInts(t.ranges, token)
-	node := t.Mappings[t.ranges[idx]]
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.ranges) == 0 {
+		return ""
+	}
+	idx := rangeIndex(t.ranges, token)
+	node := t.mappings[t.ranges[idx]]
 	return node
 }
 
-func (t *Tokens) SetForeignTokens(items map[int]CacheItem, node string) {
-	for token, _ := range items {
-		t.ForeignTokens[token] = node
+// GetNodes returns the node owning the token followed by the next
+// distinct nodes found clockwise on the ring, n nodes at most
+func (t *Tokens) GetNodes(token, n int) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	nodes, seen := make([]string, 0, n), map[string]struct{}{}
+	idx := rangeIndex(t.ranges, token)
+	for i := 0; i < len(t.ranges) && len(nodes) < n; i++ {
+		node := t.mappings[t.ranges[(idx+i)%len(t.ranges)]]
+		if _, ok := seen[node]; ok || node == "" {
+			continue
+		}
+		seen[node] = struct{}{}
+		nodes = append(nodes, node)
 	}
+	return nodes
 }
 
-func (t *Tokens) DeleteForeignToken(token int) {
-	delete(t.ForeignTokens, token)
+// Ranges returns the token ranges of the ring. The first range wraps
+// around the end of the ring, so it is returned as 2 separate ranges
+func (t *Tokens) Ranges() []TokenRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return ringRanges(t.ranges)
 }
 
-func (t *Tokens) Merge(mappings map[int]string) {
-	newMappings := map[int]string{}
-	nodes := t.Nodes.Map()
-	ranges := t.ranges
-	m1, m2 := mappings, t.Mappings
-	if len(mappings) < len(t.Mappings) {
-		m1 = t.Mappings
-		m2 = mappings
+// MarkMoved records token ranges whose items may have to be handed to other nodes
+func (t *Tokens) MarkMoved(ranges ...TokenRange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.moved = mergeRanges(append(t.moved, ranges...))
+}
+
+// TakeMoved returns and forgets the token ranges the current node stopped
+// replicating, for some replication factor, since the last call
+func (t *Tokens) TakeMoved() []TokenRange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	moved := t.moved
+	t.moved = nil
+	return moved
+}
+
+// SetForeignTokens records the node as the holder of the items
+func (t *Tokens) SetForeignTokens(items map[int]CacheItem, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for token := range items {
+		t.foreignTokens[token] = node
 	}
+}
+
+// DeleteForeignTokens forgets the holders of the tokens, once their items were handed back
+func (t *Tokens) DeleteForeignTokens(tokens []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	newNodes := map[string]int{}
-	newRanges := make([]int, 0)
-	for _, s := range mappings {
-		newNodes[s] = NodeStatusUp
+	for _, token := range tokens {
+		delete(t.foreignTokens, token)
 	}
-	for r := range m1 {
-		newRanges = append(newRanges, r)
+}
+
+// ForeignTokens returns the tokens held by the node, sorted
+func (t *Tokens) ForeignTokens(node string) []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tokens := make([]int, 0)
+	for token, holder := range t.foreignTokens {
+		if holder == node {
+			tokens = append(tokens, token)
+		}
 	}
-	sort.Ints(newRanges)
-	ranges = newRanges
-	nodes = newNodes
+	sort.Ints(tokens)
+	return tokens
+}
 
-	if reflect.DeepEqual(nodes, t.Nodes.Map) {
-		return
+// ReplaceForeignTokens replaces the tokens held by the node with the ones it gossiped.
+// Every node only gossips the tokens it holds, so it is the only source of truth about them
+func (t *Tokens) ReplaceForeignTokens(node string, tokens []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for token, holder := range t.foreignTokens {
+		if holder == node {
+			delete(t.foreignTokens, token)
+		}
+	}
+	for _, token := range tokens {
+		t.foreignTokens[token] = node
 	}
+}
+
+// ForeignNode returns the node holding the items of the token for its owner, if any
+func (t *Tokens) ForeignNode(token int) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	node, ok := t.foreignTokens[token]
+	return node, ok
+}
 
-	for s := range nodes {
-		_, ok := t.Nodes.Map()[s]
-		if ok {
-			delete(nodes, s)
+// Merge learns about the nodes found in the mappings of another node.
+// The ring itself only depends on the nodes, so it doesn't have to be merged
+func (t *Tokens) Merge(mappings map[int]string) {
+	members := map[string]Member{}
+	for _, node := range mappings {
+		if _, ok := t.Nodes.Member(node); !ok {
+			members[node] = Member{Status: NodeStatusUp}
 		}
 	}
+	if len(members) > 0 {
+		t.Nodes.Merge(members)
+	}
+}
+
+// Checksum identifies the ring, it is computed when the ring is rebuilt
+// since it is sent with every gossip and every response
+func (t *Tokens) Checksum() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-	i := 0
-	numberOfNodes := len(nodes) + len(t.Nodes.Map())
-	tokenRange := math.MaxInt / numberOfNodes / t.numberOfTokenRanges
-	m1Nodes := map[string]struct{}{}
-	for r, s := range m1 {
-		m1Nodes[s] = struct{}{}
-		factor := sort.SearchInts(ranges, r) + 1
-		newMappings[factor*tokenRange] = s
-		i++
+	return t.checksum
+}
+
+// rebuild places the virtual nodes of every node on the ring. A joining node
+// only takes over the ranges right before its virtual nodes and the ranges of
+// a leaving node go to the next nodes clockwise, every other range keeps its
+// owner. The ranges the current node stopped replicating are recorded, so they
+// can be streamed to their new owners.
+// The nodes are read under the lock, the status changes rebuild the ring
+// concurrently and the last rebuild must not install an older membership
+func (t *Tokens) rebuild() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := NodesMap{}
+	for node, status := range t.Nodes.Map() {
+		if inRing(status) {
+			nodes[node] = status
+		}
 	}
-	for _, s := range m2 {
-		_, ok := m1Nodes[s]
-		if ok {
-			continue
+	if t.mappings != nil && sameNodes(t.nodeSet(), nodes) {
+		return
+	}
+
+	mappings := TokenMappings{}
+	for node := range nodes {
+		for i := 0; i < t.numberOfTokenRanges; i++ {
+			token := virtualNodeToken(node, i)
+			// collisions are unlikely, but every node has to resolve them the same way
+			if owner, ok := mappings[token]; ok && owner < node {
+				continue
+			}
+			mappings[token] = node
 		}
-		i++
-		newMappings[(i)*tokenRange] = s
 	}
-	t.Mappings = newMappings
+	ranges := make([]int, 0, len(mappings))
+	for r := range mappings {
+		ranges = append(ranges, r)
+	}
+	sort.Ints(ranges)
+
+	if t.mappings != nil {
+		moved := movedRanges(t.Nodes.Current(), t.mappings, t.ranges, mappings, ranges)
+		t.moved = mergeRanges(append(t.moved, moved...))
+	}
+	t.mappings, t.ranges = mappings, ranges
+	t.checksum = checksum(mappings)
 }
 
-func (t *Tokens) Checksum() string {
-	bs, err := json.Marshal(t.Mappings)
+func checksum(mappings TokenMappings) string {
+	bs, err := json.Marshal(mappings)
 	if err != nil {
 		log.Printf("could not marshal token mappings: %v", err)
 		return ""
@@ -139,6 +258,122 @@ func (t *Tokens) Checksum() string {
 	return fmt.Sprintf("%x", sum)
 }
 
+// nodeSet returns the nodes of the ring. It must be called with the lock held
+func (t *Tokens) nodeSet() map[string]struct{} {
+	nodes := map[string]struct{}{}
+	for _, node := range t.mappings {
+		nodes[node] = struct{}{}
+	}
+	return nodes
+}
+
+func sameNodes(ring map[string]struct{}, nodes NodesMap) bool {
+	if len(ring) != len(nodes) {
+		return false
+	}
+	for node := range nodes {
+		if _, ok := ring[node]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// virtualNodeToken uses md5 instead of HashKey, since fnv leaves the similar
+// names of the virtual nodes clustered on the ring
+func virtualNodeToken(node string, i int) int {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s#%d", node, i)))
+	return int(binary.BigEndian.Uint64(sum[:8]))
+}
+
+// rangeIndex returns the index of the range the token falls into.
+// Tokens bigger than the last range wrap around to the first one
+func rangeIndex(ranges []int, token int) int {
+	idx := sort.SearchInts(ranges, token)
+	if idx == len(ranges) {
+		idx = 0
+	}
+	return idx
+}
+
+func ringRanges(ranges []int) []TokenRange {
+	if len(ranges) == 0 {
+		return []TokenRange{}
+	}
+
+	tokenRanges := make([]TokenRange, 0, len(ranges)+1)
+	tokenRanges = append(tokenRanges, TokenRange{From: math.MinInt, To: ranges[0]})
+	for i := 1; i < len(ranges); i++ {
+		tokenRanges = append(tokenRanges, TokenRange{From: ranges[i-1] + 1, To: ranges[i]})
+	}
+	if last := ranges[len(ranges)-1]; last < math.MaxInt {
+		tokenRanges = append(tokenRanges, TokenRange{From: last + 1, To: math.MaxInt})
+	}
+	return tokenRanges
+}
+
+// replicaPosition returns the position of the node among the distinct nodes
+// found clockwise from the token. The node replicates the token for every
+// replication factor bigger than its position
+func replicaPosition(node string, mappings TokenMappings, ranges []int, token int) int {
+	if len(ranges) == 0 {
+		return math.MaxInt
+	}
+
+	seen, idx := map[string]struct{}{}, rangeIndex(ranges, token)
+	for i := 0; i < len(ranges); i++ {
+		owner := mappings[ranges[(idx+i)%len(ranges)]]
+		if owner == node {
+			return len(seen)
+		}
+		seen[owner] = struct{}{}
+	}
+	return math.MaxInt
+}
+
+// movedRanges returns the ranges where the node moved further away from the
+// owner between the old and the new ring, so it replicates them for fewer
+// replication factors than before
+func movedRanges(node string, oldMappings TokenMappings, oldRanges []int, newMappings TokenMappings, newRanges []int) []TokenRange {
+	boundaries := append(append(make([]int, 0, len(oldRanges)+len(newRanges)), oldRanges...), newRanges...)
+	sort.Ints(boundaries)
+
+	moved := make([]TokenRange, 0)
+	for _, r := range ringRanges(boundaries) {
+		if r.From > r.To {
+			// duplicated boundary
+			continue
+		}
+		oldPosition := replicaPosition(node, oldMappings, oldRanges, r.To)
+		newPosition := replicaPosition(node, newMappings, newRanges, r.To)
+		if newPosition > oldPosition {
+			moved = append(moved, r)
+		}
+	}
+	return mergeRanges(moved)
+}
+
+// mergeRanges sorts the ranges and joins the overlapping or adjacent ones
+func mergeRanges(ranges []TokenRange) []TokenRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+	merged := []TokenRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if last.To == math.MaxInt || r.From <= last.To+1 {
+			if r.To > last.To {
+				last.To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
 func HashKey(s string) uint64 {
 	h := fnv.New64a()
 	_, _ = h.Write([]byte(s))
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTokensConcurrentMerge(t *testing.T) {
+	nodes := NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp})
+	tokens := NewTokens(nodes, 16)
+	other := NewTokens(NewNodes("localhost:9002", NodesMap{"localhost:9000": NodeStatusUp}), 16)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tokens.Merge(other.Mappings())
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				token := int(HashKey(fmt.Sprintf("key-%d-%d", i, j)))
+				if node := tokens.GetNode(token); node == "" {
+					t.Errorf("token: %d is not mapped to any node", token)
+					return
+				}
+				_ = tokens.GetNodes(token, 2)
+				_ = tokens.Ranges()
+				_ = tokens.Checksum()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTokensDeterministic(t *testing.T) {
+	a := NewTokens(NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp, "localhost:9002": NodeStatusUp}), 64)
+	b := NewTokens(NewNodes("localhost:9002", NodesMap{"localhost:9000": NodeStatusUp}), 64)
+	if a.Checksum() == b.Checksum() {
+		t.Fatal("expected different rings for different nodes")
+	}
+
+	b.Merge(a.Mappings())
+	if a.Checksum() != b.Checksum() {
+		t.Fatal("expected the same ring once both nodes know about the same nodes")
+	}
+}
+
+func TestTokensJoinMovesMinimalRanges(t *testing.T) {
+	nodes := NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp, "localhost:9002": NodeStatusUp})
+	tokens := NewTokens(nodes, 64)
+	_ = tokens.TakeMoved()
+	owners := map[int]string{}
+	for _, r := range tokens.Ranges() {
+		owners[r.From], owners[r.To] = tokens.GetNode(r.From), tokens.GetNode(r.To)
+	}
+
+	const joining = "localhost:9003"
+	nodes.Merge(map[string]Member{joining: {Status: NodeStatusUp}})
+
+	// ranges either keep their owner or get taken over by the joining node
+	for token, owner := range owners {
+		if newOwner := tokens.GetNode(token); newOwner != owner && newOwner != joining {
+			t.Fatalf("token: %d moved from: %s to: %s", token, owner, newOwner)
+		}
+	}
+
+	// the current node only hands over the ranges where the joining node got in front of it
+	moved := tokens.TakeMoved()
+	if len(moved) == 0 {
+		t.Fatal("expected the current node to hand over some ranges")
+	}
+	for _, r := range moved {
+		for _, token := range []int{r.From, r.To} {
+			replicas := tokens.GetNodes(token, 4)
+			for _, node := range replicas {
+				if node == joining {
+					break
+				}
+				if node == nodes.Current() {
+					t.Fatalf("token: %d moved, but the joining node is not in front of the current node: %v", token, replicas)
+				}
+			}
+		}
+	}
+}
+
+// TestTokensForeignTokens records the holder of stolen tokens on a new ring,
+// the map of the holders must be ready to be written to
+func TestTokensForeignTokens(t *testing.T) {
+	tokens := NewTokens(NewNodes("localhost:9000", NodesMap{"localhost:9001": NodeStatusUp}), 16)
+
+	tokens.SetForeignTokens(map[int]CacheItem{1: {Key: "a"}, 2: {Key: "b"}}, "localhost:9001")
+	if node, ok := tokens.ForeignNode(1); !ok || node != "localhost:9001" {
+		t.Fatalf("expected the holder of token: 1, got: %s, %v", node, ok)
+	}
+
+	tokens.ReplaceForeignTokens("localhost:9001", []int{2, 3})
+	if held := tokens.ForeignTokens("localhost:9001"); fmt.Sprint(held) != "[2 3]" {
+		t.Fatalf("expected the gossiped tokens to replace the held ones, got: %v", held)
+	}
+
+	tokens.DeleteForeignTokens([]int{2, 3})
+	if held := tokens.ForeignTokens("localhost:9001"); len(held) != 0 {
+		t.Fatalf("expected the tokens to be handed back, got: %v", held)
+	}
+}
+
+// TestTokensConcurrentStatusChanges makes several nodes leave at the same time,
+// so their rebuilds race. The ring must end up built from the last statuses
+func TestTokensConcurrentStatusChanges(t *testing.T) {
+	others := NodesMap{}
+	for i := 1; i <= 8; i++ {
+		others[fmt.Sprintf("localhost:900%d", i)] = NodeStatusUp
+	}
+	want := NewTokens(NewNodes("localhost:9000", NodesMap{}), 16).Checksum()
+
+	for round := 0; round < 100; round++ {
+		nodes := NewNodes("localhost:9000", others)
+		tokens := NewTokens(nodes, 16)
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for node := range others {
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+				<-start
+				nodes.Merge(map[string]Member{node: {Status: NodeStatusLeaving, Incarnation: 1}})
+			}(node)
+		}
+		close(start)
+		wg.Wait()
+
+		if tokens.Checksum() != want {
+			t.Fatalf("round: %d, the ring was not rebuilt from the last statuses: %v", round, nodes.Map())
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Codec encodes the payloads of one connection with gob. Gob only sends
+// the definition of a type the first time it is used on a stream, so every
+// connection keeps one encoder and one decoder for its whole life.
+// That's also why payloads must be encoded in the order their frames are
+// written and decoded in the order their frames are read, none skipped
+type Codec struct {
+	encoded bytes.Buffer
+	enc     *gob.Encoder
+	payload *payloadReader
+	dec     *gob.Decoder
+}
+
+// payloadReader lets the decoder read the payloads of consecutive frames.
+// It is a byte reader, so the decoder does not read ahead of the payload
+type payloadReader struct {
+	bytes.Reader
+}
+
+func NewCodec() *Codec {
+	c := &Codec{payload: &payloadReader{}}
+	c.enc = gob.NewEncoder(&c.encoded)
+	c.dec = gob.NewDecoder(c.payload)
+	return c
+}
+
+// Encode returns the payload of v. The returned slice is only valid until the next call
+func (c *Codec) Encode(v interface{}) ([]byte, error) {
+	c.encoded.Reset()
+	err := c.enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.encoded.Bytes(), nil
+}
+
+func (c *Codec) Decode(payload []byte, v interface{}) error {
+	c.payload.Reset(payload)
+	return c.dec.Decode(v)
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Op tells the receiver what to do with the payload of a request frame
+type Op uint8
+
+const (
+	// OpHello is the first frame of every connection, its payload is the
+	// address of the node which opened the connection. It is not answered
+	OpHello Op = iota + 1
+	OpGet
+	OpSet
+	OpSetBatch
+	OpGossip
+	OpTokens
+	OpMerkleTree
+	OpRangeItems
+	OpPing
+	OpIndirectPing
+	OpScan
+	OpCAS
+	OpPrepare
+	OpPropose
+	OpCommit
+	OpChanges
+	OpBackup
+)
+
+const (
+	StatusOK uint8 = iota
+	// StatusError responses carry the error text as payload
+	StatusError
+)
+
+const (
+	// length(4) id(8) op(1) status(1)
+	headerSize   = 4 + 8 + 1 + 1
+	MaxFrameSize = 64 << 20
+)
+
+// Frame is the unit of the protocol. Responses carry the id of their request,
+// so many requests can be in flight on the same connection (pipelining)
+// and get answered in any order
+type Frame struct {
+	ID      uint64
+	Op      Op
+	Status  uint8
+	Payload []byte
+}
+
+// WriteFrame writes the frame prefixed by its length. Writes of different
+// frames must not interleave, so callers share a lock per connection
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %d byte(s) is too big", len(f.Payload))
+	}
+
+	bs := make([]byte, headerSize+len(f.Payload))
+	binary.BigEndian.PutUint32(bs[0:4], uint32(headerSize-4+len(f.Payload)))
+	binary.BigEndian.PutUint64(bs[4:12], f.ID)
+	bs[12] = byte(f.Op)
+	bs[13] = f.Status
+	copy(bs[headerSize:], f.Payload)
+
+	_, err := w.Write(bs)
+	return err
+}
+
+func ReadFrame(r io.Reader) (Frame, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[0:4])) - (headerSize - 4)
+	if length < 0 || length > MaxFrameSize {
+		return Frame{}, fmt.Errorf("invalid frame length: %d", length)
+	}
+	f := Frame{
+		ID:      binary.BigEndian.Uint64(header[4:12]),
+		Op:      Op(header[12]),
+		Status:  header[13],
+		Payload: make([]byte, length),
+	}
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return f, nil
+}
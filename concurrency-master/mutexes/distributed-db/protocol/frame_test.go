@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+func TestFramesRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	enc, dec := NewCodec(), NewCodec()
+
+	items := []map[int]models.CacheItem{
+		{1: {Key: "a", Value: "1", UpdatedAt: time.Now().UTC()}},
+		{2: {Key: "b", Value: "2", Deleted: true}, 3: {Key: "c", Value: "3"}},
+	}
+	// the type definitions are only sent with the first frame
+	for i, batch := range items {
+		payload, err := enc.Encode(models.SetBatchRequest{Items: batch})
+		if err != nil {
+			t.Fatalf("could not encode payload: %v", err)
+		}
+		err = WriteFrame(&stream, Frame{ID: uint64(i + 1), Op: OpSetBatch, Payload: payload})
+		if err != nil {
+			t.Fatalf("could not write frame: %v", err)
+		}
+	}
+
+	for i, batch := range items {
+		f, err := ReadFrame(&stream)
+		if err != nil {
+			t.Fatalf("could not read frame: %v", err)
+		}
+		if f.ID != uint64(i+1) || f.Op != OpSetBatch {
+			t.Fatalf("unexpected frame: %d, op: %d", f.ID, f.Op)
+		}
+
+		var req models.SetBatchRequest
+		err = dec.Decode(f.Payload, &req)
+		if err != nil {
+			t.Fatalf("could not decode payload: %v", err)
+		}
+		for token, item := range batch {
+			got := req.Items[token]
+			if got.Key != item.Key || got.Value != item.Value || got.Deleted != item.Deleted || !got.UpdatedAt.Equal(item.UpdatedAt) {
+				t.Fatalf("expected item: %+v, got: %+v", item, got)
+			}
+		}
+	}
+}
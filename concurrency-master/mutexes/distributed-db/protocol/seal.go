@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"distributed-db/auth"
+	"distributed-db/models"
+)
+
+const macSize = 32
+
+// Direction tells whether a frame is a request or a response
+type Direction byte
+
+const (
+	ToServer Direction = iota + 1
+	ToClient
+)
+
+// Seal prefixes the payload with the MAC of the frame, which covers the nonce
+// of the connection, so frames can't be moved to another connection, and the
+// direction of the frame, so responses can't be sent back as requests
+func Seal(signer *auth.Signer, nonce []byte, dir Direction, f Frame) Frame {
+	if !signer.Enabled() {
+		return f
+	}
+
+	mac := signer.Sign(nonce, []byte{byte(dir)}, frameHeader(f), f.Payload)
+	f.Payload = append(mac, f.Payload...)
+	return f
+}
+
+// Open checks the MAC of the frame and strips it from the payload
+func Open(signer *auth.Signer, nonce []byte, dir Direction, f Frame) (Frame, error) {
+	if !signer.Enabled() {
+		return f, nil
+	}
+
+	if len(f.Payload) < macSize {
+		return Frame{}, fmt.Errorf("%w: unsigned frame", models.ErrUnauthorized)
+	}
+	mac, payload := f.Payload[:macSize], f.Payload[macSize:]
+	f.Payload = payload
+	if !signer.Verify(mac, nonce, []byte{byte(dir)}, frameHeader(f), payload) {
+		return Frame{}, fmt.Errorf("%w: invalid frame signature", models.ErrUnauthorized)
+	}
+	return f, nil
+}
+
+func frameHeader(f Frame) []byte {
+	header := make([]byte, 10)
+	binary.BigEndian.PutUint64(header[0:8], f.ID)
+	header[8] = byte(f.Op)
+	header[9] = f.Status
+	return header
+}
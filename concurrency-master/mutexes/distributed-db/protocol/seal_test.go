@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	"distributed-db/auth"
+	"distributed-db/models"
+)
+
+func TestSealDirection(t *testing.T) {
+	signer := auth.NewSigner("secret")
+	nonce := []byte("0123456789abcdef")
+
+	f := Seal(signer, nonce, ToClient, Frame{ID: 1, Op: OpGet, Payload: []byte("payload")})
+	if _, err := Open(signer, nonce, ToServer, f); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("response sent back as a request accepted: %v", err)
+	}
+	if _, err := Open(signer, []byte("fedcba9876543210"), ToClient, f); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("frame of another connection accepted: %v", err)
+	}
+	opened, err := Open(signer, nonce, ToClient, f)
+	if err != nil || string(opened.Payload) != "payload" {
+		t.Fatalf("sealed frame rejected: %+v, %v", opened, err)
+	}
+}
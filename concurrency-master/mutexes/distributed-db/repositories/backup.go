@@ -0,0 +1,219 @@
+package repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"distributed-db/models"
+)
+
+const (
+	// lists the parts of a backup, written once every part is complete
+	backupSetFile = "backup.json"
+	// describes the part of a node, written once its tables are complete
+	backupPartFile = "part.json"
+	// number of items handed over at a time when reading a part
+	restoreBatchSize = 1000
+)
+
+// Backup copies a consistent snapshot of the database into dir, as if it was
+// a data directory. The MemTable is flushed and the SSTables of that moment are
+// linked into dir, or copied when dir is on another file system. Only the flush
+// holds back the writers: the tables never change once written, and compactions
+// wait for the copy to end before removing the tables they merged.
+// It returns the number of tables and bytes of the backup
+func (c *Cache) Backup(dir string) (int, int64, error) {
+	c.tablesMu.RLock()
+	defer c.tablesMu.RUnlock()
+
+	c.mu.Lock()
+	err := c.flush()
+	tables := append([]*sstable{}, c.sstables...)
+	c.mu.Unlock()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not flush the memtable: %w", err)
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, t := range tables {
+		for _, ext := range []string{"data", "index", "summary"} {
+			n, err := linkFile(tablePath(c.dataDir, t.generation, ext), tablePath(dir, t.generation, ext))
+			if err != nil {
+				return 0, 0, fmt.Errorf("could not back up sstable: %d: %w", t.generation, err)
+			}
+			size += n
+		}
+	}
+	return len(tables), size, writeManifest(dir, manifest{Generations: generationsOf(tables)})
+}
+
+// linkFile hard links the file to the destination, falling back to a copy
+// when linking is not possible. It returns the size of the file
+func linkFile(src, dst string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if os.Link(src, dst) == nil {
+		return info.Size(), nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return 0, err
+	}
+	err = out.Sync()
+	if err != nil {
+		_ = out.Close()
+		return 0, err
+	}
+	err = out.Close()
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(dst+".tmp", dst)
+}
+
+// NewBackups opens the directory holding the backups. Every backup is a directory
+// named after its id, with a directory per node holding the part of the node
+// and its manifest, and the file listing the parts of the backup
+func NewBackups(dir string) (*Backups, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("could not create backup directory: %w", err)
+	}
+	return &Backups{dir: dir}, nil
+}
+
+type Backups struct {
+	dir string
+}
+
+// WritePart has write fill the directory of the part of the node, then writes
+// the manifest of the part. The leftovers of an earlier attempt are removed first
+func (b *Backups) WritePart(m models.BackupManifest, write func(dir string) (int, int64, error)) (models.BackupManifest, error) {
+	start, dir := time.Now(), b.partDir(m.ID, m.Node)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+
+	m.Tables, m.Bytes, err = write(dir)
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+	m.Duration = time.Since(start).String()
+	return m, writeJSON(filepath.Join(dir, backupPartFile), m)
+}
+
+// WriteSet writes the list of the parts of the backup, which completes it
+func (b *Backups) WriteSet(set models.BackupSet) error {
+	return writeJSON(filepath.Join(b.dir, set.ID, backupSetFile), set)
+}
+
+// Sets returns the complete backups, oldest first
+func (b *Backups) Sets() ([]models.BackupSet, error) {
+	files, err := filepath.Glob(filepath.Join(b.dir, "*", backupSetFile))
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([]models.BackupSet, 0, len(files))
+	for _, file := range files {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var set models.BackupSet
+		err = json.Unmarshal(bs, &set)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode backup: %s, %w", file, err)
+		}
+		sets = append(sets, set)
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Time.Before(sets[j].Time)
+	})
+	return sets, nil
+}
+
+// ReadPart calls fn with the newest version of the items of the part
+// of the node in the backup, tombstones included, a batch at a time.
+// It stops at the first error of fn and returns the number of items read
+func (b *Backups) ReadPart(id, node string, fn func(items map[int]models.CacheItem) error) (int, error) {
+	dir := b.partDir(id, node)
+	m, err := readManifest(dir)
+	if err != nil {
+		return 0, fmt.Errorf("could not read the manifest: %w", err)
+	}
+
+	// the part is read like a data directory without a MemTable
+	part := &Cache{memtable: map[int]record{}, dataDir: dir}
+	defer func() {
+		for _, t := range part.sstables {
+			_ = t.close()
+		}
+	}()
+	for _, generation := range m.Generations {
+		t, err := openSSTable(dir, generation)
+		if err != nil {
+			return 0, fmt.Errorf("could not open sstable: %d: %w", generation, err)
+		}
+		part.sstables = append(part.sstables, t)
+	}
+
+	count, batch, fnErr := 0, map[int]models.CacheItem{}, error(nil)
+	err = part.forEach(func(token int, item models.CacheItem) {
+		if fnErr != nil {
+			return
+		}
+		batch[token] = item
+		count++
+		if len(batch) == restoreBatchSize {
+			fnErr = fn(batch)
+			batch = map[int]models.CacheItem{}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if fnErr != nil {
+		return 0, fnErr
+	}
+	if len(batch) > 0 {
+		err = fn(batch)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// ReadKeyspaces returns the keyspaces of the part of the node in the backup,
+// none for the parts written before the keyspaces were backed up
+func (b *Backups) ReadKeyspaces(id, node string) ([]models.Keyspace, error) {
+	return readKeyspaces(b.partDir(id, node))
+}
+
+func (b *Backups) partDir(id, node string) string {
+	return filepath.Join(b.dir, id, node)
+}
@@ -0,0 +1,89 @@
+package repositories
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestBackup backs up the database, then keeps writing and compacts it, which
+// removes the tables of the backup from the data directory. Reading the part
+// back must return the items as they were when the backup was taken
+func TestBackup(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cache, err := NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer cache.Close()
+	backups, err := NewBackups(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not open the backups: %v", err)
+	}
+
+	now := time.Now().UTC()
+	write := func(from, to int, value string) {
+		for i := from; i < to; i += memtableFlushSize / 2 {
+			items := map[int]models.CacheItem{}
+			for j := i; j < i+memtableFlushSize/2 && j < to; j++ {
+				items[j] = models.CacheItem{Key: fmt.Sprintf("key:%d", j), Value: value, UpdatedAt: now}
+			}
+			if _, err := cache.Set(items); err != nil {
+				t.Fatalf("could not set the items: %v", err)
+			}
+		}
+	}
+	// some items are left in the MemTable, the backup must flush them
+	write(0, 3500, "old")
+	_, err = cache.Set(map[int]models.CacheItem{0: {Key: "key:0", UpdatedAt: now.Add(time.Second), Deleted: true}})
+	if err != nil {
+		t.Fatalf("could not delete key:0: %v", err)
+	}
+	err = cache.Delete([]int{1})
+	if err != nil {
+		t.Fatalf("could not remove key:1: %v", err)
+	}
+
+	m, err := backups.WritePart(models.BackupManifest{ID: "backup", Node: "node", Time: now}, cache.Backup)
+	if err != nil {
+		t.Fatalf("could not back up the database: %v", err)
+	}
+	if m.Tables != 4 || m.Bytes == 0 {
+		t.Fatalf("unexpected part: %+v", m)
+	}
+
+	write(0, 5000, "new")
+	stats, err := cache.Compact(now.Add(time.Hour), 0)
+	if err != nil || stats.Tables == 0 {
+		t.Fatalf("could not compact the database: %+v, %v", stats, err)
+	}
+
+	items := map[int]models.CacheItem{}
+	count, err := backups.ReadPart("backup", "node", func(batch map[int]models.CacheItem) error {
+		for token, item := range batch {
+			items[token] = item
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read the part: %v", err)
+	}
+	if count != len(items) || len(items) != 3499 {
+		t.Fatalf("expected 3499 items, read: %d, got: %d", count, len(items))
+	}
+	if !items[0].Deleted {
+		t.Fatalf("expected the tombstone of key:0, got: %+v", items[0])
+	}
+	for token, item := range items {
+		if token != 0 && item.Value != "old" {
+			t.Fatalf("unexpected item: %d, %+v", token, item)
+		}
+	}
+}
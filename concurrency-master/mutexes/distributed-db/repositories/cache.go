@@ -1,118 +1,634 @@
 package repositories
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"distributed-db/models"
-	"encoding/json"
 )
 
-func NewCache(dataDir string) *Cache {
+// number of records kept in the MemTable before flushing it to an SSTable
+const memtableFlushSize = 1000
+
+// NewCache opens the storage engine found in the data directory:
+// COMMIT LOG: append only file with the writes which are only in the MemTable
+// MEMTABLE:   the most recent writes kept in memory
+// SSTABLES:   sorted tables on disk, created every time the MemTable is flushed
+// The items in memory are kept under memoryLimit bytes (0 means unlimited)
+// by evicting the least recently used ones, according to the eviction policy
+func NewCache(dataDir string, memoryLimit int64, policy string) (*Cache, error) {
+	if policy != models.EvictionSpill && policy != models.EvictionDrop {
+		return nil, fmt.Errorf("unknown eviction policy: %s", policy)
+	}
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("could not create data directory: %w", err)
+	}
+
 	cache := &Cache{
-		data:    map[int]models.CacheItem{},
-		dataDir: dataDir,
+		memtable:    map[int]record{},
+		sstables:    make([]*sstable, 0),
+		dataDir:     dataDir,
+		lru:         newLRU(),
+		keys:        newKeyIndex(),
+		memoryLimit: memoryLimit,
+		policy:      policy,
 	}
-	cache.init()
-	return cache
+	err = cache.init()
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
 }
 
 type Cache struct {
-	mu      sync.RWMutex
-	data    map[int]models.CacheItem
-	dataDir string
+	mu        sync.RWMutex
+	memtable  map[int]record
+	commitLog *commitLog
+	// oldest first
+	sstables   []*sstable
+	generation int
+	dataDir    string
+	// the items of the MemTable and the copies of the items recently read from disk
+	lru *lru
+	// the keys of the stored items in key order, for the scans
+	keys        *keyIndex
+	memoryLimit int64
+	policy      string
+	// held by backups and by the scans reading the SSTables without mu,
+	// so compactions don't remove the tables while they are read
+	tablesMu sync.RWMutex
 }
 
 func (c *Cache) Get(keys []int) []models.CacheItem {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
 
-	items := make([]models.CacheItem, 0)
+	// expired items are skipped and left for the reaper to remove
+	now, items := time.Now().UTC(), make([]models.CacheItem, 0)
 	for _, key := range keys {
-		item, ok := c.data[key]
-		if ok {
-			items = append(items, item)
+		r, ok, err := c.lookup(key)
+		if err != nil {
+			log.Printf("could not read key: %d from disk: %v", key, err)
+			continue
+		}
+		if ok && !r.Removed {
+			c.lru.touch(key, r.Item, c.memoryLimit > 0)
+			if !r.Item.Expired(now) {
+				items = append(items, r.Item)
+			}
 		}
 	}
+	c.mu.RUnlock()
 
+	// the copies of the items read from disk may take the memory over the limit
+	if c.memoryLimit > 0 && c.lru.over(c.memoryLimit) {
+		c.mu.Lock()
+		c.evict()
+		c.mu.Unlock()
+	}
 	return items
 }
 
-func (c *Cache) GetAllKeys() []int {
-	keys := make([]int, 0, len(c.data))
-	for key := range c.data {
-		keys = append(keys, key)
+// KeyCount returns the number of stored items, tombstones included, without reading them
+func (c *Cache) KeyCount() int {
+	return c.keys.count()
+}
+
+// ScanKeys returns, in key order, up to limit items whose keys start with the prefix,
+// sort after the given key and match. Tombstones are included, so the nodes holding
+// an older version of the item can be outvoted
+func (c *Cache) ScanKeys(prefix, after string, limit int, match func(key string) bool) []models.CacheItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// the keys are sought in the key index, only the items of the page are read
+	now, items := time.Now().UTC(), make([]models.CacheItem, 0)
+	if limit <= 0 {
+		return items
 	}
-	return keys
+	c.keys.seek(prefix, after, func(key string, token int) bool {
+		if !match(key) {
+			return true
+		}
+		r, ok, err := c.lookup(token)
+		if err != nil {
+			log.Printf("could not read key: %d from disk: %v", token, err)
+			return true
+		}
+		if ok && !r.Removed && !r.Item.Expired(now) {
+			items = append(items, r.Item)
+		}
+		return len(items) < limit
+	})
+	return items
+}
+
+// CountKeys returns the number and the size of the live items of the keyspace,
+// counted by the key index as they get written
+func (c *Cache) CountKeys(keyspace string) (int, int64) {
+	return c.keys.stats(keyspace, time.Now().UTC())
 }
 
-// make this a batch function that accepts multiple items
-// make it accept key and item instead
-func (c *Cache) Set(items map[int]models.CacheItem) {
+// Scan returns the newest version of the items whose tokens
+// are between from and to, tombstones included
+func (c *Cache) Scan(from, to int) map[int]models.CacheItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tokens := map[int]struct{}{}
+	for _, t := range c.sstables {
+		entries, err := t.rangeEntries(from, to)
+		if err != nil {
+			log.Printf("could not read the index of sstable: %d: %v", t.generation, err)
+			continue
+		}
+		for _, entry := range entries {
+			tokens[entry.token] = struct{}{}
+		}
+	}
+	for token := range c.memtable {
+		if token >= from && token <= to {
+			tokens[token] = struct{}{}
+		}
+	}
+
+	now, items := time.Now().UTC(), map[int]models.CacheItem{}
+	for token := range tokens {
+		r, ok, err := c.lookup(token)
+		if err != nil {
+			log.Printf("could not read key: %d from disk: %v", token, err)
+			continue
+		}
+		if ok && !r.Removed && !r.Item.Expired(now) {
+			items[token] = r.Item
+		}
+	}
+	return items
+}
+
+// Set stores the items, unless a newer version of the item is already stored.
+// Last write wins, which also lets tombstones shadow older values.
+// It returns the items which were stored, none when the write failed
+func (c *Cache) Set(items map[int]models.CacheItem) (map[int]models.CacheItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records, stored := make([]record, 0, len(items)), map[int]models.CacheItem{}
 	for key, item := range items {
-		c.mu.Lock()
-		c.data[key] = item
-		c.mu.Unlock()
+		old, ok, err := c.lookup(key)
+		if err != nil {
+			log.Printf("could not read key: %d from disk: %v", key, err)
+		}
+		if ok && !old.Removed && old.Item.UpdatedAt.After(item.UpdatedAt) {
+			continue
+		}
+		records = append(records, record{Token: key, Item: item})
+		stored[key] = item
 	}
+
+	err := c.write(records)
+	if err != nil {
+		return nil, err
+	}
+	c.evict()
+	return stored, nil
+}
+
+// Stats returns the memory taken by the items and the eviction counters
+func (c *Cache) Stats() models.MemoryStats {
+	stats := c.lru.stats()
+	stats.Policy, stats.Limit = c.policy, c.memoryLimit
+	return stats
 }
 
-func (c *Cache) Delete(keys []int) {
+func (c *Cache) Delete(keys []int) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, key := range keys {
-		delete(c.data, key)
+	return c.remove(keys)
+}
+
+// PurgeTombstones removes the tombstones updated before the given time
+// and returns the number of removed tombstones
+func (c *Cache) PurgeTombstones(before time.Time) int {
+	return c.purge(func(item models.CacheItem) bool {
+		return item.Deleted && item.UpdatedAt.Before(before)
+	}, func(token int, item models.CacheItem) record {
+		return record{Token: token, Removed: true}
+	})
+}
+
+// PurgeExpired replaces the items which expired by the given time with tombstones,
+// purged in turn after the grace period, and returns the number of replaced items
+func (c *Cache) PurgeExpired(now time.Time) int {
+	return c.purge(func(item models.CacheItem) bool {
+		return item.Expired(now)
+	}, func(token int, item models.CacheItem) record {
+		return record{Token: token, Item: item.ExpiredTombstone()}
+	})
+}
+
+// Close flushes the MemTable to disk and closes all the files
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.flush()
+	if err != nil {
+		return fmt.Errorf("could not flush the memtable: %w", err)
+	}
+	err = c.commitLog.close()
+	if err != nil {
+		return err
+	}
+	for _, t := range c.sstables {
+		err = t.close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// Snapshot stores the in-memory database to db.json file
-// CRITICAL: This is very INEFFICIENT and only for development purposes.
-// A better approach would be only keeping a small portion of data in-memory,
-// the rest to be kept in small chunks per file
-// and a background compaction process that merges and optimizes data
-func (c *Cache) Snapshot() error {
+// purge replaces the items which match with the record returned by replace.
+// They are looked for in a view of the tables, the lock is only taken to write
+// the records. The items written in the meantime are checked again,
+// so their newer version is kept
+func (c *Cache) purge(match func(item models.CacheItem) bool, replace func(token int, item models.CacheItem) record) int {
+	c.tablesMu.RLock()
+	candidates := make([]int, 0)
+	err := c.view().forEach(func(token int, item models.CacheItem) {
+		if match(item) {
+			candidates = append(candidates, token)
+		}
+	})
+	c.tablesMu.RUnlock()
+	if err != nil {
+		log.Printf("could not read the items from disk: %v", err)
+		return 0
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	err := os.MkdirAll(c.dataDir, os.ModePerm)
-	if err != nil && os.IsNotExist(err) {
-		log.Printf("could not create directory: %v", err)
+	records := make([]record, 0, len(candidates))
+	for _, token := range candidates {
+		r, ok, err := c.lookup(token)
+		if err != nil {
+			log.Printf("could not read key: %d from disk: %v", token, err)
+			continue
+		}
+		if ok && !r.Removed && match(r.Item) {
+			records = append(records, replace(token, r.Item))
+		}
+	}
+	err = c.write(records)
+	if err != nil {
+		log.Printf("could not purge the items: %v", err)
+		return 0
+	}
+	return len(records)
+}
+
+// lookup finds the newest record of the token, looking into the MemTable first,
+// then into the copies kept in memory and into the SSTables from newest to oldest
+func (c *Cache) lookup(token int) (record, bool, error) {
+	r, ok := c.memtable[token]
+	if ok {
+		return r, true, nil
+	}
+	item, ok := c.lru.get(token)
+	if ok {
+		return record{Token: token, Item: item}, true, nil
+	}
+
+	for i := len(c.sstables) - 1; i >= 0; i-- {
+		entry, ok, err := c.sstables[i].find(token)
+		if err != nil {
+			return record{}, false, err
+		}
+		if !ok {
+			continue
+		}
+		if entry.removed {
+			return record{Token: token, Removed: true}, true, nil
+		}
+
+		r, err = c.sstables[i].read(entry.offset)
+		if err != nil {
+			return record{}, false, err
+		}
+		return r, true, nil
+	}
+
+	return record{}, false, nil
+}
+
+// reindex indexes the keys of the tokens again from their newest record,
+// after a compaction dropped some of their records
+func (c *Cache) reindex(tokens []int) error {
+	for _, token := range tokens {
+		r, ok, err := c.lookup(token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			r = record{Token: token, Removed: true}
+		}
+		c.keys.put(r)
+	}
+	return nil
+}
+
+// view returns a copy of the MemTable and of the list of the SSTables, which can be
+// read without holding mu. The caller holds tablesMu until it is done with the view
+func (c *Cache) view() *Cache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	memtable := make(map[int]record, len(c.memtable))
+	for token, r := range c.memtable {
+		memtable[token] = r
+	}
+	return &Cache{memtable: memtable, sstables: append([]*sstable{}, c.sstables...), dataDir: c.dataDir}
+}
+
+// forEach calls fn with the newest version of every stored item
+func (c *Cache) forEach(fn func(token int, item models.CacheItem)) error {
+	type location struct {
+		table  *sstable
+		offset int64
+	}
+	latest := map[int]location{}
+	for _, t := range c.sstables {
+		entries, err := t.entries()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.removed {
+				delete(latest, entry.token)
+				continue
+			}
+			latest[entry.token] = location{table: t, offset: entry.offset}
+		}
+	}
+
+	for token, r := range c.memtable {
+		delete(latest, token)
+		if !r.Removed {
+			fn(token, r.Item)
+		}
+	}
+	for token, loc := range latest {
+		r, err := loc.table.read(loc.offset)
+		if err != nil {
+			return err
+		}
+		fn(token, r.Item)
+	}
+	return nil
+}
+
+func (c *Cache) remove(keys []int) error {
+	records := make([]record, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, record{Token: key, Removed: true})
+	}
+	return c.write(records)
+}
+
+// write appends the records to the COMMIT LOG before applying them to the MemTable.
+// Nothing is applied when the append fails
+func (c *Cache) write(records []record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	err := c.commitLog.append(records)
+	if err != nil {
+		return fmt.Errorf("could not append to the commit log: %w", err)
+	}
+	for _, r := range records {
+		c.memtable[r.Token] = r
+		c.track(r)
+		c.keys.put(r)
+	}
+
+	if len(c.memtable) >= memtableFlushSize {
+		err = c.flush()
+		if err != nil {
+			log.Printf("could not flush the memtable: %v", err)
+		}
+	}
+	return nil
+}
+
+// evict brings the items in memory back under the memory limit, starting from the least
+// recently used ones. With the drop policy they are removed, even from disk. Otherwise
+// the copies of the items stored on disk are forgotten, and the MemTable is flushed
+// as soon as one of its items is the least recently used one
+func (c *Cache) evict() {
+	if c.memoryLimit <= 0 {
+		return
+	}
+
+	for {
+		entry, ok := c.lru.oldest(c.memoryLimit)
+		if !ok {
+			return
+		}
+
+		switch {
+		case c.policy == models.EvictionDrop:
+			err := c.write([]record{{Token: entry.token, Removed: true}})
+			if err != nil {
+				log.Printf("could not drop key: %d, %v", entry.token, err)
+				return
+			}
+			c.lru.evicted(true)
+		case entry.dirty:
+			err := c.flush()
+			if err != nil {
+				log.Printf("could not flush the memtable: %v", err)
+				return
+			}
+		default:
+			c.lru.delete(entry.token)
+			c.lru.evicted(false)
+		}
+	}
+}
+
+// track keeps the items written to the MemTable in memory as the most recently used ones
+func (c *Cache) track(r record) {
+	if r.Removed {
+		c.lru.delete(r.Token)
+		return
+	}
+	c.lru.put(r.Token, r.Item, true)
+}
+
+// flush writes the MemTable to a new SSTable and empties the COMMIT LOG.
+// A crash before emptying the log only replays records already stored on disk
+func (c *Cache) flush() error {
+	if len(c.memtable) == 0 {
+		return nil
+	}
+
+	records := make([]record, 0, len(c.memtable))
+	for _, r := range c.memtable {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Token < records[j].Token
+	})
+
+	t, err := writeSSTable(c.dataDir, c.generation+1, records)
+	if err != nil {
+		return err
+	}
+	c.generation++
+	sstables := append(append([]*sstable{}, c.sstables...), t)
+	err = writeManifest(c.dataDir, manifest{Generations: generationsOf(sstables)})
+	if err != nil {
+		_ = t.remove()
 		return err
 	}
+	c.sstables = sstables
+
+	// without a memory limit only the MemTable is kept in memory
+	c.memtable = map[int]record{}
+	c.lru.flushed(c.memoryLimit > 0)
+	return c.commitLog.reset()
+}
 
-	file, err := os.Create(fmt.Sprintf("%s/db.json", c.dataDir))
+// init opens the SSTables found on disk and replays the COMMIT LOG into the MemTable
+func (c *Cache) init() error {
+	tmpFiles, err := filepath.Glob(filepath.Join(c.dataDir, "*.tmp"))
 	if err != nil {
-		log.Printf("could not create file: %v", err)
 		return err
 	}
+	for _, file := range tmpFiles {
+		_ = os.Remove(file)
+	}
+
+	m, err := readManifest(c.dataDir)
+	if err != nil {
+		return fmt.Errorf("could not read the manifest: %w", err)
+	}
+	listed := map[int]struct{}{}
+	for _, generation := range m.Generations {
+		t, err := openSSTable(c.dataDir, generation)
+		if err != nil {
+			return fmt.Errorf("could not open sstable: %d: %w", generation, err)
+		}
+		c.sstables = append(c.sstables, t)
+		listed[generation] = struct{}{}
+		if generation > c.generation {
+			c.generation = generation
+		}
+	}
 
-	err = json.NewEncoder(file).Encode(c.data)
+	// remove the tables left behind by an interrupted flush or compaction
+	generations, err := tableGenerations(c.dataDir)
 	if err != nil {
-		log.Printf("could not encode cache data to file: %v", err)
 		return err
 	}
-	return nil
+	for _, generation := range generations {
+		if _, ok := listed[generation]; ok {
+			continue
+		}
+		log.Printf("removing sstable: %d which is not part of the manifest", generation)
+		err = (&sstable{generation: generation, dir: c.dataDir}).remove()
+		if err != nil {
+			return err
+		}
+	}
+
+	c.commitLog, err = openCommitLog(filepath.Join(c.dataDir, "commit.log"))
+	if err != nil {
+		return fmt.Errorf("could not open the commit log: %w", err)
+	}
+	records, err := c.commitLog.replay()
+	if err != nil {
+		return fmt.Errorf("could not replay the commit log: %w", err)
+	}
+	for _, r := range records {
+		c.memtable[r.Token] = r
+		c.track(r)
+	}
+	if len(records) > 0 {
+		log.Printf("replayed %d record(s) from the commit log", len(records))
+	}
+
+	err = c.forEach(func(token int, item models.CacheItem) {
+		c.keys.put(record{Token: token, Item: item})
+	})
+	if err != nil {
+		return fmt.Errorf("could not index the keys: %w", err)
+	}
+
+	// with the drop policy the node only keeps the items which fit in memory
+	if c.policy == models.EvictionDrop && c.memoryLimit > 0 {
+		err = c.forEach(func(token int, item models.CacheItem) {
+			if _, ok := c.memtable[token]; !ok {
+				c.lru.put(token, item, false)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("could not read the items from disk: %w", err)
+		}
+		c.evict()
+	}
+
+	return c.migrate()
 }
 
-// init creates the initial state for the database from db.json file
-// CRITICAL: This is very INEFFICIENT and only for development purposes.
-// A better approach would be to use the disk directory and avoid initializing
-// the database like this. Creating optimized indexes and using file seeking can
-// drastically improve performance
-func (c *Cache) init() {
-	dbFile, err := os.Open(fmt.Sprintf("%s/db.json", c.dataDir))
+// migrate imports the db.json snapshot used by older versions
+// and renames it, so it only gets imported once
+func (c *Cache) migrate() error {
+	path := filepath.Join(c.dataDir, "db.json")
+	dbFile, err := os.Open(path)
 	if err != nil {
-		return
+		return nil
 	}
+	defer dbFile.Close()
 
 	var cacheData map[int]models.CacheItem
 	err = json.NewDecoder(dbFile).Decode(&cacheData)
 	if err != nil {
-		log.Printf("could not decode database file: %v", err)
-		return
+		return fmt.Errorf("could not decode database file: %w", err)
+	}
+
+	_, err = c.Set(cacheData)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	err = c.flush()
+	c.mu.Unlock()
+	if err != nil {
+		return err
 	}
 
-	c.data = cacheData
+	log.Printf("migrated %d item(s) from: %s", len(cacheData), path)
+	return os.Rename(path, path+".migrated")
+}
+
+func generationsOf(sstables []*sstable) []int {
+	generations := make([]int, 0, len(sstables))
+	for _, t := range sstables {
+		generations = append(generations, t.generation)
+	}
+	return generations
 }
@@ -0,0 +1,377 @@
+package repositories
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// storedTokens returns the tokens of the stored items, tombstones included
+func storedTokens(t *testing.T, cache *Cache) []int {
+	tokens := make([]int, 0)
+	err := cache.forEach(func(token int, item models.CacheItem) {
+		tokens = append(tokens, token)
+	})
+	if err != nil {
+		t.Fatalf("could not read the items: %v", err)
+	}
+	return tokens
+}
+
+// TestEviction writes more items than fit in memory. With the spill policy they
+// must all be readable from disk, with the drop policy only the most recently
+// used ones are kept, even after a restart with a smaller limit
+func TestEviction(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now().UTC()
+	items := map[int]models.CacheItem{}
+	for i := 0; i < 100; i++ {
+		items[i] = models.CacheItem{Key: fmt.Sprintf("key:%02d", i), Value: "value", UpdatedAt: now}
+	}
+	limit := 20 * items[0].Size()
+
+	for _, policy := range []string{models.EvictionSpill, models.EvictionDrop} {
+		dir := t.TempDir()
+		cache, err := NewCache(dir, limit, policy)
+		if err != nil {
+			t.Fatalf("could not open the database: %v", err)
+		}
+		for i := 0; i < len(items); i++ {
+			if _, err := cache.Set(map[int]models.CacheItem{i: items[i]}); err != nil {
+				t.Fatalf("%s: could not set item: %d, %v", policy, i, err)
+			}
+			// the first item is read all the time, it must never be evicted
+			if len(cache.Get([]int{0})) != 1 {
+				t.Fatalf("%s: the first item was evicted after writing: %d", policy, i)
+			}
+		}
+
+		stats := cache.Stats()
+		if stats.Used > limit {
+			t.Fatalf("%s: the memory used: %d is over the limit: %d", policy, stats.Used, limit)
+		}
+		found := len(cache.Get(storedTokens(t, cache)))
+		switch policy {
+		case models.EvictionSpill:
+			if found != len(items) || stats.Spilled == 0 || stats.Dropped != 0 {
+				t.Fatalf("%s: expected all the items on disk, found: %d, stats: %+v", policy, found, stats)
+			}
+		case models.EvictionDrop:
+			if found != stats.Items || int(stats.Dropped) != len(items)-found {
+				t.Fatalf("%s: expected only the items in memory, found: %d, stats: %+v", policy, found, stats)
+			}
+		}
+
+		err = cache.Close()
+		if err != nil {
+			t.Fatalf("could not close the database: %v", err)
+		}
+		cache, err = NewCache(dir, limit/2, policy)
+		if err != nil {
+			t.Fatalf("could not reopen the database: %v", err)
+		}
+		found = len(cache.Get(storedTokens(t, cache)))
+		if policy == models.EvictionDrop && int64(found) > limit/2/items[0].Size() {
+			t.Fatalf("%s: %d item(s) left after restarting with a smaller limit", policy, found)
+		}
+		if policy == models.EvictionSpill && found != len(items) {
+			t.Fatalf("%s: expected all the items after restarting, found: %d", policy, found)
+		}
+		_ = cache.Close()
+	}
+}
+
+// TestSetCommitLogFailure writes while the commit log can't be appended to.
+// The write must fail and leave nothing behind
+func TestSetCommitLogFailure(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cache, err := NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	_ = cache.commitLog.close()
+
+	item := models.CacheItem{Key: "key", Value: "value", UpdatedAt: time.Now().UTC()}
+	stored, err := cache.Set(map[int]models.CacheItem{1: item})
+	if err == nil || len(stored) != 0 {
+		t.Fatalf("expected the write to fail, stored: %v, err: %v", stored, err)
+	}
+	if len(cache.Get([]int{1})) != 0 {
+		t.Fatal("the failed write is readable")
+	}
+	if err = cache.Delete([]int{1}); err == nil {
+		t.Fatal("expected the removal to fail")
+	}
+}
+
+// TestPurgeConcurrentWrites purges expired items while they get rewritten.
+// The purge does not hold the lock while it looks for the items,
+// the versions written in the meantime must survive it
+func TestPurgeConcurrentWrites(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cache, err := NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer cache.Close()
+
+	now := time.Now().UTC()
+	expired := map[int]models.CacheItem{}
+	for i := 0; i < 3*memtableFlushSize; i++ {
+		expired[i] = models.CacheItem{Key: fmt.Sprintf("key:%d", i), Value: "old", UpdatedAt: now, ExpiresAt: now.Add(-time.Second)}
+	}
+	if _, err = cache.Set(expired); err != nil {
+		t.Fatalf("could not set the items: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < len(expired); i++ {
+			item := models.CacheItem{Key: fmt.Sprintf("key:%d", i), Value: "new", UpdatedAt: now.Add(time.Second)}
+			if _, err := cache.Set(map[int]models.CacheItem{i: item}); err != nil {
+				t.Errorf("could not rewrite item: %d, %v", i, err)
+				return
+			}
+		}
+	}()
+	for purging := true; purging; {
+		select {
+		case <-done:
+			purging = false
+		default:
+		}
+		cache.PurgeExpired(time.Now().UTC())
+	}
+
+	items := cache.Get(storedTokens(t, cache))
+	if len(items) != len(expired) {
+		t.Fatalf("expected the %d rewritten items, found: %d", len(expired), len(items))
+	}
+	for _, item := range items {
+		if item.Deleted || item.Value != "new" {
+			t.Fatalf("expected the rewritten item, got: %+v", item)
+		}
+	}
+}
+
+// TestPurgeExpiredKeepsTombstone purges an expired item, then merges the copy
+// of another replica, which missed the purge. The copy must not come back
+func TestPurgeExpiredKeepsTombstone(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cache, err := NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer cache.Close()
+
+	now := time.Now().UTC()
+	item := models.CacheItem{Key: "key", Value: "value", UpdatedAt: now.Add(-time.Minute), ExpiresAt: now.Add(-time.Second)}
+	if _, err = cache.Set(map[int]models.CacheItem{1: item}); err != nil {
+		t.Fatalf("could not set the item: %v", err)
+	}
+	if purged := cache.PurgeExpired(now); purged != 1 {
+		t.Fatalf("expected the expired item to be purged, purged: %d", purged)
+	}
+
+	stored, err := cache.Set(map[int]models.CacheItem{1: item})
+	if err != nil || len(stored) != 0 {
+		t.Fatalf("expected the copy to lose against the tombstone, stored: %v, err: %v", stored, err)
+	}
+	items := cache.Get([]int{1})
+	if len(items) != 1 || !items[0].Deleted || !items[0].UpdatedAt.Equal(item.ExpiresAt) {
+		t.Fatalf("expected the tombstone dated when the item expired, got: %+v", items)
+	}
+}
+
+// TestScanKeys lists the keys a page at a time while they are spread over the
+// tables, the MemTable and the removals. The pages must follow the key order,
+// tombstones included until a compaction drops them, and a restart must not
+// lose the keys of the index. The key count must follow the stored keys
+func TestScanKeys(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+
+	// the tokens don't follow the keys, like the hashes of the ring
+	now, count := time.Now().UTC(), 4*memtableFlushSize
+	for batch := 0; batch < 4; batch++ {
+		items := map[int]models.CacheItem{}
+		for i := batch * memtableFlushSize; i < (batch+1)*memtableFlushSize; i++ {
+			item := models.CacheItem{Key: fmt.Sprintf("key:%04d", count-1-i), Value: "value", UpdatedAt: now.Add(-time.Hour)}
+			item.Deleted = i%10 == 1
+			items[i] = item
+		}
+		items[count+batch] = models.CacheItem{Key: fmt.Sprintf("other:%d", batch), Value: "value", UpdatedAt: now}
+		if _, err = cache.Set(items); err != nil {
+			t.Fatalf("could not set the items: %v", err)
+		}
+	}
+	removed := make([]int, 0)
+	for i := 0; i < count; i += 10 {
+		removed = append(removed, i)
+	}
+	if err = cache.Delete(removed); err != nil {
+		t.Fatalf("could not remove the items: %v", err)
+	}
+
+	scanAll := func(cache *Cache) ([]string, int) {
+		if count, stored := cache.KeyCount(), len(storedTokens(t, cache)); count != stored {
+			t.Fatalf("the key count: %d does not match the %d stored keys", count, stored)
+		}
+		keys, tombstones, after := make([]string, 0), 0, ""
+		for {
+			items := cache.ScanKeys("key:", after, 100, func(key string) bool { return true })
+			if len(items) == 0 {
+				return keys, tombstones
+			}
+			for _, item := range items {
+				if item.Key <= after {
+					t.Fatalf("key: %s is not after: %s", item.Key, after)
+				}
+				keys, after = append(keys, item.Key), item.Key
+				if item.Deleted {
+					tombstones++
+				}
+			}
+		}
+	}
+	expected := count - len(removed)
+	keys, tombstones := scanAll(cache)
+	if len(keys) != expected || tombstones != count/10 {
+		t.Fatalf("expected %d keys with %d tombstones, got: %d keys, %d tombstones", expected, count/10, len(keys), tombstones)
+	}
+
+	if err = cache.Close(); err != nil {
+		t.Fatalf("could not close the database: %v", err)
+	}
+	cache, err = NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database again: %v", err)
+	}
+	defer cache.Close()
+	if keys, _ = scanAll(cache); len(keys) != expected {
+		t.Fatalf("expected %d keys after the restart, got: %d", expected, len(keys))
+	}
+
+	stats, err := cache.Compact(now, 0)
+	if err != nil || stats.DroppedTombstones == 0 {
+		t.Fatalf("expected the tombstones to be dropped, stats: %+v, err: %v", stats, err)
+	}
+	keys, tombstones = scanAll(cache)
+	if len(keys) != expected-count/10 || tombstones != 0 {
+		t.Fatalf("expected %d keys without tombstones, got: %d keys, %d tombstones", expected-count/10, len(keys), tombstones)
+	}
+}
+
+// TestCountKeys counts the items of the keyspaces while they get overwritten,
+// deleted, removed and expire, and after a restart. The counts kept by the
+// key index must match the counts of the stored items
+func TestCountKeys(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+
+	check := func(cache *Cache, stage string) {
+		now := time.Now().UTC()
+		expected := map[string]models.KeyspaceStats{}
+		err := cache.forEach(func(token int, item models.CacheItem) {
+			if item.Deleted || item.Expired(now) {
+				return
+			}
+			keyspace, _ := models.SplitKeyspaceKey(item.Key)
+			stats := expected[keyspace]
+			stats.Keys, stats.Bytes = stats.Keys+1, stats.Bytes+item.Size()
+			expected[keyspace] = stats
+		})
+		if err != nil {
+			t.Fatalf("%s: could not read the items: %v", stage, err)
+		}
+		for _, keyspace := range []string{models.DefaultKeyspace, "orders"} {
+			keys, bytes := cache.CountKeys(keyspace)
+			if keys != expected[keyspace].Keys || bytes != expected[keyspace].Bytes {
+				t.Fatalf("%s: expected %+v in keyspace: %s, counted: %d keys, %d bytes", stage, expected[keyspace], keyspace, keys, bytes)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	items := map[int]models.CacheItem{}
+	for i := 0; i < 3*memtableFlushSize/2; i++ {
+		item := models.CacheItem{Key: fmt.Sprintf("key:%d", i), Value: "value", UpdatedAt: now}
+		if i%2 == 0 {
+			item.Key = models.KeyspaceKey("orders", item.Key)
+		}
+		if i%5 == 0 {
+			item.ExpiresAt = now.Add(50 * time.Millisecond)
+		}
+		items[i] = item
+	}
+	if _, err = cache.Set(items); err != nil {
+		t.Fatalf("could not set the items: %v", err)
+	}
+	check(cache, "written")
+
+	changes := map[int]models.CacheItem{}
+	for i := 0; i < len(items); i += 3 {
+		item := items[i]
+		item.UpdatedAt = now.Add(time.Second)
+		switch i % 4 {
+		case 0:
+			item.Value = "a longer value"
+		case 1:
+			item.Deleted = true
+		case 2:
+			item.ExpiresAt = time.Time{}
+		}
+		changes[i] = item
+	}
+	if _, err = cache.Set(changes); err != nil {
+		t.Fatalf("could not change the items: %v", err)
+	}
+	if err = cache.Delete([]int{1, 2, 4}); err != nil {
+		t.Fatalf("could not remove the items: %v", err)
+	}
+	check(cache, "changed")
+
+	time.Sleep(100 * time.Millisecond)
+	check(cache, "expired")
+
+	if err = cache.Close(); err != nil {
+		t.Fatalf("could not close the database: %v", err)
+	}
+	cache, err = NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database again: %v", err)
+	}
+	defer cache.Close()
+	check(cache, "restarted")
+
+	if purged := cache.PurgeExpired(time.Now().UTC()); purged == 0 {
+		t.Fatal("expected the expired items to be purged")
+	}
+	check(cache, "purged")
+}
@@ -0,0 +1,110 @@
+package repositories
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// commitLog is an append only file holding every write
+// which did not make it into an SSTable yet.
+// Every entry is framed as: [length uint32][crc32 uint32][json record]
+func openCommitLog(path string) (*commitLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commitLog{file: file}, nil
+}
+
+type commitLog struct {
+	file *os.File
+}
+
+// append writes the records and syncs the file,
+// so the writes are durable once append returns
+func (l *commitLog) append(records []record) error {
+	w := bufio.NewWriter(l.file)
+	for _, r := range records {
+		bs, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(bs)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(bs))
+		_, err = w.Write(header[:])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// replay reads back all the records from the log. A torn or corrupted
+// entry at the end of the file (crash during a write) ends the replay
+func (l *commitLog) replay() ([]record, error) {
+	_, err := l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	r, records := bufio.NewReader(l.file), make([]record, 0)
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(r, header[:])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		bs := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		_, err = io.ReadFull(r, bs)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if crc32.ChecksumIEEE(bs) != binary.BigEndian.Uint32(header[4:]) {
+			return records, nil
+		}
+
+		var rec record
+		err = json.Unmarshal(bs, &rec)
+		if err != nil {
+			return records, nil
+		}
+		records = append(records, rec)
+	}
+}
+
+// reset empties the log, once its records are safely stored in an SSTable
+func (l *commitLog) reset() error {
+	err := l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *commitLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,290 @@
+package repositories
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"distributed-db/models"
+)
+
+// size-tiered compaction settings
+const (
+	// tables smaller than this all end up in the same bucket
+	minTableSize = 1 << 20
+	// tables between bucketLow * avg and bucketHigh * avg share a bucket
+	bucketLow  = 0.5
+	bucketHigh = 1.5
+	// min and max number of tables merged in a single run
+	minCompactionThreshold = 4
+	maxCompactionThreshold = 32
+)
+
+// Compact runs one size-tiered compaction. It looks for runs of adjacent
+// tables of similar size and merges the cheapest one into a single table.
+// Overwritten values are dropped and so are removed records and tombstones updated
+// before tombstonesBefore, as long as no older table is left out of the run, which
+// could make an older version of the item visible again. Expired items are turned
+// into tombstones dated when they expired, dropped once past tombstonesBefore.
+// Writes are throttled to bytesPerSecond (0 means no throttling)
+func (c *Cache) Compact(tombstonesBefore time.Time, bytesPerSecond int64) (models.CompactionStats, error) {
+	start := time.Now()
+	c.mu.RLock()
+	tables := append([]*sstable{}, c.sstables...)
+	c.mu.RUnlock()
+
+	first, run := pickRun(tables)
+	if len(run) == 0 {
+		return models.CompactionStats{}, nil
+	}
+
+	c.mu.Lock()
+	c.generation++
+	generation := c.generation
+	c.mu.Unlock()
+
+	stats := models.CompactionStats{Tables: len(run)}
+	dropDeleted := first == 0
+	output, dropped, err := mergeTables(c.dataDir, generation, run, dropDeleted, tombstonesBefore, newThrottle(bytesPerSecond), &stats)
+	if err != nil {
+		return models.CompactionStats{}, err
+	}
+
+	// swap the tables in the manifest, the run is replaced by its output.
+	// Tables only get appended by flushes in the meantime, so the run stays in place
+	c.mu.Lock()
+	for i, t := range run {
+		if first+i >= len(c.sstables) || c.sstables[first+i] != t {
+			c.mu.Unlock()
+			_ = output.remove()
+			return models.CompactionStats{}, fmt.Errorf("sstables changed during compaction")
+		}
+	}
+	sstables := make([]*sstable, 0, len(c.sstables)-len(run)+1)
+	sstables = append(sstables, c.sstables[:first]...)
+	sstables = append(sstables, output)
+	sstables = append(sstables, c.sstables[first+len(run):]...)
+	err = writeManifest(c.dataDir, manifest{Generations: generationsOf(sstables)})
+	if err != nil {
+		c.mu.Unlock()
+		_ = output.remove()
+		return models.CompactionStats{}, fmt.Errorf("could not write the manifest: %w", err)
+	}
+	c.sstables = sstables
+	// the copies of the dropped items must not outlive them
+	if dropDeleted {
+		now := time.Now().UTC()
+		c.lru.forget(func(item models.CacheItem) bool {
+			return (item.Deleted && item.UpdatedAt.Before(tombstonesBefore)) || item.Expired(now)
+		})
+	}
+	err = c.reindex(dropped)
+	if err != nil {
+		log.Printf("could not index the keys of the dropped items: %v", err)
+	}
+	c.mu.Unlock()
+
+	c.tablesMu.Lock()
+	for _, t := range run {
+		err = t.remove()
+		if err != nil {
+			log.Printf("could not remove compacted sstable: %d: %v", t.generation, err)
+		}
+	}
+	c.tablesMu.Unlock()
+
+	stats.BytesOut = output.size
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// pickRun groups adjacent tables of similar size and returns
+// the position and the tables of the run with the smallest average size
+func pickRun(tables []*sstable) (int, []*sstable) {
+	type bucket struct {
+		first int
+		size  int64
+		count int
+	}
+	fits := func(b bucket, t *sstable) bool {
+		if b.count == 0 || b.count == maxCompactionThreshold {
+			return b.count == 0
+		}
+		avg := float64(b.size) / float64(b.count)
+		if t.size < minTableSize && avg < minTableSize {
+			return true
+		}
+		return float64(t.size) >= bucketLow*avg && float64(t.size) <= bucketHigh*avg
+	}
+
+	buckets, current := make([]bucket, 0), bucket{}
+	for i, t := range tables {
+		if !fits(current, t) {
+			buckets = append(buckets, current)
+			current = bucket{first: i}
+		}
+		current.size += t.size
+		current.count++
+	}
+	buckets = append(buckets, current)
+
+	best := bucket{}
+	for _, b := range buckets {
+		if b.count < minCompactionThreshold {
+			continue
+		}
+		if best.count == 0 || b.size/int64(b.count) < best.size/int64(best.count) {
+			best = b
+		}
+	}
+	return best.first, tables[best.first : best.first+best.count]
+}
+
+// mergeTables merges the sorted tables into a new table, keeping only the newest
+// record of every token. It returns the tokens of the items it dropped
+func mergeTables(dir string, generation int, tables []*sstable, dropDeleted bool, tombstonesBefore time.Time, throttle *throttle, stats *models.CompactionStats) (*sstable, []int, error) {
+	scanners := make([]*tableScanner, 0, len(tables))
+	for _, t := range tables {
+		s, err := newTableScanner(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		scanners = append(scanners, s)
+		stats.BytesIn += t.size
+	}
+
+	w, err := newTableWriter(dir, generation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now, dropped := time.Now().UTC(), make([]int, 0)
+	for {
+		// find the smallest token, the newest table wins on equal tokens
+		newest := -1
+		for i, s := range scanners {
+			if s.done {
+				continue
+			}
+			if newest == -1 || s.current.Token <= scanners[newest].current.Token {
+				newest = i
+			}
+		}
+		if newest == -1 {
+			break
+		}
+
+		r := scanners[newest].current
+		for _, s := range scanners {
+			if s.done || s.current.Token != r.Token {
+				continue
+			}
+			stats.RecordsIn++
+			err = s.next()
+			if err != nil {
+				w.abort()
+				return nil, nil, err
+			}
+		}
+
+		switch {
+		case dropDeleted && r.Removed:
+			stats.DroppedTombstones++
+			continue
+		case dropDeleted && r.Item.Deleted && r.Item.UpdatedAt.Before(tombstonesBefore):
+			stats.DroppedTombstones++
+			dropped = append(dropped, r.Token)
+			continue
+		case dropDeleted && r.Item.Expired(now):
+			tombstone := r.Item.ExpiredTombstone()
+			if tombstone.UpdatedAt.Before(tombstonesBefore) {
+				stats.DroppedExpired++
+				dropped = append(dropped, r.Token)
+				continue
+			}
+			// the older copies of the other replicas stay shadowed until the grace period ends
+			r.Item = tombstone
+		}
+
+		err = w.write(r)
+		if err != nil {
+			w.abort()
+			return nil, nil, err
+		}
+		stats.RecordsOut++
+		throttle.wait(w.offset)
+	}
+	stats.DroppedOverwritten = stats.RecordsIn - stats.RecordsOut - stats.DroppedTombstones - stats.DroppedExpired
+
+	output, err := w.commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return output, dropped, nil
+}
+
+// tableScanner reads the records of a table in token order
+type tableScanner struct {
+	r       *bufio.Reader
+	current record
+	done    bool
+}
+
+func newTableScanner(t *sstable) (*tableScanner, error) {
+	s := &tableScanner{
+		r: bufio.NewReader(io.NewSectionReader(t.data, 0, t.size)),
+	}
+	return s, s.next()
+}
+
+func (s *tableScanner) next() error {
+	var header [4]byte
+	_, err := io.ReadFull(s.r, header[:])
+	if errors.Is(err, io.EOF) {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bs := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, err = io.ReadFull(s.r, bs)
+	if err != nil {
+		return err
+	}
+
+	s.current = record{}
+	return json.Unmarshal(bs, &s.current)
+}
+
+// throttle limits the compaction I/O, so it does not starve the foreground traffic
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// wait sleeps until writing the given amount of bytes is within the limit
+func (t *throttle) wait(written int64) {
+	if t.bytesPerSecond <= 0 {
+		return
+	}
+
+	expected := time.Duration(float64(written) / float64(t.bytesPerSecond) * float64(time.Second))
+	elapsed := time.Since(t.start)
+	if expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+}
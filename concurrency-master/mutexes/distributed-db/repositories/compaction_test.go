@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// writeTable writes the items and flushes them to a new table
+func writeTable(t *testing.T, cache *Cache, items map[int]models.CacheItem) {
+	if _, err := cache.Set(items); err != nil {
+		t.Fatalf("could not set the items: %v", err)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err := cache.flush(); err != nil {
+		t.Fatalf("could not flush the items: %v", err)
+	}
+}
+
+// TestPickRun groups the tables by size. Only the runs of at least
+// minCompactionThreshold adjacent tables of similar size get merged,
+// the run with the smallest tables first
+func TestPickRun(t *testing.T) {
+	tables := func(sizes ...int64) []*sstable {
+		res := make([]*sstable, 0, len(sizes))
+		for _, size := range sizes {
+			res = append(res, &sstable{size: size})
+		}
+		return res
+	}
+	const mb = minTableSize
+
+	for _, test := range []struct {
+		sizes []int64
+		first int
+		count int
+	}{
+		{sizes: []int64{10, 20, 30}, count: 0},
+		{sizes: []int64{10, 20, 30, 40}, first: 0, count: 4},
+		{sizes: []int64{100 * mb, 10, 20, 30, 40}, first: 1, count: 4},
+		{sizes: []int64{10 * mb, 11 * mb, 12 * mb, 13 * mb, 100 * mb, 2 * mb, 2 * mb, 2 * mb, 2 * mb}, first: 5, count: 4},
+		{sizes: []int64{10 * mb, 11 * mb, 40 * mb, 12 * mb, 13 * mb}, count: 0},
+	} {
+		all := tables(test.sizes...)
+		first, run := pickRun(all)
+		if len(run) != test.count || (test.count > 0 && (first != test.first || run[0] != all[test.first])) {
+			t.Fatalf("sizes: %v, expected %d table(s) from: %d, got: %d from: %d", test.sizes, test.count, test.first, len(run), first)
+		}
+	}
+}
+
+// TestCompact merges tables holding several versions of the items. The newest
+// version of every item must win, the old tombstones, the removed records and the
+// items expired long ago must be dropped and the recently expired items replaced
+// by tombstones. The merged table must replace the run in the manifest
+func TestCompact(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+
+	now := time.Now().UTC()
+	grace := now.Add(-time.Hour)
+	writeTable(t, cache, map[int]models.CacheItem{
+		1: {Key: "overwritten", Value: "v1", UpdatedAt: now.Add(-3 * time.Hour)},
+		2: {Key: "value", Value: "value", UpdatedAt: now.Add(-3 * time.Hour)},
+		3: {Key: "old tombstone", UpdatedAt: now.Add(-2 * time.Hour), Deleted: true},
+		4: {Key: "recent tombstone", UpdatedAt: now.Add(-time.Minute), Deleted: true},
+		5: {Key: "expired long ago", Value: "value", UpdatedAt: now.Add(-3 * time.Hour), ExpiresAt: now.Add(-2 * time.Hour)},
+		6: {Key: "expired recently", Value: "value", UpdatedAt: now.Add(-3 * time.Hour), ExpiresAt: now.Add(-time.Minute)},
+		7: {Key: "removed", Value: "value", UpdatedAt: now.Add(-3 * time.Hour)},
+	})
+	writeTable(t, cache, map[int]models.CacheItem{1: {Key: "overwritten", Value: "v2", UpdatedAt: now.Add(-2 * time.Hour)}})
+	writeTable(t, cache, map[int]models.CacheItem{1: {Key: "overwritten", Value: "v3", UpdatedAt: now.Add(-time.Hour)}})
+	if err = cache.Delete([]int{7}); err != nil {
+		t.Fatalf("could not remove the item: %v", err)
+	}
+	writeTable(t, cache, map[int]models.CacheItem{8: {Key: "other", Value: "value", UpdatedAt: now}})
+
+	stats, err := cache.Compact(grace, 0)
+	if err != nil {
+		t.Fatalf("could not compact: %v", err)
+	}
+	if stats.Tables != 4 || stats.DroppedOverwritten != 3 || stats.DroppedTombstones != 2 || stats.DroppedExpired != 1 || stats.RecordsOut != 5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	check := func(cache *Cache, stage string) {
+		if len(cache.sstables) != 1 {
+			t.Fatalf("%s: expected the merged table only, got: %d table(s)", stage, len(cache.sstables))
+		}
+		found := map[string]models.CacheItem{}
+		err := cache.forEach(func(token int, item models.CacheItem) {
+			found[item.Key] = item
+		})
+		if err != nil {
+			t.Fatalf("%s: could not read the items: %v", stage, err)
+		}
+		if len(found) != 5 {
+			t.Fatalf("%s: expected 5 items, got: %v", stage, found)
+		}
+		if item := found["overwritten"]; item.Value != "v3" {
+			t.Fatalf("%s: expected the newest version, got: %+v", stage, item)
+		}
+		if item := found["recent tombstone"]; !item.Deleted {
+			t.Fatalf("%s: expected the recent tombstone to be kept, got: %+v", stage, item)
+		}
+		if item := found["expired recently"]; !item.Deleted || !item.UpdatedAt.Equal(now.Add(-time.Minute)) {
+			t.Fatalf("%s: expected a tombstone dated when the item expired, got: %+v", stage, item)
+		}
+		for _, key := range []string{"old tombstone", "expired long ago", "removed"} {
+			if item, ok := found[key]; ok {
+				t.Fatalf("%s: expected key: %s to be dropped, got: %+v", stage, key, item)
+			}
+		}
+	}
+	check(cache, "compacted")
+
+	// the run is replaced on disk as well, the removed tables must not come back
+	if err = cache.Close(); err != nil {
+		t.Fatalf("could not close the database: %v", err)
+	}
+	m, err := readManifest(dir)
+	if err != nil || len(m.Generations) != 1 {
+		t.Fatalf("expected the merged table in the manifest, got: %+v, %v", m, err)
+	}
+	cache, err = NewCache(dir, 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database again: %v", err)
+	}
+	defer cache.Close()
+	check(cache, "restarted")
+}
+
+// TestCompactKeepsTombstones merges the recent tables while an older, bigger table
+// is left out of the run. The old tombstones must be kept, since the older table
+// may still hold a value they shadow
+func TestCompactKeepsTombstones(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cache, err := NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	defer cache.Close()
+
+	now := time.Now().UTC()
+	writeTable(t, cache, map[int]models.CacheItem{
+		1: {Key: "deleted", Value: "value", UpdatedAt: now.Add(-3 * time.Hour)},
+		2: {Key: "big", Value: strings.Repeat("x", 2*minTableSize), UpdatedAt: now.Add(-3 * time.Hour)},
+	})
+	writeTable(t, cache, map[int]models.CacheItem{1: {Key: "deleted", UpdatedAt: now.Add(-2 * time.Hour), Deleted: true}})
+	for token := 3; token < 6; token++ {
+		writeTable(t, cache, map[int]models.CacheItem{token: {Key: "other", Value: "value", UpdatedAt: now}})
+	}
+
+	stats, err := cache.Compact(now.Add(-time.Hour), 0)
+	if err != nil || stats.Tables != 4 || stats.DroppedTombstones != 0 {
+		t.Fatalf("expected the 4 small tables to be merged without dropping tombstones, stats: %+v, err: %v", stats, err)
+	}
+	items := cache.Get([]int{1})
+	if len(items) != 1 || !items[0].Deleted {
+		t.Fatalf("expected the tombstone to shadow the older value, got: %+v", items)
+	}
+}
@@ -0,0 +1,353 @@
+package repositories
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+// number of hints sent to a node in a single batch
+const hintsBatchSize = 100
+
+var ErrTooManyHints = errors.New("too many hints")
+
+// NewHints opens the hints stored in the given directory.
+// Hints are writes which could not reach their replica, kept on the coordinator
+// in an append only file per target node until the node comes back up,
+// or until they are older than the max age
+func NewHints(dir string, maxAge time.Duration, maxPerNode int) (*Hints, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("could not create hints directory: %w", err)
+	}
+
+	hints := &Hints{
+		dir:        dir,
+		maxAge:     maxAge,
+		maxPerNode: maxPerNode,
+		counts:     map[string]int{},
+		oldest:     map[string]time.Time{},
+		replaying:  map[string]bool{},
+	}
+	err = hints.init()
+	if err != nil {
+		return nil, err
+	}
+	return hints, nil
+}
+
+type Hints struct {
+	mu         sync.Mutex
+	dir        string
+	maxAge     time.Duration
+	maxPerNode int
+	counts     map[string]int
+	// when the oldest hint of every node was created, so the expired
+	// hints are pruned without reading the files which have none
+	oldest map[string]time.Time
+	// the nodes whose hints are being sent, their files are only rewritten by the replay
+	replaying map[string]bool
+}
+
+type hint struct {
+	Token     int              `json:"token"`
+	Item      models.CacheItem `json:"item"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// Add stores a hint for the node, unless the node already has too many hints
+// once the expired ones are pruned
+func (h *Hints) Add(node string, token int, item models.CacheItem) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts[node] >= h.maxPerNode && !h.replaying[node] {
+		_, err := h.prune(node)
+		if err != nil {
+			log.Printf("could not prune the hints of node: %s, %v", node, err)
+		}
+	}
+	if h.counts[node] >= h.maxPerNode {
+		return fmt.Errorf("%w: node: %s already has %d hint(s)", ErrTooManyHints, node, h.counts[node])
+	}
+
+	now := time.Now().UTC()
+	bs, err := json.Marshal(hint{Token: token, Item: item, CreatedAt: now})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path(node), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(bs, '\n'))
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	if h.counts[node] == 0 {
+		h.oldest[node] = now
+	}
+	h.counts[node]++
+	return nil
+}
+
+// Nodes returns the nodes which have hints waiting for them
+func (h *Hints) Nodes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nodes := make([]string, 0, len(h.counts))
+	for node, count := range h.counts {
+		if count > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Prune drops the hints older than the max age of all the nodes,
+// and returns the number of dropped hints
+func (h *Hints) Prune() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	deadline, pruned := time.Now().UTC().Add(-h.maxAge), 0
+	for node, oldest := range h.oldest {
+		if !oldest.Before(deadline) || h.replaying[node] {
+			continue
+		}
+		n, err := h.prune(node)
+		if err != nil {
+			log.Printf("could not prune the hints of node: %s, %v", node, err)
+			continue
+		}
+		pruned += n
+	}
+	return pruned
+}
+
+// Replay sends the hints of the node in batches and removes the ones which were
+// acknowledged. Hints older than the max age are dropped. The lock is not held
+// while sending, the hints added in the meantime are kept for the next replay,
+// and so are the hints which could not be sent, which is safe since the newest
+// version of an item always wins. Only one replay of a node runs at a time
+func (h *Hints) Replay(node string, send func(items map[int]models.CacheItem) error) (int, error) {
+	h.mu.Lock()
+	if h.replaying[node] {
+		h.mu.Unlock()
+		return 0, nil
+	}
+	hints, err := h.read(node)
+	if err != nil {
+		h.mu.Unlock()
+		return 0, err
+	}
+	h.replaying[node] = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.replaying, node)
+		h.mu.Unlock()
+	}()
+
+	// only the newest hint of every token is worth sending
+	deadline, items := time.Now().UTC().Add(-h.maxAge), map[int]models.CacheItem{}
+	for _, hn := range hints {
+		if hn.CreatedAt.Before(deadline) {
+			continue
+		}
+		old, ok := items[hn.Token]
+		if !ok || !old.UpdatedAt.After(hn.Item.UpdatedAt) {
+			items[hn.Token] = hn.Item
+		}
+	}
+
+	batch, acked := map[int]models.CacheItem{}, map[int]bool{}
+	var sendErr error
+	for token, item := range items {
+		batch[token] = item
+		if len(batch) < hintsBatchSize {
+			continue
+		}
+		sendErr = send(batch)
+		if sendErr != nil {
+			break
+		}
+		for token := range batch {
+			acked[token] = true
+		}
+		batch = map[int]models.CacheItem{}
+	}
+	if sendErr == nil && len(batch) > 0 {
+		sendErr = send(batch)
+		if sendErr == nil {
+			for token := range batch {
+				acked[token] = true
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err = h.rewrite(node, len(hints), func(hn hint) bool {
+		return !acked[hn.Token] && !hn.CreatedAt.Before(deadline)
+	})
+	if err != nil {
+		return len(acked), err
+	}
+	return len(acked), sendErr
+}
+
+// prune drops the expired hints of the node and returns their number
+func (h *Hints) prune(node string) (int, error) {
+	count := h.counts[node]
+	deadline := time.Now().UTC().Add(-h.maxAge)
+	err := h.rewrite(node, count, func(hn hint) bool {
+		return !hn.CreatedAt.Before(deadline)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count - h.counts[node], nil
+}
+
+// rewrite keeps the first n hints of the node which are kept, and all the hints after
+// them, which were added since the first n were read. The file is replaced at once
+func (h *Hints) rewrite(node string, n int, keep func(hn hint) bool) error {
+	hints, err := h.read(node)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]hint, 0, len(hints))
+	for i, hn := range hints {
+		if i >= n || keep(hn) {
+			kept = append(kept, hn)
+		}
+	}
+	if len(kept) == 0 {
+		err = os.Remove(h.path(node))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(h.counts, node)
+		delete(h.oldest, node)
+		return nil
+	}
+	if len(kept) == len(hints) {
+		return nil
+	}
+
+	tmp := h.path(node) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, hn := range kept {
+		bs, err := json.Marshal(hn)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		_, _ = w.Write(append(bs, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, h.path(node))
+	if err != nil {
+		return err
+	}
+
+	h.counts[node], h.oldest[node] = len(kept), oldestOf(kept)
+	return nil
+}
+
+func oldestOf(hints []hint) time.Time {
+	oldest := hints[0].CreatedAt
+	for _, hn := range hints[1:] {
+		if hn.CreatedAt.Before(oldest) {
+			oldest = hn.CreatedAt
+		}
+	}
+	return oldest
+}
+
+func (h *Hints) read(node string) ([]hint, error) {
+	file, err := os.Open(h.path(node))
+	if os.IsNotExist(err) {
+		return []hint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hints, scanner := make([]hint, 0), bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var hn hint
+		err = json.Unmarshal(scanner.Bytes(), &hn)
+		if err != nil {
+			// most likely a torn write at the end of the file
+			log.Printf("skipping corrupted hint for node: %s: %v", node, err)
+			continue
+		}
+		hints = append(hints, hn)
+	}
+	return hints, scanner.Err()
+}
+
+func (h *Hints) init() error {
+	files, err := filepath.Glob(filepath.Join(h.dir, "*.hints"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		node, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".hints"))
+		if err != nil {
+			continue
+		}
+		hints, err := h.read(node)
+		if err != nil {
+			return fmt.Errorf("could not read hints of node: %s: %w", node, err)
+		}
+		h.counts[node] = len(hints)
+		if len(hints) > 0 {
+			h.oldest[node] = oldestOf(hints)
+		}
+	}
+	return nil
+}
+
+func (h *Hints) path(node string) string {
+	return filepath.Join(h.dir, url.PathEscape(node)+".hints")
+}
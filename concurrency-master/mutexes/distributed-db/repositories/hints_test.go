@@ -0,0 +1,90 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestHintsReplay adds hints while they are being sent and fails the second batch.
+// The lock is not held while sending, the hints added in the meantime and the ones
+// of the failed batch must be kept for the next replay
+func TestHintsReplay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	hints, err := NewHints(t.TempDir(), time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("could not open the hints: %v", err)
+	}
+	now := time.Now().UTC()
+	for i := 0; i < 2*hintsBatchSize; i++ {
+		if err = hints.Add("node", i, models.CacheItem{Key: fmt.Sprint(i), UpdatedAt: now}); err != nil {
+			t.Fatalf("could not add hint: %d, %v", i, err)
+		}
+	}
+
+	batches := 0
+	sent, err := hints.Replay("node", func(items map[int]models.CacheItem) error {
+		batches++
+		if batches == 2 {
+			return errors.New("node unreachable")
+		}
+		return hints.Add("node", 1000, models.CacheItem{Key: "new", UpdatedAt: now})
+	})
+	if err == nil || sent != hintsBatchSize {
+		t.Fatalf("expected the first batch to be sent, sent: %d, err: %v", sent, err)
+	}
+
+	tokens := map[int]bool{}
+	sent, err = hints.Replay("node", func(items map[int]models.CacheItem) error {
+		for token := range items {
+			tokens[token] = true
+		}
+		return nil
+	})
+	if err != nil || sent != hintsBatchSize+1 || !tokens[1000] {
+		t.Fatalf("expected the failed batch and the new hint, sent: %d, new hint: %v, err: %v", sent, tokens[1000], err)
+	}
+	if nodes := hints.Nodes(); len(nodes) != 0 {
+		t.Fatalf("expected no hint left, got hints for: %v", nodes)
+	}
+}
+
+// TestHintsPrune keeps hints for a node which never comes back,
+// the expired ones must not take the room of the new ones
+func TestHintsPrune(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	hints, err := NewHints(t.TempDir(), 50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("could not open the hints: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = hints.Add("node", i, models.CacheItem{Key: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("could not add hint: %d, %v", i, err)
+		}
+	}
+	if err = hints.Add("node", 2, models.CacheItem{Key: "2"}); !errors.Is(err, ErrTooManyHints) {
+		t.Fatalf("expected too many hints, got: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err = hints.Add("node", 2, models.CacheItem{Key: "2"}); err != nil {
+		t.Fatalf("expected the expired hints to make room, got: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pruned := hints.Prune(); pruned != 1 {
+		t.Fatalf("expected the expired hint to be pruned, pruned: %d", pruned)
+	}
+	if nodes := hints.Nodes(); len(nodes) != 0 {
+		t.Fatalf("expected no hint left, got hints for: %v", nodes)
+	}
+}
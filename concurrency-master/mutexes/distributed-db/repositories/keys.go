@@ -0,0 +1,242 @@
+package repositories
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+// number of keys added since the last merge above which they get merged into the sorted keys
+const keysMergeSize = 1024
+
+// keyIndex keeps the keys of the stored items in key order, so the scans seek to their
+// first key instead of reading every item. The tables are sorted by token, the index is
+// built when the database is opened and kept up to date by the writes.
+// The keys added since the last merge are kept apart and merged lazily,
+// the removed keys stay in the sorted keys until then and are skipped.
+// It also counts the live items of every keyspace, the items with a TTL
+// are only uncounted once they expire, when the keyspace gets counted
+type keyIndex struct {
+	mu     sync.Mutex
+	tokens map[int]keyEntry
+	byKey  map[string]int
+	sorted []string
+	added  []string
+	// whether the added keys are sorted
+	ordered bool
+	stale   int
+	counts  map[string]keyCount
+	// the counted items with a TTL, soonest to expire first
+	expiries expiries
+}
+
+type keyEntry struct {
+	key       string
+	size      int64
+	deleted   bool
+	expiresAt time.Time
+	// whether the item is counted in its keyspace
+	counted bool
+}
+
+type keyCount struct {
+	keys  int
+	bytes int64
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{tokens: map[int]keyEntry{}, byKey: map[string]int{}, ordered: true, counts: map[string]keyCount{}}
+}
+
+// put indexes the key of the record, or forgets it when the record is removed
+func (k *keyIndex) put(r record) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if r.Removed {
+		k.remove(r.Token)
+		return
+	}
+	if old, ok := k.tokens[r.Token]; ok && old.key == r.Item.Key {
+		k.untally(old)
+	} else {
+		k.remove(r.Token)
+		if _, ok := k.byKey[r.Item.Key]; !ok {
+			k.added = append(k.added, r.Item.Key)
+			k.ordered = false
+		}
+	}
+
+	entry := keyEntry{key: r.Item.Key, size: r.Item.Size(), deleted: r.Item.Deleted, expiresAt: r.Item.ExpiresAt}
+	if !entry.deleted {
+		k.tally(r.Token, &entry)
+	}
+	k.tokens[r.Token] = entry
+	k.byKey[r.Item.Key] = r.Token
+}
+
+// stats returns the number and the size of the live items of the keyspace
+func (k *keyIndex) stats(keyspace string, now time.Time) (int, int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for len(k.expiries) > 0 && !now.Before(k.expiries[0].at) {
+		e := heap.Pop(&k.expiries).(expiry)
+		// the items written again since have an expiry of their own
+		entry, ok := k.tokens[e.token]
+		if ok && entry.counted && entry.expiresAt.Equal(e.at) {
+			k.untally(entry)
+			entry.counted = false
+			k.tokens[e.token] = entry
+		}
+	}
+	c := k.counts[keyspace]
+	return c.keys, c.bytes
+}
+
+// seek calls fn, in key order, with the keys which start with the prefix and sort
+// after the given key, and with their tokens, until fn returns false
+func (k *keyIndex) seek(prefix, after string, fn func(key string, token int) bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.added) > keysMergeSize || k.stale > len(k.sorted)/2 {
+		k.merge()
+	}
+	if !k.ordered {
+		sort.Strings(k.added)
+		k.ordered = true
+	}
+
+	first := func(keys []string) int {
+		return sort.Search(len(keys), func(i int) bool {
+			return keys[i] > after && keys[i] >= prefix
+		})
+	}
+	i, j, last := first(k.sorted), first(k.added), ""
+	for i < len(k.sorted) || j < len(k.added) {
+		var key string
+		if j == len(k.added) || (i < len(k.sorted) && k.sorted[i] <= k.added[j]) {
+			key, i = k.sorted[i], i+1
+		} else {
+			key, j = k.added[j], j+1
+		}
+		// the keys with the prefix are next to each other
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		// a key removed and added again is in both lists
+		if key == last {
+			continue
+		}
+		last = key
+
+		token, ok := k.byKey[key]
+		if ok && !fn(key, token) {
+			return
+		}
+	}
+}
+
+// count returns the number of indexed keys
+func (k *keyIndex) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.tokens)
+}
+
+func (k *keyIndex) remove(token int) {
+	entry, ok := k.tokens[token]
+	if !ok {
+		return
+	}
+	k.untally(entry)
+	delete(k.tokens, token)
+	if k.byKey[entry.key] == token {
+		delete(k.byKey, entry.key)
+		k.stale++
+	}
+}
+
+// tally counts the item in its keyspace
+func (k *keyIndex) tally(token int, entry *keyEntry) {
+	keyspace, _ := models.SplitKeyspaceKey(entry.key)
+	c := k.counts[keyspace]
+	c.keys, c.bytes = c.keys+1, c.bytes+entry.size
+	k.counts[keyspace] = c
+	entry.counted = true
+
+	if entry.expiresAt.IsZero() {
+		return
+	}
+	// the expiries of the items written again are only dropped once due,
+	// they are rebuilt when they outnumber the items
+	if len(k.expiries) > 2*len(k.tokens)+keysMergeSize {
+		k.expiries = k.expiries[:0]
+		for t, e := range k.tokens {
+			if e.counted && !e.expiresAt.IsZero() {
+				k.expiries = append(k.expiries, expiry{token: t, at: e.expiresAt})
+			}
+		}
+		heap.Init(&k.expiries)
+	}
+	heap.Push(&k.expiries, expiry{token: token, at: entry.expiresAt})
+}
+
+func (k *keyIndex) untally(entry keyEntry) {
+	if !entry.counted {
+		return
+	}
+	keyspace, _ := models.SplitKeyspaceKey(entry.key)
+	c := k.counts[keyspace]
+	c.keys, c.bytes = c.keys-1, c.bytes-entry.size
+	if c.keys == 0 {
+		delete(k.counts, keyspace)
+		return
+	}
+	k.counts[keyspace] = c
+}
+
+// merge moves the added keys into the sorted keys, dropping the removed ones
+func (k *keyIndex) merge() {
+	sort.Strings(k.added)
+	merged := make([]string, 0, len(k.byKey))
+	i, j := 0, 0
+	for i < len(k.sorted) || j < len(k.added) {
+		var key string
+		if j == len(k.added) || (i < len(k.sorted) && k.sorted[i] <= k.added[j]) {
+			key, i = k.sorted[i], i+1
+		} else {
+			key, j = k.added[j], j+1
+		}
+		if _, ok := k.byKey[key]; !ok || (len(merged) > 0 && merged[len(merged)-1] == key) {
+			continue
+		}
+		merged = append(merged, key)
+	}
+	k.sorted, k.added, k.ordered, k.stale = merged, nil, true, 0
+}
+
+type expiry struct {
+	token int
+	at    time.Time
+}
+
+// expiries is a min-heap of expiries, see container/heap
+type expiries []expiry
+
+func (e expiries) Len() int            { return len(e) }
+func (e expiries) Less(i, j int) bool  { return e[i].at.Before(e[j].at) }
+func (e expiries) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *expiries) Push(x interface{}) { *e = append(*e, x.(expiry)) }
+func (e *expiries) Pop() interface{} {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
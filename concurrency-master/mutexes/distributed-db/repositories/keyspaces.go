@@ -0,0 +1,122 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"distributed-db/models"
+)
+
+const keyspacesFile = "keyspaces.json"
+
+// NewKeyspaces opens the keyspaces known by the node, kept in a single
+// file of the data directory, so they survive restarts
+func NewKeyspaces(dataDir string) (*Keyspaces, error) {
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("could not create data directory: %w", err)
+	}
+
+	k := &Keyspaces{path: filepath.Join(dataDir, keyspacesFile), keyspaces: map[string]models.Keyspace{}}
+	keyspaces, err := readKeyspaces(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, keyspace := range keyspaces {
+		k.keyspaces[keyspace.Name] = keyspace
+	}
+	return k, nil
+}
+
+type Keyspaces struct {
+	mu        sync.RWMutex
+	path      string
+	keyspaces map[string]models.Keyspace
+}
+
+func (k *Keyspaces) Get(name string) (models.Keyspace, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keyspace, ok := k.keyspaces[name]
+	return keyspace, ok
+}
+
+// List returns the keyspaces sorted by name
+func (k *Keyspaces) List() []models.Keyspace {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.list()
+}
+
+// Merge keeps the newest definition of every keyspace
+// and saves the keyspaces when any of them changed
+func (k *Keyspaces) Merge(keyspaces []models.Keyspace) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changed := false
+	for _, keyspace := range keyspaces {
+		if old, ok := k.keyspaces[keyspace.Name]; ok && !keyspace.UpdatedAt.After(old.UpdatedAt) {
+			continue
+		}
+		k.keyspaces[keyspace.Name] = keyspace
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	err := writeJSON(k.path, k.list())
+	if err != nil {
+		return fmt.Errorf("could not save the keyspaces: %w", err)
+	}
+	return nil
+}
+
+// Backup writes the keyspaces into the directory of a backup part
+func (k *Keyspaces) Backup(dir string) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	err := writeJSON(filepath.Join(dir, keyspacesFile), k.list())
+	if err != nil {
+		return fmt.Errorf("could not back up the keyspaces: %w", err)
+	}
+	return nil
+}
+
+func (k *Keyspaces) list() []models.Keyspace {
+	keyspaces := make([]models.Keyspace, 0, len(k.keyspaces))
+	for _, keyspace := range k.keyspaces {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Slice(keyspaces, func(i, j int) bool {
+		return keyspaces[i].Name < keyspaces[j].Name
+	})
+	return keyspaces
+}
+
+// readKeyspaces reads the keyspaces kept in the directory, there are none without the file
+func readKeyspaces(dir string) ([]models.Keyspace, error) {
+	bs, err := os.ReadFile(filepath.Join(dir, keyspacesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the keyspaces: %w", err)
+	}
+
+	var keyspaces []models.Keyspace
+	err = json.Unmarshal(bs, &keyspaces)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the keyspaces: %w", err)
+	}
+	return keyspaces, nil
+}
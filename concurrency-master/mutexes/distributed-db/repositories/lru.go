@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"container/list"
+	"sync"
+
+	"distributed-db/models"
+)
+
+// lru keeps the items held in memory from the most to the least recently used,
+// with their approximate size. Dirty items are the ones of the MemTable,
+// the others are copies of items found on disk kept around for the next reads
+type lru struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[int]*list.Element
+	bytes   int64
+	dirty   int
+	hits    int64
+	misses  int64
+	spilled int64
+	dropped int64
+}
+
+type lruEntry struct {
+	token int
+	item  models.CacheItem
+	size  int64
+	dirty bool
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), entries: map[int]*list.Element{}}
+}
+
+// get returns the copy of the item, without counting as a use
+func (l *lru) get(token int) (models.CacheItem, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[token]
+	if !ok {
+		return models.CacheItem{}, false
+	}
+	return e.Value.(*lruEntry).item, true
+}
+
+// put keeps the item in memory as the most recently used one
+func (l *lru) put(token int, item models.CacheItem, dirty bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(token)
+	entry := &lruEntry{token: token, item: item, size: item.Size(), dirty: dirty}
+	l.entries[token] = l.order.PushFront(entry)
+	l.bytes += entry.size
+	if dirty {
+		l.dirty++
+	}
+}
+
+// touch marks the item as the most recently used one, counting the read
+// as a hit. Items read from disk are kept in memory when cache is set
+func (l *lru) touch(token int, item models.CacheItem, cache bool) {
+	l.mu.Lock()
+	e, ok := l.entries[token]
+	if ok {
+		l.hits++
+		l.order.MoveToFront(e)
+		l.mu.Unlock()
+		return
+	}
+	l.misses++
+	l.mu.Unlock()
+
+	if cache {
+		l.put(token, item, false)
+	}
+}
+
+func (l *lru) delete(token int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(token)
+}
+
+func (l *lru) over(limit int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.bytes > limit
+}
+
+// oldest returns the least recently used item when over the limit
+func (l *lru) oldest(limit int64) (lruEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.bytes <= limit || l.order.Len() == 0 {
+		return lruEntry{}, false
+	}
+	return *l.order.Back().Value.(*lruEntry), true
+}
+
+// flushed is called once the MemTable is on disk. Its items are kept
+// in memory as copies, unless keep is false
+func (l *lru) flushed(keep bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for token, e := range l.entries {
+		entry := e.Value.(*lruEntry)
+		switch {
+		case !entry.dirty:
+		case keep:
+			entry.dirty = false
+		default:
+			l.remove(token)
+		}
+	}
+	l.dirty = 0
+}
+
+// forget removes the copies of the items which match
+func (l *lru) forget(match func(item models.CacheItem) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for token, e := range l.entries {
+		entry := e.Value.(*lruEntry)
+		if !entry.dirty && match(entry.item) {
+			l.remove(token)
+		}
+	}
+}
+
+func (l *lru) evicted(dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dropped {
+		l.dropped++
+		return
+	}
+	l.spilled++
+}
+
+func (l *lru) stats() models.MemoryStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return models.MemoryStats{
+		Used:      l.bytes,
+		Items:     l.order.Len(),
+		Unflushed: l.dirty,
+		Hits:      l.hits,
+		Misses:    l.misses,
+		Spilled:   l.spilled,
+		Dropped:   l.dropped,
+	}
+}
+
+func (l *lru) remove(token int) {
+	e, ok := l.entries[token]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*lruEntry)
+	l.order.Remove(e)
+	delete(l.entries, token)
+	l.bytes -= entry.size
+	if entry.dirty {
+		l.dirty--
+	}
+}
@@ -0,0 +1,95 @@
+package repositories
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifest lists the SSTables making up the database, oldest first.
+// Rewriting it is the atomic step of every flush and compaction,
+// tables on disk which are not part of it are leftovers of a crash
+type manifest struct {
+	Generations []int `json:"generations"`
+}
+
+func manifestPath(dir string) string {
+	return filepath.Join(dir, "MANIFEST")
+}
+
+// readManifest reads the manifest of the data directory.
+// Directories created before the manifest existed get one
+// listing their SSTables in generation order
+func readManifest(dir string) (manifest, error) {
+	bs, err := os.ReadFile(manifestPath(dir))
+	if err == nil {
+		var m manifest
+		err = json.Unmarshal(bs, &m)
+		return m, err
+	}
+	if !os.IsNotExist(err) {
+		return manifest{}, err
+	}
+
+	generations, err := tableGenerations(dir)
+	if err != nil {
+		return manifest{}, err
+	}
+	m := manifest{Generations: generations}
+	return m, writeManifest(dir, m)
+}
+
+func writeManifest(dir string, m manifest) error {
+	return writeJSON(manifestPath(dir), m)
+}
+
+// writeJSON writes the file under a temporary name and renames it once synced
+func writeJSON(path string, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(bs)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tableGenerations lists the generations of the complete SSTables found on disk
+func tableGenerations(dir string) ([]int, error) {
+	summaries, err := filepath.Glob(filepath.Join(dir, "*.summary"))
+	if err != nil {
+		return nil, err
+	}
+
+	generations := make([]int, 0, len(summaries))
+	for _, summary := range summaries {
+		generation, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(summary), ".summary"))
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
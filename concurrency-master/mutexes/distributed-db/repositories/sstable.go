@@ -0,0 +1,375 @@
+package repositories
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"distributed-db/models"
+)
+
+const (
+	// token (8 bytes) + data offset (8 bytes) + flags (1 byte)
+	indexEntrySize = 17
+	// token (8 bytes) + index position (8 bytes)
+	summaryEntrySize = 16
+	// every N-th index entry makes it into the summary
+	summaryInterval = 64
+	flagRemoved     = 1
+)
+
+// record is what gets stored in the commit log and the SSTables.
+// Removed records shadow the older versions of the item found on disk
+type record struct {
+	Token   int              `json:"token"`
+	Item    models.CacheItem `json:"item"`
+	Removed bool             `json:"removed,omitempty"`
+}
+
+type indexEntry struct {
+	token   int
+	offset  int64
+	removed bool
+}
+
+type summaryEntry struct {
+	token    int
+	position int64
+}
+
+// sstable is an immutable sorted string table made out of 3 files:
+// DATA:    the records sorted by token, framed as [length uint32][json record]
+// INDEX:   fixed size entries mapping every token to its offset in the DATA file
+// SUMMARY: every N-th INDEX entry, kept in memory to know which part of the INDEX to read
+type sstable struct {
+	generation int
+	dir        string
+	data       *os.File
+	index      *os.File
+	summary    []summaryEntry
+	count      int64
+	size       int64
+}
+
+func tablePath(dir string, generation int, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.%s", generation, ext))
+}
+
+// writeSSTable writes the records (sorted by token) as a new SSTable.
+// The files are written under temporary names and renamed once synced.
+// The SUMMARY file is renamed last, which makes it the commit marker of the table
+func writeSSTable(dir string, generation int, records []record) (*sstable, error) {
+	w, err := newTableWriter(dir, generation)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		err = w.write(r)
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w.commit()
+}
+
+func openSSTable(dir string, generation int) (*sstable, error) {
+	bs, err := os.ReadFile(tablePath(dir, generation, "summary"))
+	if err != nil {
+		return nil, err
+	}
+	summary := make([]summaryEntry, 0, len(bs)/summaryEntrySize)
+	for i := 0; i+summaryEntrySize <= len(bs); i += summaryEntrySize {
+		summary = append(summary, summaryEntry{
+			token:    int(binary.BigEndian.Uint64(bs[i:])),
+			position: int64(binary.BigEndian.Uint64(bs[i+8:])),
+		})
+	}
+
+	data, err := os.Open(tablePath(dir, generation, "data"))
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.Open(tablePath(dir, generation, "index"))
+	if err != nil {
+		_ = data.Close()
+		return nil, err
+	}
+	dataInfo, err := data.Stat()
+	if err != nil {
+		_ = data.Close()
+		_ = index.Close()
+		return nil, err
+	}
+	indexInfo, err := index.Stat()
+	if err != nil {
+		_ = data.Close()
+		_ = index.Close()
+		return nil, err
+	}
+
+	t := &sstable{
+		generation: generation,
+		dir:        dir,
+		data:       data,
+		index:      index,
+		summary:    summary,
+		count:      indexInfo.Size() / indexEntrySize,
+		size:       dataInfo.Size(),
+	}
+	return t, nil
+}
+
+// find looks the token up using the SUMMARY to only read
+// the part of the INDEX where the token can be found
+func (t *sstable) find(token int) (indexEntry, bool, error) {
+	i := sort.Search(len(t.summary), func(i int) bool {
+		return t.summary[i].token > token
+	}) - 1
+	if i < 0 {
+		return indexEntry{}, false, nil
+	}
+
+	start := t.summary[i].position
+	end := start + summaryInterval
+	if end > t.count {
+		end = t.count
+	}
+	bs := make([]byte, (end-start)*indexEntrySize)
+	_, err := t.index.ReadAt(bs, start*indexEntrySize)
+	if err != nil {
+		return indexEntry{}, false, err
+	}
+
+	for j := 0; j < len(bs); j += indexEntrySize {
+		entry := decodeIndexEntry(bs[j:])
+		if entry.token == token {
+			return entry, true, nil
+		}
+		if entry.token > token {
+			break
+		}
+	}
+	return indexEntry{}, false, nil
+}
+
+// rangeEntries reads the INDEX entries of the tokens between from and to
+func (t *sstable) rangeEntries(from, to int) ([]indexEntry, error) {
+	i := sort.Search(len(t.summary), func(i int) bool {
+		return t.summary[i].token > from
+	}) - 1
+	position := int64(0)
+	if i >= 0 {
+		position = t.summary[i].position
+	}
+
+	entries := make([]indexEntry, 0)
+	for position < t.count {
+		end := position + summaryInterval
+		if end > t.count {
+			end = t.count
+		}
+		bs := make([]byte, (end-position)*indexEntrySize)
+		_, err := t.index.ReadAt(bs, position*indexEntrySize)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 0; j < len(bs); j += indexEntrySize {
+			entry := decodeIndexEntry(bs[j:])
+			if entry.token > to {
+				return entries, nil
+			}
+			if entry.token >= from {
+				entries = append(entries, entry)
+			}
+		}
+		position = end
+	}
+	return entries, nil
+}
+
+// entries reads the whole INDEX
+func (t *sstable) entries() ([]indexEntry, error) {
+	bs := make([]byte, t.count*indexEntrySize)
+	_, err := t.index.ReadAt(bs, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	entries := make([]indexEntry, 0, t.count)
+	for i := 0; i+indexEntrySize <= len(bs); i += indexEntrySize {
+		entries = append(entries, decodeIndexEntry(bs[i:]))
+	}
+	return entries, nil
+}
+
+func (t *sstable) read(offset int64) (record, error) {
+	var header [4]byte
+	_, err := t.data.ReadAt(header[:], offset)
+	if err != nil {
+		return record{}, err
+	}
+
+	bs := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, err = t.data.ReadAt(bs, offset+int64(len(header)))
+	if err != nil {
+		return record{}, err
+	}
+
+	var r record
+	err = json.Unmarshal(bs, &r)
+	return r, err
+}
+
+func (t *sstable) close() error {
+	if t.data == nil {
+		return nil
+	}
+	err := t.data.Close()
+	if err != nil {
+		return err
+	}
+	return t.index.Close()
+}
+
+// remove deletes the files of the table, the SUMMARY first
+// so a crash halfway through does not leave a half table behind
+func (t *sstable) remove() error {
+	_ = t.close()
+	for _, ext := range []string{"summary", "index", "data"} {
+		err := os.Remove(tablePath(t.dir, t.generation, ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeIndexEntry(bs []byte) indexEntry {
+	return indexEntry{
+		token:   int(binary.BigEndian.Uint64(bs)),
+		offset:  int64(binary.BigEndian.Uint64(bs[8:])),
+		removed: bs[16]&flagRemoved != 0,
+	}
+}
+
+// tableWriter writes an SSTable one record at a time,
+// the records have to be written sorted by token
+type tableWriter struct {
+	dir        string
+	generation int
+	files      map[string]*os.File
+	data       *bufio.Writer
+	index      *bufio.Writer
+	summary    *bufio.Writer
+	offset     int64
+	count      int64
+}
+
+func newTableWriter(dir string, generation int) (*tableWriter, error) {
+	w := &tableWriter{
+		dir:        dir,
+		generation: generation,
+		files:      map[string]*os.File{},
+	}
+	for _, ext := range []string{"data", "index", "summary"} {
+		file, err := os.Create(tablePath(dir, generation, ext) + ".tmp")
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+		w.files[ext] = file
+	}
+	w.data = bufio.NewWriter(w.files["data"])
+	w.index = bufio.NewWriter(w.files["index"])
+	w.summary = bufio.NewWriter(w.files["summary"])
+	return w, nil
+}
+
+func (w *tableWriter) write(r record) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(bs)))
+	_, err = w.data.Write(header[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.data.Write(bs)
+	if err != nil {
+		return err
+	}
+
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(r.Token))
+	binary.BigEndian.PutUint64(entry[8:], uint64(w.offset))
+	if r.Removed {
+		entry[16] = flagRemoved
+	}
+	_, err = w.index.Write(entry[:])
+	if err != nil {
+		return err
+	}
+
+	if w.count%summaryInterval == 0 {
+		var s [summaryEntrySize]byte
+		binary.BigEndian.PutUint64(s[:], uint64(r.Token))
+		binary.BigEndian.PutUint64(s[8:], uint64(w.count))
+		_, err = w.summary.Write(s[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	w.offset += int64(len(header) + len(bs))
+	w.count++
+	return nil
+}
+
+func (w *tableWriter) commit() (*sstable, error) {
+	for _, buf := range []*bufio.Writer{w.data, w.index, w.summary} {
+		err := buf.Flush()
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	for _, ext := range []string{"data", "index", "summary"} {
+		file := w.files[ext]
+		err := file.Sync()
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+		err = file.Close()
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	for _, ext := range []string{"data", "index", "summary"} {
+		path := tablePath(w.dir, w.generation, ext)
+		err := os.Rename(path+".tmp", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return openSSTable(w.dir, w.generation)
+}
+
+func (w *tableWriter) abort() {
+	for ext, file := range w.files {
+		_ = file.Close()
+		_ = os.Remove(tablePath(w.dir, w.generation, ext) + ".tmp")
+	}
+}
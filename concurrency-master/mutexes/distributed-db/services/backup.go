@@ -0,0 +1,194 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"distributed-db/models"
+)
+
+// Backup takes a backup of the whole cluster. Every node writes its part,
+// a consistent snapshot of its data taken without stopping the writes,
+// into its backup directory. The backup is only complete, and can only be
+// restored, once every node wrote its part and the list of the parts was
+// written by the current node. The parts end up in a single backup set when
+// the nodes share the backup directory, otherwise they have to be gathered
+func (svc CacheSvc) Backup() (models.BackupSet, error) {
+	if svc.backupsRepo == nil {
+		return models.BackupSet{}, fmt.Errorf("%w: the node has no backup directory", models.ErrInvalidRequest)
+	}
+
+	now := time.Now().UTC()
+	req := models.BackupRequest{ID: now.Format(models.BackupIDLayout), Time: now}
+
+	// down nodes are asked as well, the backup can't be complete without them
+	nodes := []string{svc.tokens.Nodes.Current()}
+	for _, node := range svc.tokens.Nodes.ListAll() {
+		if member, _ := svc.tokens.Nodes.Member(node); member.Status != models.NodeStatusLeft {
+			nodes = append(nodes, node)
+		}
+	}
+
+	type result struct {
+		node string
+		part models.BackupManifest
+		err  error
+	}
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			part, err := svc.backupNode(node, req)
+			results <- result{node: node, part: part, err: err}
+		}(node)
+	}
+
+	set, failed := models.BackupSet{ID: req.ID, Time: req.Time, Parts: make([]models.BackupManifest, 0, len(nodes))}, make([]string, 0)
+	for range nodes {
+		res := <-results
+		if res.err != nil {
+			log.Printf("could not back up node: %s, %v", res.node, res.err)
+			failed = append(failed, res.node)
+			continue
+		}
+		set.Parts = append(set.Parts, res.part)
+	}
+	if len(failed) > 0 {
+		return models.BackupSet{}, fmt.Errorf("%w: could not back up node(s): %s", models.ErrUnavailable, strings.Join(failed, ","))
+	}
+	sort.Slice(set.Parts, func(i, j int) bool {
+		return set.Parts[i].Node < set.Parts[j].Node
+	})
+
+	err := svc.backupsRepo.WriteSet(set)
+	if err != nil {
+		return models.BackupSet{}, fmt.Errorf("could not write backup: %s, %w", set.ID, err)
+	}
+	log.Printf("backup: %s of %d node(s) is complete", set.ID, len(set.Parts))
+	return set, nil
+}
+
+// BackupPart writes the part of the current node of the backup
+func (svc CacheSvc) BackupPart(req models.BackupRequest) (models.BackupManifest, error) {
+	if svc.backupsRepo == nil {
+		return models.BackupManifest{}, fmt.Errorf("%w: the node has no backup directory", models.ErrInvalidRequest)
+	}
+
+	m := models.BackupManifest{ID: req.ID, Node: svc.tokens.Nodes.Current(), Time: req.Time}
+	// the keyspaces are needed to make sense of the stored keys
+	m, err := svc.backupsRepo.WritePart(m, func(dir string) (int, int64, error) {
+		tables, bytes, err := svc.cacheRepo.Backup(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		return tables, bytes, svc.keyspacesRepo.Backup(dir)
+	})
+	if err != nil {
+		return models.BackupManifest{}, err
+	}
+	log.Printf("wrote %d sstable(s), %d byte(s) for backup: %s", m.Tables, m.Bytes, m.ID)
+	return m, nil
+}
+
+// Restore imports the parts of the nodes from a backup into the current node,
+// which must not hold any item yet. Restoring the part of the current node
+// rebuilds it, restoring the parts of all the nodes into one node rebuilds the
+// whole cluster. Either way, the items the current node does not own are streamed
+// to their owners, as when the node joins the ring. Without nodes, the part of the
+// current node is restored. It must run before the streamer starts
+func (svc CacheSvc) Restore(req models.RestoreRequest) (models.RestoreResponse, error) {
+	if svc.backupsRepo == nil {
+		return models.RestoreResponse{}, fmt.Errorf("%w: the node has no backup directory", models.ErrInvalidRequest)
+	}
+	if svc.cacheRepo.KeyCount() > 0 {
+		return models.RestoreResponse{}, fmt.Errorf("%w: the node already holds items, backups are restored into empty nodes", models.ErrInvalidRequest)
+	}
+
+	sets, err := svc.backupsRepo.Sets()
+	if err != nil {
+		return models.RestoreResponse{}, fmt.Errorf("could not list the backups: %w", err)
+	}
+	set, ok := pickBackup(sets, req.Backup)
+	if !ok {
+		return models.RestoreResponse{}, fmt.Errorf("%w: no complete backup matches: %s", models.ErrInvalidRequest, req.Backup)
+	}
+
+	parts := map[string]bool{}
+	for _, part := range set.Parts {
+		parts[part.Node] = true
+	}
+	nodes := req.Nodes
+	switch {
+	case req.AllNodes:
+		nodes = make([]string, 0, len(set.Parts))
+		for _, part := range set.Parts {
+			nodes = append(nodes, part.Node)
+		}
+	case len(nodes) == 0:
+		nodes = []string{svc.tokens.Nodes.Current()}
+	}
+	for _, node := range nodes {
+		if !parts[node] {
+			return models.RestoreResponse{}, fmt.Errorf("%w: backup: %s has no part for node: %s", models.ErrInvalidRequest, set.ID, node)
+		}
+	}
+
+	// last write wins, the newest version of the items found in several parts is kept,
+	// and the newest definition of the keyspaces
+	res := models.RestoreResponse{ID: set.ID, Nodes: nodes}
+	for _, node := range nodes {
+		keyspaces, err := svc.backupsRepo.ReadKeyspaces(set.ID, node)
+		if err != nil {
+			return models.RestoreResponse{}, fmt.Errorf("could not restore the keyspaces of node: %s, %w", node, err)
+		}
+		err = svc.keyspacesRepo.Merge(keyspaces)
+		if err != nil {
+			return models.RestoreResponse{}, fmt.Errorf("could not restore the keyspaces of node: %s, %w", node, err)
+		}
+
+		n, err := svc.backupsRepo.ReadPart(set.ID, node, func(items map[int]models.CacheItem) error {
+			_, err := svc.cacheRepo.Set(items)
+			return err
+		})
+		if err != nil {
+			return models.RestoreResponse{}, fmt.Errorf("could not restore the part of node: %s, %w", node, err)
+		}
+		res.Items += n
+	}
+	return res, nil
+}
+
+// pickBackup finds the backup by id, or the newest one taken by the given time
+func pickBackup(sets []models.BackupSet, backup string) (models.BackupSet, bool) {
+	if len(sets) == 0 {
+		return models.BackupSet{}, false
+	}
+	if backup == models.RestoreLatest {
+		return sets[len(sets)-1], true
+	}
+
+	at, err := time.Parse(time.RFC3339, backup)
+	if err != nil {
+		for _, set := range sets {
+			if set.ID == backup {
+				return set, true
+			}
+		}
+		return models.BackupSet{}, false
+	}
+	for i := len(sets) - 1; i >= 0; i-- {
+		if !sets[i].Time.After(at) {
+			return sets[i], true
+		}
+	}
+	return models.BackupSet{}, false
+}
+
+func (svc CacheSvc) backupNode(node string, req models.BackupRequest) (models.BackupManifest, error) {
+	if node == svc.tokens.Nodes.Current() {
+		return svc.BackupPart(req)
+	}
+	return svc.httpClient.BackupPart(node, req)
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestPickBackup selects the backup to restore among the complete ones, oldest first,
+// by the latest keyword, by id and by time, the time picking the newest backup taken by then
+func TestPickBackup(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sets := make([]models.BackupSet, 0)
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		sets = append(sets, models.BackupSet{ID: at.Format(models.BackupIDLayout), Time: at})
+	}
+
+	for _, test := range []struct {
+		backup string
+		want   int
+	}{
+		{backup: models.RestoreLatest, want: 2},
+		{backup: sets[1].ID, want: 1},
+		{backup: start.Add(90 * time.Minute).Format(time.RFC3339), want: 1},
+		{backup: start.Add(2 * time.Hour).Format(time.RFC3339), want: 2},
+		{backup: start.Add(-time.Minute).Format(time.RFC3339), want: -1},
+		{backup: "unknown", want: -1},
+	} {
+		set, ok := pickBackup(sets, test.backup)
+		switch {
+		case test.want < 0 && ok:
+			t.Fatalf("expected no backup for: %s, got: %s", test.backup, set.ID)
+		case test.want >= 0 && (!ok || set.ID != sets[test.want].ID):
+			t.Fatalf("expected backup: %s for: %s, got: %s, %v", sets[test.want].ID, test.backup, set.ID, ok)
+		}
+	}
+	if _, ok := pickBackup(nil, models.RestoreLatest); ok {
+		t.Fatal("expected no backup without any complete backup")
+	}
+}
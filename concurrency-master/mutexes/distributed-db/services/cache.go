@@ -1,6 +1,8 @@
 package services
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
@@ -11,144 +13,329 @@ import (
 
 type CacheRepository interface {
 	Get(keys []int) []models.CacheItem
-	Set(items map[int]models.CacheItem)
-	Delete(keys []int)
-	GetAllKeys() []int
+	Set(items map[int]models.CacheItem) (map[int]models.CacheItem, error)
+	Delete(keys []int) error
+	KeyCount() int
+	Scan(from, to int) map[int]models.CacheItem
+	ScanKeys(prefix, after string, limit int, match func(key string) bool) []models.CacheItem
+	CountKeys(keyspace string) (int, int64)
+	PurgeTombstones(before time.Time) int
+	PurgeExpired(now time.Time) int
+	Compact(tombstonesBefore time.Time, bytesPerSecond int64) (models.CompactionStats, error)
+	Stats() models.MemoryStats
+	Backup(dir string) (int, int64, error)
+}
+
+type HintsRepository interface {
+	Add(node string, token int, item models.CacheItem) error
+	Nodes() []string
+	Replay(node string, send func(items map[int]models.CacheItem) error) (int, error)
+	Prune() int
+}
+
+type BackupRepository interface {
+	WritePart(m models.BackupManifest, write func(dir string) (int, int64, error)) (models.BackupManifest, error)
+	WriteSet(set models.BackupSet) error
+	Sets() ([]models.BackupSet, error)
+	ReadPart(id, node string, fn func(items map[int]models.CacheItem) error) (int, error)
+	ReadKeyspaces(id, node string) ([]models.Keyspace, error)
+}
+
+type KeyspaceRepository interface {
+	Get(name string) (models.Keyspace, bool)
+	List() []models.Keyspace
+	Merge(keyspaces []models.Keyspace) error
+	Backup(dir string) error
 }
 
 type HTTPClient interface {
-	Get(node string, keys []string) ([]models.CacheItem, error)
-	Set(node, key, value string) (models.CacheItem, error)
+	Get(node string, req models.GetRequest) ([]models.CacheItem, error)
+	Set(node string, req models.SetRequest) (models.CacheItem, error)
 	SetBatch(node string, items map[int]models.CacheItem) ([]models.CacheItem, error)
-	Gossip(node string, newNodes models.NodesMap, tokensChecksum string) (oldNodes models.NodesMap, err error)
+	Gossip(node string, req models.GossipRequest) (models.GossipResponse, error)
+	Ping(node string, req models.PingRequest, timeout time.Duration) (models.PingResponse, error)
+	IndirectPing(node string, req models.IndirectPingRequest, timeout time.Duration) (models.PingResponse, error)
 	Tokens(node string) (models.TokenMappings, error)
+	MerkleTree(node string, req models.MerkleRequest) (models.MerkleTree, error)
+	RangeItems(node string, ranges []models.TokenRange) (map[int]models.CacheItem, error)
+	Scan(node string, req models.ScanRequest) (models.ScanResponse, error)
+	CAS(node string, req models.CASRequest) (models.CASResponse, error)
+	Prepare(node string, req models.PrepareRequest) (models.PrepareResponse, error)
+	Propose(node string, req models.ProposeRequest) (models.ProposeResponse, error)
+	Commit(node string, req models.CommitRequest) (models.CommitResponse, error)
+	// Changes is a long poll, it gives up on the node once the context is done
+	Changes(ctx context.Context, node string, req models.ChangesRequest) (models.ChangesResponse, error)
+	BackupPart(node string, req models.BackupRequest) (models.BackupManifest, error)
 }
 
-func NewCache(cacheRepo CacheRepository, httpClient HTTPClient, tokens *models.Tokens) CacheSvc {
+// NewCache creates the cache service. The replication factor
+// is used for the requests which don't specify one.
+// Without a backup repository, the node can't take backups
+func NewCache(cacheRepo CacheRepository, hintsRepo HintsRepository, backupsRepo BackupRepository, keyspacesRepo KeyspaceRepository, httpClient HTTPClient, tokens *models.Tokens, changes *models.Changes, metrics *models.Metrics, replicationFactor int) CacheSvc {
 	return CacheSvc{
-		cacheRepo:  cacheRepo,
-		httpClient: httpClient,
-		tokens:     tokens,
+		cacheRepo:         cacheRepo,
+		hintsRepo:         hintsRepo,
+		backupsRepo:       backupsRepo,
+		keyspacesRepo:     keyspacesRepo,
+		httpClient:        httpClient,
+		tokens:            tokens,
+		changes:           changes,
+		metrics:           metrics,
+		replicationFactor: replicationFactor,
+		decommission:      &decommission{left: make(chan struct{})},
+		cas:               newConsensus(),
 		//hashCache => local cache for generated hashes and the server they belong to
 		// save a bit of computational time
 	}
 }
 
 type CacheSvc struct {
-	cacheRepo  CacheRepository
-	httpClient HTTPClient
-	tokens     *models.Tokens
+	cacheRepo         CacheRepository
+	hintsRepo         HintsRepository
+	backupsRepo       BackupRepository
+	keyspacesRepo     KeyspaceRepository
+	httpClient        HTTPClient
+	tokens            *models.Tokens
+	changes           *models.Changes
+	metrics           *models.Metrics
+	replicationFactor int
+	decommission      *decommission
+	cas               *consensus
 }
 
-func (svc CacheSvc) Get(keys []string) []models.CacheItem {
-	// there's a problem here when having foreign records (stolen tokens) on current node
-	// lookup current node anyways
-	keyToNode := map[string]string{}
-	tokenToNode := map[int]string{}
-	for _, key := range keys {
-		token := int(models.HashKey(key))
-		node := svc.tokens.GetNode(token)
-		tokenToNode[token] = node
-		keyToNode[key] = node
+// Get reads every key from as many replicas as the consistency level requires.
+// The full item is read from a single replica and only digests from the others.
+// When the digests disagree, the newest version is returned and written back
+// in the background to the replicas which lagged behind (read repair).
+// The items written to another node while their owner was unreachable (stolen
+// tokens) are also read from the node holding them, until it hands them back.
+// The holder does not count towards the consistency level, its copy is only
+// returned when it is newer than the copy of the replicas.
+// The replicas are asked for the stored keys, with tombstones
+func (svc CacheSvc) Get(req models.GetRequest) (models.GetResponse, error) {
+	if req.Tombstones {
+		return svc.get(req)
 	}
 
-	nodeToTokens := map[string][]int{}
-	for token, node := range tokenToNode {
-		nodeToTokens[node] = append(nodeToTokens[node], token)
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return models.GetResponse{}, err
+	}
+	req.Keys, err = storedKeys(keyspace, req.Keys)
+	if err != nil {
+		return models.GetResponse{}, err
 	}
-	nodeToKeys := map[string][]string{}
-	for key, node := range keyToNode {
-		nodeToKeys[node] = append(nodeToKeys[node], key)
+	if req.ReplicationFactor == 0 {
+		req.ReplicationFactor = keyspace.ReplicationFactor
+	}
+	if req.ConsistencyLevel == "" {
+		req.ConsistencyLevel = keyspace.ConsistencyLevel
 	}
 
-	cacheItems := make([]models.CacheItem, 0)
-	for node, tokens := range nodeToTokens {
-		if node == svc.tokens.Nodes.Current() {
-			items := svc.cacheRepo.Get(tokens)
-			for _, item := range items {
-				item.Node = node
-				cacheItems = append(cacheItems, item)
-			}
-			continue
-		}
+	res, err := svc.get(req)
+	if err != nil {
+		return models.GetResponse{}, err
+	}
+	for i, item := range res.Items {
+		res.Items[i] = clientItem(keyspace, item)
+	}
+	return res, nil
+}
 
-		nodeKeys := nodeToKeys[node]
-		items, err := svc.httpClient.Get(node, nodeKeys)
+func (svc CacheSvc) get(req models.GetRequest) (models.GetResponse, error) {
+	reads, holderKeys := map[string]*keyRead{}, map[string][]string{}
+	for _, key := range req.Keys {
+		token := int(models.HashKey(key))
+		replicas := svc.replicas(token, req.ReplicationFactor)
+		acks, err := req.ConsistencyLevel.Acks(len(replicas))
 		if err != nil {
-			log.Printf("could not get cache items from node: %s, %v", node, err)
-			continue
+			return models.GetResponse{}, err
 		}
-
-		for _, item := range items {
-			item.Node = node
-			cacheItems = append(cacheItems, item)
+		holder, ok := svc.foreignNode(token)
+		if ok && !contains(replicas, holder) {
+			holderKeys[holder] = append(holderKeys[holder], key)
 		}
+		replicas = svc.preferCurrent(replicas)
+		reads[key] = &keyRead{token: token, replicas: replicas, acks: acks, digests: map[string]string{}}
 	}
+	held := make(chan []readResult, 1)
+	go func() {
+		held <- svc.readReplicas(holderKeys, nil, req.ReplicationFactor)
+	}()
+
+	// ask as many replicas as the consistency level requires for every key
+	// and fall back to the next replicas for the keys of the nodes that failed
+	for {
+		dataKeys, digestKeys := map[string][]string{}, map[string][]string{}
+		for key, read := range reads {
+			pending := 0
+			if !read.hasData && read.next < len(read.replicas) {
+				node := read.replicas[read.next]
+				dataKeys[node] = append(dataKeys[node], key)
+				read.next++
+				pending++
+			}
+			for need := read.acks - read.responses - pending; need > 0 && read.next < len(read.replicas); need-- {
+				node := read.replicas[read.next]
+				digestKeys[node] = append(digestKeys[node], key)
+				read.next++
+			}
+		}
+		if len(dataKeys) == 0 && len(digestKeys) == 0 {
+			break
+		}
 
-	// TOKEN STEALING
-	// SET and SET BATCH
-	// add foreign tokens to gossip data
-	// once the data is successfully streamed remove it from foreign tokens
+		for _, res := range svc.readReplicas(dataKeys, digestKeys, req.ReplicationFactor) {
+			if res.err != nil {
+				log.Printf("could not get cache items from node: %s, %v", res.node, res.err)
+				continue
+			}
 
-	// GET
-	// when getting data from a coordinator:
-	// 1. check local node
-	// 2. check the node which has foreign token
-	// 3. check the node which contains the data
-	// also when making request verify the node status
+			found := map[string]models.CacheItem{}
+			for _, item := range res.items {
+				found[item.Key] = item
+			}
+			for _, key := range res.keys {
+				read := reads[key]
+				item, ok := found[key]
+				read.responses++
+				if res.digest {
+					read.digests[res.node] = item.Digest
+					continue
+				}
 
-	return cacheItems
-}
+				read.hasData, read.dataNode = true, res.node
+				if ok {
+					item.Node = res.node
+					read.item, read.found = item, true
+				}
+			}
+		}
+	}
 
-func (svc CacheSvc) Set(key, value string) (models.CacheItem, error) {
-	token := int(models.HashKey(key))
-	node := svc.tokens.GetNode(token)
-	if node == svc.tokens.Nodes.Current() {
-		item := models.CacheItem{
-			Key:       key,
-			Value:     value,
-			UpdatedAt: time.Now().UTC(),
+	unavailable := make([]string, 0)
+	for _, key := range req.Keys {
+		read := reads[key]
+		if read.responses < read.acks || !read.hasData {
+			unavailable = append(unavailable, key)
 		}
+	}
+	if len(unavailable) > 0 {
+		return models.GetResponse{}, fmt.Errorf("%w: not enough replicas responded for key(s): %s", models.ErrUnavailable, clientKeys(unavailable))
+	}
 
-		svc.cacheRepo.Set(map[int]models.CacheItem{token: item})
-		item.Node = node
+	res := models.GetResponse{
+		Items:       make([]models.CacheItem, 0),
+		ReadRepairs: svc.readRepair(reads, req.ReplicationFactor),
+	}
+	// the holders hand their newer copies back to the replicas themselves
+	for _, held := range <-held {
+		if held.err != nil {
+			log.Printf("could not get cache items from holder: %s, %v", held.node, held.err)
+			continue
+		}
+		for _, item := range held.items {
+			read := reads[item.Key]
+			if read.found && !item.UpdatedAt.After(read.item.UpdatedAt) {
+				continue
+			}
+			item.Node = held.node
+			read.item, read.found = item, true
+		}
+	}
+	for _, key := range req.Keys {
+		read := reads[key]
+		if !read.found || (read.item.Deleted && !req.Tombstones) {
+			continue
+		}
+		item := read.item
+		if req.Digests {
+			item.Digest, item.Value = models.Digest(item), ""
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
 
-		return item, nil
+// Set writes the item, the defaults of its keyspace apply to what the request leaves out
+func (svc CacheSvc) Set(req models.SetRequest) (models.CacheItem, error) {
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return models.CacheItem{}, err
+	}
+	key, err := storedKey(keyspace, req.Key)
+	if err != nil {
+		return models.CacheItem{}, err
 	}
+	if req.ReplicationFactor == 0 {
+		req.ReplicationFactor = keyspace.ReplicationFactor
+	}
+	if req.ConsistencyLevel == "" {
+		req.ConsistencyLevel = keyspace.ConsistencyLevel
+	}
+	if req.TTL == 0 {
+		req.TTL = keyspace.TTL
+	}
+
+	token := int(models.HashKey(key))
+	replicas := svc.replicas(token, req.ReplicationFactor)
+	item := models.CacheItem{
+		Key:               key,
+		Value:             req.Value,
+		UpdatedAt:         time.Now().UTC(),
+		ReplicationFactor: len(replicas),
+	}
+	if req.TTL > 0 {
+		item.ExpiresAt = item.UpdatedAt.Add(time.Duration(req.TTL))
+	}
+
+	acked, err := svc.write(token, item, replicas, req.ConsistencyLevel)
+	if err != nil {
+		return models.CacheItem{}, err
+	}
+	item.Replicas = acked
+	item.Node = replicas[0]
 
-	// save the record no matter what and retry in the background
-	// if retry has failed x amount of times, apply token range stealing
-	// if retry has succeeded, remove the item from the current node
-	return svc.httpClient.Set(node, key, value)
+	return clientItem(keyspace, item), nil
 }
 
-func (svc CacheSvc) SetBatch(items map[int]models.CacheItem) []models.CacheItem {
+// SetBatch stores the items the current node replicates and forwards the others
+// to their owners. The items of an unreachable owner are kept for it, it fails
+// when the items can't be stored on the current node
+func (svc CacheSvc) SetBatch(items map[int]models.CacheItem) ([]models.CacheItem, error) {
 	resItems := make([]models.CacheItem, 0)
 	localItems := map[int]models.CacheItem{}
 	nodesToForeignItems := map[string]map[int]models.CacheItem{}
 	setNode := func(items []models.CacheItem, node string) {
-		for _, item := range items {
-			item.Node = node
+		for i := range items {
+			items[i].Node = node
 		}
 	}
 
 	// split items into local items and foreign items
-	// local items => belong to current node
+	// local items => current node is one of their replicas
 	// map of nodes to foreign items => belong to different nodes
 	for token, item := range items {
-		node := svc.tokens.GetNode(token)
-		if node == svc.tokens.Nodes.Current() {
+		replicas := svc.replicas(token, item.ReplicationFactor)
+		if len(replicas) == 0 || contains(replicas, svc.tokens.Nodes.Current()) {
 			localItems[token] = item
-			item.Node = node
+			item.Node = svc.tokens.Nodes.Current()
 			resItems = append(resItems, item)
 			continue
 		}
 
+		node := replicas[0]
+		if nodesToForeignItems[node] == nil {
+			nodesToForeignItems[node] = map[int]models.CacheItem{}
+		}
 		nodesToForeignItems[node][token] = item
 	}
 	// save local items on the current node
 	if len(localItems) > 0 {
-		svc.cacheRepo.Set(localItems)
+		err := svc.store(localItems)
+		if err != nil {
+			return nil, fmt.Errorf("could not store batch: %w", err)
+		}
 	}
 
 	// attempt to save foreign items on each node they belong to
@@ -159,21 +346,124 @@ func (svc CacheSvc) SetBatch(items map[int]models.CacheItem) []models.CacheItem
 			// if batch call failed, save the items on the current node
 			// they will get redistributed by the streamer worker anyways
 			log.Printf("could not set batch for node %s: %v", node, err)
-			svc.cacheRepo.Set(foreignItems)
+			err = svc.store(foreignItems)
+			if err != nil {
+				return nil, fmt.Errorf("could not keep the batch of node: %s, %w", node, err)
+			}
 			svc.tokens.SetForeignTokens(foreignItems, svc.tokens.Nodes.Current())
+			for token := range foreignItems {
+				svc.tokens.MarkMoved(models.TokenRange{From: token, To: token})
+			}
+			for _, item := range foreignItems {
+				batchItems = append(batchItems, item)
+			}
 			setNode(batchItems, svc.tokens.Nodes.Current())
 		}
 
 		resItems = append(resItems, batchItems...)
 	}
 
-	return resItems
+	return resItems, nil
 }
 
-func (svc CacheSvc) Delete(keys []string) {
+// Delete writes a tombstone for every key on all of its replicas.
+// Tombstones are regular items, so they win over older values
+// and get streamed like any other item, until they get purged
+func (svc CacheSvc) Delete(req models.DeleteRequest) error {
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return err
+	}
+	keys, err := storedKeys(keyspace, req.Keys)
+	if err != nil {
+		return err
+	}
+	if req.ReplicationFactor == 0 {
+		req.ReplicationFactor = keyspace.ReplicationFactor
+	}
+	if req.ConsistencyLevel == "" {
+		req.ConsistencyLevel = keyspace.ConsistencyLevel
+	}
+
 	// also implement retry mechanism
-	// implement tombstone and make it short-lived
-	// think about if necessary to gossip tombstone
+	now := time.Now().UTC()
+	for _, key := range keys {
+		token := int(models.HashKey(key))
+		replicas := svc.replicas(token, req.ReplicationFactor)
+		tombstone := models.CacheItem{
+			Key:               key,
+			UpdatedAt:         now,
+			ReplicationFactor: len(replicas),
+			Deleted:           true,
+		}
+
+		_, err := svc.write(token, tombstone, replicas, req.ConsistencyLevel)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeTombstones removes the tombstones older than the grace period
+func (svc CacheSvc) PurgeTombstones(grace time.Duration) {
+	purged := svc.cacheRepo.PurgeTombstones(time.Now().UTC().Add(-grace))
+	if purged > 0 {
+		log.Printf("purged %d tombstone(s)", purged)
+	}
+}
+
+// PurgeExpired replaces the items whose TTL has passed with tombstones
+func (svc CacheSvc) PurgeExpired() {
+	purged := svc.cacheRepo.PurgeExpired(time.Now().UTC())
+	if purged > 0 {
+		log.Printf("purged %d expired item(s)", purged)
+	}
+}
+
+// Compact merges the stored tables, dropping the tombstones older than the grace period
+func (svc CacheSvc) Compact(grace time.Duration, bytesPerSecond int64) {
+	stats, err := svc.cacheRepo.Compact(time.Now().UTC().Add(-grace), bytesPerSecond)
+	if err != nil {
+		log.Printf("could not compact sstables: %v", err)
+		return
+	}
+	if stats.Tables == 0 {
+		return
+	}
+
+	log.Printf(
+		"compacted %d sstable(s) in %v: %d => %d byte(s), %d => %d record(s), dropped %d overwritten, %d tombstone(s), %d expired",
+		stats.Tables, stats.Duration, stats.BytesIn, stats.BytesOut, stats.RecordsIn, stats.RecordsOut,
+		stats.DroppedOverwritten, stats.DroppedTombstones, stats.DroppedExpired,
+	)
+}
+
+// ReplayHints sends the hinted writes to the replicas which are back up,
+// the expired hints of the replicas which are still down are dropped
+func (svc CacheSvc) ReplayHints() {
+	if pruned := svc.hintsRepo.Prune(); pruned > 0 {
+		log.Printf("dropped %d expired hint(s)", pruned)
+	}
+
+	nodes := svc.tokens.Nodes.Map()
+	for _, node := range svc.hintsRepo.Nodes() {
+		if nodes[node] != models.NodeStatusUp {
+			continue
+		}
+
+		sent, err := svc.hintsRepo.Replay(node, func(items map[int]models.CacheItem) error {
+			_, err := svc.httpClient.SetBatch(node, items)
+			return err
+		})
+		if err != nil {
+			log.Printf("could not replay hints to node: %s, %v", node, err)
+		}
+		if sent > 0 {
+			log.Printf("replayed %d hint(s) to node: %s", sent, node)
+		}
+	}
 }
 
 func (svc CacheSvc) Gossip() {
@@ -183,58 +473,100 @@ func (svc CacheSvc) Gossip() {
 	}
 
 	log.Println("gossiping to:", strings.Join(nodes, ","))
+	failures := 0
+	defer func() {
+		svc.metrics.GossipRound(failures)
+	}()
 	for _, node := range nodes {
-		oldNodes, err := svc.httpClient.Gossip(node, svc.tokens.Nodes.Map(), svc.tokens.Checksum())
+		// unreachable nodes are left to the failure detector
+		err := svc.gossip(node)
 		if err != nil {
 			log.Printf("could not make http call for gossip: %v", err)
-			svc.tokens.Nodes.Fail(node)
-			continue
+			failures++
 		}
+	}
+}
+
+// gossip exchanges the members, the stolen tokens and the keyspaces with the node
+func (svc CacheSvc) gossip(node string) error {
+	req := models.GossipRequest{
+		Members:        svc.tokens.Nodes.Members(),
+		TokensChecksum: svc.tokens.Checksum(),
+		ForeignTokens:  svc.tokens.ForeignTokens(svc.tokens.Nodes.Current()),
+		Keyspaces:      svc.keyspacesRepo.List(),
+	}
+	res, err := svc.httpClient.Gossip(node, req)
+	if err != nil {
+		return err
+	}
+
+	svc.tokens.Nodes.Merge(res.Members)
+	svc.tokens.ReplaceForeignTokens(node, res.ForeignTokens)
+	svc.mergeKeyspaces(res.Keyspaces)
+	return nil
+}
 
-		svc.tokens.Nodes.Set(oldNodes)
+// Stats shows the memory of the node, and the items it stores for the keyspace when one is given
+func (svc CacheSvc) Stats(keyspace string) (models.StatsResponse, error) {
+	res := models.StatsResponse{
+		Node:   svc.tokens.Nodes.Current(),
+		Memory: svc.cacheRepo.Stats(),
+	}
+	if keyspace != "" {
+		stats, err := svc.KeyspaceStats(keyspace)
+		if err != nil {
+			return models.StatsResponse{}, err
+		}
+		res.Keyspace = &stats
 	}
+	return res, nil
 }
 
 func (svc CacheSvc) GetTokens() map[int]string {
-	return svc.tokens.Mappings
+	return svc.tokens.Mappings()
 }
 
-func (svc CacheSvc) UpdateTokens(node string, newNodes models.NodesMap, tokensChecksum string) (models.NodesMap, error) {
-	svc.tokens.Nodes.Gossip(node)
-	svc.tokens.Nodes.Set(newNodes)
+func (svc CacheSvc) UpdateTokens(node string, req models.GossipRequest) (models.GossipResponse, error) {
+	svc.tokens.Nodes.Merge(req.Members)
+	svc.tokens.ReplaceForeignTokens(node, req.ForeignTokens)
+	svc.mergeKeyspaces(req.Keyspaces)
 
-	if svc.tokens.Checksum() != tokensChecksum {
+	if svc.tokens.Checksum() != req.TokensChecksum {
 		tokens, err := svc.httpClient.Tokens(node)
 		if err != nil {
-			return models.NodesMap{}, err
+			return models.GossipResponse{}, err
 		}
 		svc.tokens.Merge(tokens)
 	}
 
-	return svc.tokens.Nodes.Map(), nil
+	res := models.GossipResponse{
+		Members:       svc.tokens.Nodes.Members(),
+		ForeignTokens: svc.tokens.ForeignTokens(svc.tokens.Nodes.Current()),
+		Keyspaces:     svc.keyspacesRepo.List(),
+	}
+	return res, nil
 }
 
 func (svc CacheSvc) Stream(retryBatches map[string]map[int]models.CacheItem) map[string]map[int]models.CacheItem {
-	keys := svc.cacheRepo.GetAllKeys()
-
 	// LOOKUP NEW ITEMS
+	// only the ranges moved by the ring changes are looked up. Their items
+	// are streamed to all of their replicas once the current node is no longer one of them
 	tryingToStream, nodeToBatches := 0, retryBatches
-	for _, token := range keys {
-		node := svc.tokens.GetNode(token)
-		if node != svc.tokens.Nodes.Current() {
-			continue
-		}
-
-		items := svc.cacheRepo.Get([]int{token})
-		if len(items) == 0 {
-			continue
-		}
+	for _, r := range svc.tokens.TakeMoved() {
+		for token, item := range svc.cacheRepo.Scan(r.From, r.To) {
+			replicas := svc.replicas(token, item.ReplicationFactor)
+			if len(replicas) == 0 || contains(replicas, svc.tokens.Nodes.Current()) {
+				continue
+			}
 
-		if nodeToBatches[node] == nil {
-			nodeToBatches[node] = map[int]models.CacheItem{}
+			for _, node := range replicas {
+				if nodeToBatches[node] == nil {
+					nodeToBatches[node] = map[int]models.CacheItem{}
+				}
+				nodeToBatches[node][token] = item
+			}
+			tryingToStream++
 		}
-		nodeToBatches[node][token] = items[0]
-		tryingToStream++
 	}
 	if tryingToStream > 0 {
 		log.Printf("trying to stream %d new item(s)", tryingToStream)
@@ -275,8 +607,11 @@ func (svc CacheSvc) Stream(retryBatches map[string]map[int]models.CacheItem) map
 	}
 
 	// START BATCH STREAMING
-	failedToStream, failedBatches := 0, map[string]map[int]models.CacheItem{}
+	var mu sync.Mutex
+	streamed, failedToStream, failedBatches := 0, 0, map[string]map[int]models.CacheItem{}
 	failBatch := func(node string, batchItems map[int]models.CacheItem) {
+		mu.Lock()
+		defer mu.Unlock()
 		for token, item := range batchItems {
 			if failedBatches[node] == nil {
 				failedBatches[node] = map[int]models.CacheItem{}
@@ -288,28 +623,217 @@ func (svc CacheSvc) Stream(retryBatches map[string]map[int]models.CacheItem) map
 
 	var wg sync.WaitGroup
 	maxConcurrentBatches := 10
-	for i := 0; i < len(batches); i += maxConcurrentBatches {
-
-	}
-
-	for i, b := range batches {
+	sem := make(chan struct{}, maxConcurrentBatches)
+	for _, b := range batches {
 		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		sem <- struct{}{}
+		go func(b batch) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
 			_, err := svc.httpClient.SetBatch(b.node, b.items)
 			if err != nil {
+				log.Printf("could not stream batch to node: %s, %v", b.node, err)
 				failBatch(b.node, b.items)
+				return
+			}
+			log.Printf("successfully streamed %d item(s) to node: %s", len(b.keysToDelete), b.node)
+			mu.Lock()
+			streamed += len(b.items)
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+	svc.metrics.Streamed(streamed, failedToStream)
+
+	// only remove the items that reached all of their replicas
+	keysToDelete := make([]int, 0)
+	for _, b := range batches {
+		for _, token := range b.keysToDelete {
+			if failed(failedBatches, token) {
+				continue
 			}
-			svc.cacheRepo.Delete(b.keysToDelete)
-			log.Printf("successfully streamed %d items", b.keysToDelete)
-		}()
-		if i%maxConcurrentBatches == 0 {
-			wg.Wait()
+			keysToDelete = append(keysToDelete, token)
 		}
 	}
+	err := svc.cacheRepo.Delete(keysToDelete)
+	if err != nil {
+		log.Printf("could not remove the streamed items: %v", err)
+	} else {
+		// the items written for unreachable owners are back with them
+		svc.tokens.DeleteForeignTokens(keysToDelete)
+	}
 
 	if failedToStream > 0 {
 		log.Printf("failed to stream %d items", failedToStream)
 	}
 	return failedBatches
 }
+
+func (svc CacheSvc) replicas(token, replicationFactor int) []string {
+	if replicationFactor < 1 {
+		replicationFactor = svc.replicationFactor
+	}
+	return svc.tokens.GetNodes(token, replicationFactor)
+}
+
+// foreignNode returns the node holding the items of the token for its owner,
+// as long as the node can be reached
+func (svc CacheSvc) foreignNode(token int) (string, bool) {
+	node, ok := svc.tokens.ForeignNode(token)
+	if !ok || node == svc.tokens.Nodes.Current() {
+		return node, ok
+	}
+	member, ok := svc.tokens.Nodes.Member(node)
+	return node, ok && member.Status != models.NodeStatusDown && member.Status != models.NodeStatusLeft
+}
+
+// preferCurrent moves the current node in front of the other replicas
+// to avoid a network call when the data is available locally
+func (svc CacheSvc) preferCurrent(replicas []string) []string {
+	nodes := make([]string, 0, len(replicas))
+	for _, node := range replicas {
+		if node == svc.tokens.Nodes.Current() {
+			nodes = append([]string{node}, nodes...)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (svc CacheSvc) getReplica(node string, keys []string, replicationFactor int, digests bool) ([]models.CacheItem, error) {
+	if node == svc.tokens.Nodes.Current() {
+		tokens := make([]int, 0, len(keys))
+		for _, key := range keys {
+			tokens = append(tokens, int(models.HashKey(key)))
+		}
+		items := svc.cacheRepo.Get(tokens)
+		if digests {
+			for i := range items {
+				items[i].Digest, items[i].Value = models.Digest(items[i]), ""
+			}
+		}
+		return items, nil
+	}
+
+	// replicas only have to answer for themselves
+	// and tombstones are needed to find the newest value
+	req := models.GetRequest{
+		Keys:              keys,
+		ReplicationFactor: replicationFactor,
+		ConsistencyLevel:  models.ConsistencyLevelOne,
+		Tombstones:        true,
+		Digests:           digests,
+	}
+	return svc.httpClient.Get(node, req)
+}
+
+// write stores the item on its replicas and waits for as many
+// acknowledgements as the consistency level requires.
+// It returns the replicas that acknowledged the write in ring order
+func (svc CacheSvc) write(token int, item models.CacheItem, replicas []string, level models.ConsistencyLevel) ([]string, error) {
+	if len(replicas) == 0 {
+		return []string{}, fmt.Errorf("%w: no replicas found for key: %s", models.ErrUnavailable, item.Key)
+	}
+	acks, err := level.Acks(len(replicas))
+	if err != nil {
+		return []string{}, err
+	}
+
+	// the results channel is buffered, so the writes that
+	// finish after replying don't block their goroutines
+	type result struct {
+		node string
+		err  error
+	}
+	results := make(chan result, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			err := svc.setReplica(node, token, item)
+			if err != nil {
+				svc.hint(node, token, item)
+			}
+			results <- result{node: node, err: err}
+		}(node)
+	}
+
+	acked, failed := map[string]struct{}{}, 0
+	for len(acked) < acks && failed <= len(replicas)-acks {
+		res := <-results
+		if res.err != nil {
+			// hints don't count towards the consistency level
+			log.Printf("could not store key: %s on replica: %s, %v", item.Key, res.node, res.err)
+			failed++
+			continue
+		}
+		acked[res.node] = struct{}{}
+	}
+	if len(acked) < acks {
+		return []string{}, fmt.Errorf("%w: key: %s was stored on %d out of %d required replica(s)", models.ErrUnavailable, item.Key, len(acked), acks)
+	}
+
+	nodes := make([]string, 0, len(acked))
+	for _, node := range replicas {
+		if _, ok := acked[node]; ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// hint keeps the write for the unreachable replica,
+// it gets replayed once the replica comes back up
+func (svc CacheSvc) hint(node string, token int, item models.CacheItem) {
+	err := svc.hintsRepo.Add(node, token, item)
+	if err != nil {
+		log.Printf("could not store hint for key: %s on node: %s, %v", item.Key, node, err)
+	}
+}
+
+func (svc CacheSvc) setReplica(node string, token int, item models.CacheItem) error {
+	items := map[int]models.CacheItem{token: item}
+	if node == svc.tokens.Nodes.Current() {
+		return svc.store(items)
+	}
+
+	_, err := svc.httpClient.SetBatch(node, items)
+	return err
+}
+
+// store writes the items to the local storage. The changes of the keys
+// the current node owns are logged for the watchers
+func (svc CacheSvc) store(items map[int]models.CacheItem) error {
+	stored, err := svc.cacheRepo.Set(items)
+	if err != nil {
+		return err
+	}
+
+	owned := make([]models.CacheItem, 0, len(stored))
+	for token, item := range stored {
+		if owners := svc.tokens.GetNodes(token, 1); len(owners) > 0 && owners[0] == svc.tokens.Nodes.Current() {
+			owned = append(owned, item)
+		}
+	}
+	svc.changes.Append(owned)
+	return nil
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func failed(batches map[string]map[int]models.CacheItem, token int) bool {
+	for _, items := range batches {
+		if _, ok := items[token]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,442 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+	"distributed-db/repositories"
+)
+
+const (
+	testCurrentNode = "localhost:9000"
+	testOtherNode   = "localhost:9001"
+)
+
+// fakeClient plays the other node of a 2 node cluster
+type fakeClient struct {
+	mu     sync.Mutex
+	items  map[int]models.CacheItem
+	tokens models.TokenMappings
+}
+
+func newFakeClient() *fakeClient {
+	nodes := models.NewNodes(testOtherNode, models.NodesMap{testCurrentNode: models.NodeStatusUp})
+	return &fakeClient{
+		items:  map[int]models.CacheItem{},
+		tokens: models.NewTokens(nodes, 16).Mappings(),
+	}
+}
+
+func (c *fakeClient) Get(node string, req models.GetRequest) ([]models.CacheItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := make([]models.CacheItem, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		if item, ok := c.items[int(models.HashKey(key))]; ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (c *fakeClient) Set(node string, req models.SetRequest) (models.CacheItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item := models.CacheItem{Key: req.Key, Value: req.Value, UpdatedAt: time.Now().UTC(), Node: node}
+	c.items[int(models.HashKey(req.Key))] = item
+	return item, nil
+}
+
+func (c *fakeClient) SetBatch(node string, items map[int]models.CacheItem) ([]models.CacheItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make([]models.CacheItem, 0, len(items))
+	for token, item := range items {
+		c.items[token] = item
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+func (c *fakeClient) Gossip(node string, req models.GossipRequest) (models.GossipResponse, error) {
+	return models.GossipResponse{Members: map[string]models.Member{node: {Status: models.NodeStatusUp}}}, nil
+}
+
+func (c *fakeClient) Ping(node string, req models.PingRequest, timeout time.Duration) (models.PingResponse, error) {
+	return models.PingResponse{}, nil
+}
+
+func (c *fakeClient) IndirectPing(node string, req models.IndirectPingRequest, timeout time.Duration) (models.PingResponse, error) {
+	return models.PingResponse{}, nil
+}
+
+func (c *fakeClient) Tokens(node string) (models.TokenMappings, error) {
+	return c.tokens, nil
+}
+
+func (c *fakeClient) MerkleTree(node string, req models.MerkleRequest) (models.MerkleTree, error) {
+	return models.NewMerkleTree(req.Range, map[int]models.CacheItem{}), nil
+}
+
+func (c *fakeClient) RangeItems(node string, ranges []models.TokenRange) (map[int]models.CacheItem, error) {
+	return map[int]models.CacheItem{}, nil
+}
+
+func (c *fakeClient) Scan(node string, req models.ScanRequest) (models.ScanResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keyspace := models.Keyspace{Name: req.Keyspace}
+	if keyspace.Name == "" {
+		keyspace.Name = models.DefaultKeyspace
+	}
+	items := make([]models.CacheItem, 0)
+	for _, item := range c.items {
+		if item.Key > req.Cursor && strings.HasPrefix(item.Key, req.Prefix) && inKeyspace(keyspace, item.Key) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	if len(items) > req.Limit {
+		items = items[:req.Limit]
+	}
+	return models.ScanResponse{Items: items}, nil
+}
+
+func (c *fakeClient) CAS(node string, req models.CASRequest) (models.CASResponse, error) {
+	return models.CASResponse{}, nil
+}
+
+func (c *fakeClient) Prepare(node string, req models.PrepareRequest) (models.PrepareResponse, error) {
+	return models.PrepareResponse{}, nil
+}
+
+func (c *fakeClient) Propose(node string, req models.ProposeRequest) (models.ProposeResponse, error) {
+	return models.ProposeResponse{}, nil
+}
+
+func (c *fakeClient) Commit(node string, req models.CommitRequest) (models.CommitResponse, error) {
+	return models.CommitResponse{}, nil
+}
+
+func (c *fakeClient) Changes(ctx context.Context, node string, req models.ChangesRequest) (models.ChangesResponse, error) {
+	return models.ChangesResponse{Epoch: 1, Changes: []models.Change{}}, nil
+}
+
+func (c *fakeClient) BackupPart(node string, req models.BackupRequest) (models.BackupManifest, error) {
+	return models.BackupManifest{ID: req.ID, Node: node, Time: req.Time}, nil
+}
+
+// clusterClient delivers the requests straight to the services of the other nodes,
+// the requests sent to the nodes marked down fail
+type clusterClient struct {
+	*fakeClient
+	nodes  map[string]CacheSvc
+	downMu sync.Mutex
+	down   map[string]bool
+}
+
+// newTestCluster returns the services of n nodes which all know each other,
+// connected by a clusterClient
+func newTestCluster(t *testing.T, n, replicationFactor int) (*clusterClient, []CacheSvc) {
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, fmt.Sprintf("localhost:%d", 9000+i))
+	}
+	client := &clusterClient{fakeClient: newFakeClient(), nodes: map[string]CacheSvc{}, down: map[string]bool{}}
+	svcs := make([]CacheSvc, 0, n)
+	for _, addr := range addrs {
+		others := make([]string, 0, n-1)
+		for _, other := range addrs {
+			if other != addr {
+				others = append(others, other)
+			}
+		}
+		svc := newTestNode(t, addr, others, client, replicationFactor)
+		client.nodes[addr] = svc
+		svcs = append(svcs, svc)
+	}
+	return client, svcs
+}
+
+// setDown makes the requests sent to the node fail, or succeed again
+func (c *clusterClient) setDown(node string, down bool) {
+	c.downMu.Lock()
+	defer c.downMu.Unlock()
+
+	c.down[node] = down
+}
+
+func (c *clusterClient) reach(node string) error {
+	c.downMu.Lock()
+	defer c.downMu.Unlock()
+
+	if c.down[node] {
+		return fmt.Errorf("node: %s is down", node)
+	}
+	return nil
+}
+
+func (c *clusterClient) Get(node string, req models.GetRequest) ([]models.CacheItem, error) {
+	if err := c.reach(node); err != nil {
+		return nil, err
+	}
+	res, err := c.nodes[node].Get(req)
+	return res.Items, err
+}
+
+func (c *clusterClient) SetBatch(node string, items map[int]models.CacheItem) ([]models.CacheItem, error) {
+	if err := c.reach(node); err != nil {
+		return nil, err
+	}
+	return c.nodes[node].SetBatch(items)
+}
+
+// stored returns the copy of the item stored by the node, if any
+func stored(svc CacheSvc, key string) (models.CacheItem, bool) {
+	items := svc.cacheRepo.Get([]int{int(models.HashKey(key))})
+	if len(items) == 0 {
+		return models.CacheItem{}, false
+	}
+	return items[0], true
+}
+
+// settle waits for the write of the key to reach all its replicas, as a copy on
+// the nodes which are up and as a hint for the nodes which are down, so no write
+// is left running once it returns
+func settle(t *testing.T, client *clusterClient, key string) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the write of key: %s did not reach all its replicas", key)
+		}
+
+		pending := false
+		for node, svc := range client.nodes {
+			if client.reach(node) == nil {
+				_, ok := stored(svc, key)
+				pending = pending || !ok
+				continue
+			}
+			hinted := false
+			for _, other := range client.nodes {
+				hinted = hinted || contains(other.hintsRepo.Nodes(), node)
+			}
+			pending = pending || !hinted
+		}
+		if !pending {
+			return
+		}
+	}
+}
+
+// newTestService returns the service of the current node of a 2 node cluster,
+// the other node is played by a fakeClient
+func newTestService(t *testing.T, replicationFactor int) CacheSvc {
+	return newTestNode(t, testCurrentNode, []string{testOtherNode}, newFakeClient(), replicationFactor)
+}
+
+// newTestNode returns the service of the node, which reaches the other nodes through
+// the client. Its repositories are kept in temporary directories of the test
+func newTestNode(t *testing.T, node string, others []string, client HTTPClient, replicationFactor int) CacheSvc {
+	cacheRepo, err := repositories.NewCache(t.TempDir(), 0, models.EvictionSpill)
+	if err != nil {
+		t.Fatalf("could not open the database: %v", err)
+	}
+	t.Cleanup(func() { _ = cacheRepo.Close() })
+	hintsRepo, err := repositories.NewHints(t.TempDir(), time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("could not open the hints: %v", err)
+	}
+	keyspacesRepo, err := repositories.NewKeyspaces(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not open the keyspaces: %v", err)
+	}
+
+	nodes := models.NodesMap{}
+	for _, other := range others {
+		nodes[other] = models.NodeStatusUp
+	}
+	tokens := models.NewTokens(models.NewNodes(node, nodes), 16)
+	return NewCache(cacheRepo, hintsRepo, nil, keyspacesRepo, client, tokens, models.NewChanges(100), models.NewMetrics(), replicationFactor)
+}
+
+// TestCacheConcurrentAccess drives gossip, streaming, probing and client
+// requests at the same time. It is meant to be run with -race
+func TestCacheConcurrentAccess(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	svc := newTestService(t, 2)
+	nodes := svc.tokens.Nodes
+	nodes.Subscribe(svc.NodeStatusChanged)
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	run(func(i int) {
+		svc.Gossip()
+		_, err := svc.UpdateTokens(testOtherNode, models.GossipRequest{Members: nodes.Members()})
+		if err != nil {
+			t.Errorf("could not update tokens: %v", err)
+		}
+	})
+	run(func(i int) {
+		svc.Probe(time.Millisecond, time.Millisecond, 1)
+	})
+	retryBatches := map[string]map[int]models.CacheItem{}
+	run(func(i int) {
+		retryBatches = svc.Stream(retryBatches)
+	})
+	for w := 0; w < 4; w++ {
+		w := w
+		run(func(i int) {
+			key := fmt.Sprintf("key-%d-%d", w, i)
+			_, err := svc.Set(models.SetRequest{Key: key, Value: "value"})
+			if err != nil {
+				t.Errorf("could not set key: %s, %v", key, err)
+				return
+			}
+			_, err = svc.Get(models.GetRequest{Keys: []string{key}})
+			if err != nil {
+				t.Errorf("could not get key: %s, %v", key, err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// TestSetReplicates writes keys from a node of a 5 node cluster. Every key must be
+// stored on the N distinct nodes following its token on the ring, and only on them
+func TestSetReplicates(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	_, svcs := newTestCluster(t, 5, 3)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		item, err := svcs[0].Set(models.SetRequest{Key: key, Value: "value", ConsistencyLevel: models.ConsistencyLevelAll})
+		if err != nil {
+			t.Fatalf("could not set key: %s, %v", key, err)
+		}
+
+		replicas := svcs[0].tokens.GetNodes(int(models.HashKey(key)), 3)
+		if len(replicas) != 3 || strings.Join(item.Replicas, ",") != strings.Join(replicas, ",") {
+			t.Fatalf("expected key: %s on the successors: %v, got: %v", key, replicas, item.Replicas)
+		}
+		copies := 0
+		for _, svc := range svcs {
+			node := svc.tokens.Nodes.Current()
+			_, ok := stored(svc, key)
+			if ok != contains(replicas, node) {
+				t.Fatalf("expected key: %s on node: %s to be stored: %v", key, node, contains(replicas, node))
+			}
+			if ok {
+				copies++
+			}
+		}
+		if copies != 3 {
+			t.Fatalf("expected key: %s on 3 nodes, found %d copies", key, copies)
+		}
+	}
+}
+
+// TestConsistencyLevels writes and reads a key of a 3 node cluster with some of
+// the replicas down. The requests must only fail when fewer replicas than
+// the consistency level requires answer
+func TestConsistencyLevels(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		level       models.ConsistencyLevel
+		down        int
+		unavailable bool
+	}{
+		{level: models.ConsistencyLevelOne, down: 2},
+		{level: models.ConsistencyLevelQuorum, down: 1},
+		{level: models.ConsistencyLevelQuorum, down: 2, unavailable: true},
+		{level: models.ConsistencyLevelAll, down: 0},
+		{level: models.ConsistencyLevelAll, down: 1, unavailable: true},
+	} {
+		client, svcs := newTestCluster(t, 3, 3)
+		for _, svc := range svcs[1 : 1+test.down] {
+			client.setDown(svc.tokens.Nodes.Current(), true)
+		}
+
+		_, err := svcs[0].Set(models.SetRequest{Key: "key", Value: "value", ConsistencyLevel: test.level})
+		if test.unavailable != errors.Is(err, models.ErrUnavailable) || (!test.unavailable && err != nil) {
+			t.Fatalf("%s with %d replica(s) down, expected the write to be unavailable: %v, got: %v", test.level, test.down, test.unavailable, err)
+		}
+		settle(t, client, "key")
+
+		res, err := svcs[0].Get(models.GetRequest{Keys: []string{"key"}, ConsistencyLevel: test.level})
+		if test.unavailable != errors.Is(err, models.ErrUnavailable) || (!test.unavailable && err != nil) {
+			t.Fatalf("%s with %d replica(s) down, expected the read to be unavailable: %v, got: %v", test.level, test.down, test.unavailable, err)
+		}
+		if !test.unavailable && (len(res.Items) != 1 || res.Items[0].Value != "value") {
+			t.Fatalf("%s with %d replica(s) down, expected the value, got: %+v", test.level, test.down, res.Items)
+		}
+	}
+}
+
+// TestDeleteTombstones deletes a key of a 3 node cluster. Every replica must hide
+// the key, and keep its tombstone until the grace period is over
+func TestDeleteTombstones(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	_, svcs := newTestCluster(t, 3, 3)
+
+	_, err := svcs[0].Set(models.SetRequest{Key: "key", Value: "value", ConsistencyLevel: models.ConsistencyLevelAll})
+	if err != nil {
+		t.Fatalf("could not set the key: %v", err)
+	}
+	err = svcs[1].Delete(models.DeleteRequest{Keys: []string{"key"}, ConsistencyLevel: models.ConsistencyLevelAll})
+	if err != nil {
+		t.Fatalf("could not delete the key: %v", err)
+	}
+
+	for _, svc := range svcs {
+		node := svc.tokens.Nodes.Current()
+		res, err := svc.Get(models.GetRequest{Keys: []string{"key"}, ConsistencyLevel: models.ConsistencyLevelOne})
+		if err != nil || len(res.Items) != 0 {
+			t.Fatalf("expected the key to be hidden on node: %s, got: %+v, %v", node, res.Items, err)
+		}
+		if item, ok := stored(svc, "key"); !ok || !item.Deleted {
+			t.Fatalf("expected a tombstone on node: %s, got: %+v, %v", node, item, ok)
+		}
+
+		svc.PurgeTombstones(time.Hour)
+		if _, ok := stored(svc, "key"); !ok {
+			t.Fatalf("the tombstone was purged during the grace period on node: %s", node)
+		}
+		svc.PurgeTombstones(0)
+		if item, ok := stored(svc, "key"); ok {
+			t.Fatalf("expected the tombstone to be purged after the grace period on node: %s, got: %+v", node, item)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+// rounds tried before giving up on a key other nodes keep writing to
+const casAttempts = 10
+
+// the rounds older than this are over, the replicas drop their state and refuse
+// their ballots. The ballots are dated by the clock of their node, so the clocks
+// of the nodes have to be closer than this
+const casRoundTimeout = time.Minute
+
+// consensus keeps the state of the compare-and-set writes of the node:
+// the locks of the keys owned without replication and, as a replica,
+// the ballot promised and the proposal accepted for every key in a round.
+// The state of a key is dropped once its round is committed, the stored
+// item then refuses the older ballots by itself, its time is the ballot time.
+// The state of the rounds which never commit is dropped once they time out
+type consensus struct {
+	mu         sync.Mutex
+	acceptors  map[int]*acceptor
+	timeout    time.Duration
+	expiredAt  time.Time
+	lastBallot int64
+	locks      [64]sync.Mutex
+}
+
+type acceptor struct {
+	promised models.Ballot
+	accepted *models.Proposal
+}
+
+func newConsensus() *consensus {
+	return &consensus{acceptors: map[int]*acceptor{}, timeout: casRoundTimeout}
+}
+
+// CAS writes the item only if the current one has the expected version.
+// Without replication the node owning the key does the check and the write
+// under the lock of the key. With replication a majority of the replicas
+// has to agree on the write first (paxos), so concurrent writes of the key
+// from any node are applied one after the other.
+// Plain writes of the key bypass all of this and overwrite the version
+func (svc CacheSvc) CAS(req models.CASRequest) (models.CASResponse, error) {
+	if req.Local {
+		return svc.casLocal(int(models.HashKey(req.Key)), req)
+	}
+
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+	req.Key, err = storedKey(keyspace, req.Key)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+	if req.ReplicationFactor == 0 {
+		req.ReplicationFactor = keyspace.ReplicationFactor
+	}
+	if req.TTL == 0 {
+		req.TTL = keyspace.TTL
+	}
+
+	res, err := svc.compareAndSet(req)
+	if err != nil {
+		return models.CASResponse{}, err
+	}
+	res.Item = clientItem(keyspace, res.Item)
+	return res, nil
+}
+
+func (svc CacheSvc) compareAndSet(req models.CASRequest) (models.CASResponse, error) {
+	token := int(models.HashKey(req.Key))
+
+	replicas := svc.replicas(token, req.ReplicationFactor)
+	switch {
+	case len(replicas) == 0:
+		return models.CASResponse{}, fmt.Errorf("%w: no replicas found for key: %s", models.ErrUnavailable, req.Key)
+	case len(replicas) > 1:
+		return svc.casConsensus(token, replicas, req)
+	case replicas[0] == svc.tokens.Nodes.Current():
+		return svc.casLocal(token, req)
+	}
+
+	req.Local = true
+	res, err := svc.httpClient.CAS(replicas[0], req)
+	if err != nil {
+		return models.CASResponse{}, fmt.Errorf("%w: could not forward the write of key: %s to node: %s, %v", models.ErrUnavailable, req.Key, replicas[0], err)
+	}
+	return res, nil
+}
+
+// Prepare promises the ballot not to take part in the older rounds of the key.
+// Ballots older than the stored item are refused too, their round is over
+func (svc CacheSvc) Prepare(req models.PrepareRequest) models.PrepareResponse {
+	token := int(models.HashKey(req.Key))
+	item, found := svc.storedItem(token)
+
+	svc.cas.mu.Lock()
+	defer svc.cas.mu.Unlock()
+
+	horizon := svc.cas.horizon(time.Now())
+	a := svc.cas.acceptor(token)
+	if !a.promised.Less(req.Ballot) || older(req.Ballot, item, found) || req.Ballot.Time < horizon {
+		return models.PrepareResponse{Ballot: a.newest(item, found, horizon)}
+	}
+	a.promised = req.Ballot
+
+	return models.PrepareResponse{Promised: true, Ballot: req.Ballot, Accepted: a.accepted, Found: found, Item: item}
+}
+
+// Propose accepts the item unless a newer ballot was promised in the meantime
+func (svc CacheSvc) Propose(req models.ProposeRequest) models.ProposeResponse {
+	token := int(models.HashKey(req.Proposal.Item.Key))
+	item, found := svc.storedItem(token)
+
+	svc.cas.mu.Lock()
+	defer svc.cas.mu.Unlock()
+
+	horizon := svc.cas.horizon(time.Now())
+	a := svc.cas.acceptor(token)
+	if req.Proposal.Ballot.Less(a.promised) || older(req.Proposal.Ballot, item, found) || req.Proposal.Ballot.Time < horizon {
+		return models.ProposeResponse{Ballot: a.newest(item, found, horizon)}
+	}
+	proposal := req.Proposal
+	a.promised, a.accepted = proposal.Ballot, &proposal
+
+	return models.ProposeResponse{Accepted: true, Ballot: proposal.Ballot}
+}
+
+// Commit stores the item agreed on and forgets the round.
+// The round is kept when the item can't be stored, a later round finishes it
+func (svc CacheSvc) Commit(req models.CommitRequest) (models.CommitResponse, error) {
+	token := int(models.HashKey(req.Proposal.Item.Key))
+	err := svc.store(map[int]models.CacheItem{token: req.Proposal.Item})
+	if err != nil {
+		return models.CommitResponse{}, err
+	}
+
+	svc.cas.mu.Lock()
+	defer svc.cas.mu.Unlock()
+
+	a, ok := svc.cas.acceptors[token]
+	if !ok {
+		return models.CommitResponse{Stored: true}, nil
+	}
+	if a.accepted != nil && !req.Proposal.Ballot.Less(a.accepted.Ballot) {
+		a.accepted = nil
+	}
+	if a.accepted == nil && !req.Proposal.Ballot.Less(a.promised) {
+		delete(svc.cas.acceptors, token)
+	}
+	return models.CommitResponse{Stored: true}, nil
+}
+
+// horizon returns the time of the oldest ballot which did not time out. The state of
+// the older rounds is dropped once per timeout. It must be called with the lock held
+func (c *consensus) horizon(now time.Time) int64 {
+	horizon := now.Add(-c.timeout).UnixNano()
+	if now.Sub(c.expiredAt) < c.timeout {
+		return horizon
+	}
+
+	for token, a := range c.acceptors {
+		if a.promised.Time < horizon {
+			delete(c.acceptors, token)
+		}
+	}
+	c.expiredAt = now
+	return horizon
+}
+
+func (c *consensus) acceptor(token int) *acceptor {
+	a, ok := c.acceptors[token]
+	if !ok {
+		a = &acceptor{}
+		c.acceptors[token] = a
+	}
+	return a
+}
+
+// newest returns the ballot the refused rounds have to beat
+func (a *acceptor) newest(item models.CacheItem, found bool, horizon int64) models.Ballot {
+	newest := a.promised
+	if found && newest.Time <= item.UpdatedAt.UnixNano() {
+		newest = models.Ballot{Time: item.UpdatedAt.UnixNano()}
+	}
+	if newest.Time < horizon {
+		newest = models.Ballot{Time: horizon}
+	}
+	return newest
+}
+
+// older tells whether the round of the ballot is older than the stored item
+func older(ballot models.Ballot, item models.CacheItem, found bool) bool {
+	return found && ballot.Time <= item.UpdatedAt.UnixNano()
+}
+
+// ballot returns a ballot newer than the ones of the node and than the given one
+func (c *consensus) ballot(node string, newerThan models.Ballot) models.Ballot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := time.Now().UnixNano()
+	if t <= c.lastBallot {
+		t = c.lastBallot + 1
+	}
+	if t <= newerThan.Time {
+		t = newerThan.Time + 1
+	}
+	c.lastBallot = t
+	return models.Ballot{Time: t, Node: node}
+}
+
+func (svc CacheSvc) casLocal(token int, req models.CASRequest) (models.CASResponse, error) {
+	lock := &svc.cas.locks[uint(token)%uint(len(svc.cas.locks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, found := svc.storedItem(token)
+	exists := found && !current.Deleted
+	if !matches(req, current, exists) {
+		return models.CASResponse{Exists: exists, Item: current}, nil
+	}
+
+	now := time.Now().UTC()
+	// the new version has to win over the current one
+	if !now.After(current.UpdatedAt) {
+		now = current.UpdatedAt.Add(time.Nanosecond)
+	}
+	item := newVersion(req, current, now, 1)
+	err := svc.store(map[int]models.CacheItem{token: item})
+	if err != nil {
+		return models.CASResponse{}, fmt.Errorf("could not store key: %s, %w", req.Key, err)
+	}
+	item.Node = svc.tokens.Nodes.Current()
+
+	return models.CASResponse{Applied: true, Exists: true, Item: item}, nil
+}
+
+// casConsensus runs rounds until one of them decides on the write:
+//  1. PREPARE: a majority of the replicas promises the ballot of the round,
+//     sending back their current item and the item accepted in an unfinished round
+//  2. the unfinished round is finished first, then the condition is checked
+//     against the newest item of the majority
+//  3. PROPOSE: a majority of the replicas accepts the new item
+//  4. COMMIT:  the replicas store the new item
+//
+// A round interrupted by a newer ballot is retried after a random pause. A new item
+// accepted by a minority can still be finished by a later round, so when all the
+// rounds fail the write may or may not have been applied
+func (svc CacheSvc) casConsensus(token int, replicas []string, req models.CASRequest) (models.CASResponse, error) {
+	quorum := len(replicas)/2 + 1
+	newest, uncertain := models.Ballot{}, false
+	// the items proposed by this write, their time is the time of their ballot
+	proposed := map[int64]bool{}
+	for attempt := 1; attempt <= casAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(rand.Intn(10*attempt)) * time.Millisecond)
+		}
+		ballot := svc.cas.ballot(svc.tokens.Nodes.Current(), newest)
+
+		promises, refused := svc.prepare(replicas, models.PrepareRequest{Key: req.Key, Ballot: ballot})
+		if refused.Time > 0 && newest.Less(refused) {
+			newest = refused
+		}
+		if len(promises) < quorum {
+			continue
+		}
+
+		var current models.CacheItem
+		var unfinished *models.Proposal
+		found := false
+		for _, p := range promises {
+			if p.Found && (!found || p.Item.UpdatedAt.After(current.UpdatedAt)) {
+				current, found = p.Item, true
+			}
+			if p.Accepted != nil && (unfinished == nil || unfinished.Ballot.Less(p.Accepted.Ballot)) {
+				unfinished = p.Accepted
+			}
+		}
+		if unfinished != nil && (!found || unfinished.Item.UpdatedAt.After(current.UpdatedAt)) {
+			log.Printf("finishing the unfinished write of key: %s", req.Key)
+			proposal := models.Proposal{Ballot: ballot, Item: unfinished.Item}
+			if svc.propose(replicas, proposal) >= quorum {
+				svc.commit(replicas, proposal, quorum)
+			}
+			continue
+		}
+
+		// the item accepted by a minority in a previous round was finished
+		if found && proposed[current.UpdatedAt.UnixNano()] {
+			current.Node, current.Replicas = replicas[0], replicas
+			return models.CASResponse{Applied: true, Exists: true, Item: current}, nil
+		}
+		exists := found && !current.Deleted
+		if !matches(req, current, exists) {
+			if uncertain {
+				return models.CASResponse{}, fmt.Errorf("%w: the write of key: %s conflicts with a newer version, it may have been applied before", models.ErrUnavailable, req.Key)
+			}
+			return models.CASResponse{Exists: exists, Item: current}, nil
+		}
+
+		item := newVersion(req, current, time.Unix(0, ballot.Time).UTC(), len(replicas))
+		proposal := models.Proposal{Ballot: ballot, Item: item}
+		proposed[ballot.Time] = true
+		accepted := svc.propose(replicas, proposal)
+		if accepted < quorum {
+			uncertain = uncertain || accepted > 0
+			continue
+		}
+		if !svc.commit(replicas, proposal, quorum) {
+			return models.CASResponse{}, fmt.Errorf("%w: the write of key: %s was accepted but not committed by a majority of the replicas", models.ErrUnavailable, req.Key)
+		}
+		item.Node, item.Replicas = replicas[0], replicas
+
+		return models.CASResponse{Applied: true, Exists: true, Item: item}, nil
+	}
+
+	if uncertain {
+		return models.CASResponse{}, fmt.Errorf("%w: no agreement on the write of key: %s after %d round(s), it may have been applied", models.ErrUnavailable, req.Key, casAttempts)
+	}
+	return models.CASResponse{}, fmt.Errorf("%w: no agreement on the write of key: %s after %d round(s)", models.ErrUnavailable, req.Key, casAttempts)
+}
+
+// prepare returns the promises of the replicas and the newest ballot which got refused
+func (svc CacheSvc) prepare(replicas []string, req models.PrepareRequest) ([]models.PrepareResponse, models.Ballot) {
+	results := make(chan models.PrepareResponse, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			if node == svc.tokens.Nodes.Current() {
+				results <- svc.Prepare(req)
+				return
+			}
+			res, err := svc.httpClient.Prepare(node, req)
+			if err != nil {
+				log.Printf("could not prepare the write of key: %s on node: %s, %v", req.Key, node, err)
+			}
+			results <- res
+		}(node)
+	}
+
+	promises, refused := make([]models.PrepareResponse, 0, len(replicas)), models.Ballot{}
+	for range replicas {
+		res := <-results
+		if res.Promised {
+			promises = append(promises, res)
+		} else if refused.Less(res.Ballot) {
+			refused = res.Ballot
+		}
+	}
+	return promises, refused
+}
+
+// propose returns the number of replicas which accepted the proposal
+func (svc CacheSvc) propose(replicas []string, proposal models.Proposal) int {
+	req := models.ProposeRequest{Proposal: proposal}
+	results := make(chan bool, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			if node == svc.tokens.Nodes.Current() {
+				results <- svc.Propose(req).Accepted
+				return
+			}
+			res, err := svc.httpClient.Propose(node, req)
+			if err != nil {
+				log.Printf("could not propose the write of key: %s to node: %s, %v", proposal.Item.Key, node, err)
+			}
+			results <- res.Accepted
+		}(node)
+	}
+
+	accepted := 0
+	for range replicas {
+		if <-results {
+			accepted++
+		}
+	}
+	return accepted
+}
+
+// commit stores the proposal on all the replicas and waits for the quorum to store it.
+// The replicas which missed the commit get the item from the next round or the repairs
+func (svc CacheSvc) commit(replicas []string, proposal models.Proposal, quorum int) bool {
+	req := models.CommitRequest{Proposal: proposal}
+	results := make(chan error, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			if node == svc.tokens.Nodes.Current() {
+				_, err := svc.Commit(req)
+				if err != nil {
+					log.Printf("could not commit the write of key: %s on the current node, %v", proposal.Item.Key, err)
+				}
+				results <- err
+				return
+			}
+			_, err := svc.httpClient.Commit(node, req)
+			if err != nil {
+				log.Printf("could not commit the write of key: %s on node: %s, %v", proposal.Item.Key, node, err)
+			}
+			results <- err
+		}(node)
+	}
+
+	committed, failed := 0, 0
+	for committed < quorum && failed <= len(replicas)-quorum {
+		if <-results == nil {
+			committed++
+			continue
+		}
+		failed++
+	}
+	return committed >= quorum
+}
+
+// storedItem reads the item of the token, tombstones included
+func (svc CacheSvc) storedItem(token int) (models.CacheItem, bool) {
+	items := svc.cacheRepo.Get([]int{token})
+	if len(items) == 0 {
+		return models.CacheItem{}, false
+	}
+	return items[0], true
+}
+
+func matches(req models.CASRequest, current models.CacheItem, exists bool) bool {
+	if req.IfAbsent {
+		return !exists
+	}
+	return exists && current.Version == req.Version
+}
+
+func newVersion(req models.CASRequest, current models.CacheItem, updatedAt time.Time, replicationFactor int) models.CacheItem {
+	item := models.CacheItem{
+		Key:               req.Key,
+		Value:             req.Value,
+		UpdatedAt:         updatedAt,
+		ReplicationFactor: replicationFactor,
+		Version:           current.Version + 1,
+	}
+	if req.TTL > 0 {
+		item.ExpiresAt = item.UpdatedAt.Add(time.Duration(req.TTL))
+	}
+	return item
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+func (c *clusterClient) CAS(node string, req models.CASRequest) (models.CASResponse, error) {
+	return c.nodes[node].CAS(req)
+}
+
+func (c *clusterClient) Prepare(node string, req models.PrepareRequest) (models.PrepareResponse, error) {
+	return c.nodes[node].Prepare(req), nil
+}
+
+func (c *clusterClient) Propose(node string, req models.ProposeRequest) (models.ProposeResponse, error) {
+	return c.nodes[node].Propose(req), nil
+}
+
+func (c *clusterClient) Commit(node string, req models.CommitRequest) (models.CommitResponse, error) {
+	return c.nodes[node].Commit(req)
+}
+
+// TestCASConcurrentIncrements increments a counter from all the nodes of a
+// replicated cluster at the same time. Every applied write must be a new version
+// and the last version must count all of them, none lost. Failed writes may have
+// been applied by a later round, they are counted apart
+func TestCASConcurrentIncrements(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addrs := []string{"localhost:9000", "localhost:9001", "localhost:9002"}
+	client := &clusterClient{fakeClient: newFakeClient(), nodes: map[string]CacheSvc{}}
+	for _, addr := range addrs {
+		others := make([]string, 0, len(addrs)-1)
+		for _, other := range addrs {
+			if other != addr {
+				others = append(others, other)
+			}
+		}
+		client.nodes[addr] = newTestNode(t, addr, others, client, 3)
+	}
+
+	res, err := client.nodes[addrs[0]].CAS(models.CASRequest{Key: "counter", Value: "0", IfAbsent: true})
+	if err != nil || !res.Applied {
+		t.Fatalf("could not create the counter: %+v, %v", res, err)
+	}
+	res, err = client.nodes[addrs[1]].CAS(models.CASRequest{Key: "counter", Value: "0", IfAbsent: true})
+	if err != nil || res.Applied || res.Item.Version != 1 {
+		t.Fatalf("the counter was created twice: %+v, %v", res, err)
+	}
+
+	var mu sync.Mutex
+	versions, uncertain := map[uint64]string{}, 0
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(svc CacheSvc) {
+			defer wg.Done()
+
+			version := uint64(1)
+			for applied := 0; applied < 10; {
+				req := models.CASRequest{Key: "counter", Value: fmt.Sprint(version), Version: version}
+				res, err := svc.CAS(req)
+				if err != nil {
+					mu.Lock()
+					uncertain++
+					mu.Unlock()
+					continue
+				}
+				if !res.Applied {
+					version = res.Item.Version
+					continue
+				}
+
+				mu.Lock()
+				if node, ok := versions[res.Item.Version]; ok {
+					t.Errorf("version: %d was written by: %s and: %s", res.Item.Version, node, svc.tokens.Nodes.Current())
+				}
+				versions[res.Item.Version] = svc.tokens.Nodes.Current()
+				mu.Unlock()
+				version, applied = res.Item.Version, applied+1
+			}
+		}(client.nodes[addr])
+	}
+	wg.Wait()
+
+	res, err = client.nodes[addrs[2]].CAS(models.CASRequest{Key: "counter", Version: 0})
+	if err != nil || res.Applied {
+		t.Fatalf("unexpected write: %+v, %v", res, err)
+	}
+	if res.Item.Version < 31 || res.Item.Version > uint64(31+uncertain) {
+		t.Fatalf("expected version: 31 plus at most %d, got: %d", uncertain, res.Item.Version)
+	}
+}
+
+// TestCASRoundsTimeout prepares and proposes rounds which never commit. Their
+// state must be dropped once they time out, and the replica must keep refusing
+// their ballots after it forgot them
+func TestCASRoundsTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	svc := newTestService(t, 1)
+	svc.cas.timeout = 50 * time.Millisecond
+
+	ballot := models.Ballot{Time: time.Now().UnixNano(), Node: testOtherNode}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if res := svc.Prepare(models.PrepareRequest{Key: key, Ballot: ballot}); !res.Promised {
+			t.Fatalf("expected the round of key: %s to be promised, got: %+v", key, res)
+		}
+		if i%2 == 0 {
+			proposal := models.Proposal{Ballot: ballot, Item: models.CacheItem{Key: key, Value: "value"}}
+			if res := svc.Propose(models.ProposeRequest{Proposal: proposal}); !res.Accepted {
+				t.Fatalf("expected the proposal of key: %s to be accepted, got: %+v", key, res)
+			}
+		}
+	}
+	if len(svc.cas.acceptors) != 100 {
+		t.Fatalf("expected the state of 100 rounds, got: %d", len(svc.cas.acceptors))
+	}
+
+	time.Sleep(2 * svc.cas.timeout)
+	res := svc.Prepare(models.PrepareRequest{Key: "key:0", Ballot: ballot})
+	if res.Promised || !ballot.Less(res.Ballot) {
+		t.Fatalf("expected the timed out ballot to be refused, got: %+v", res)
+	}
+	if len(svc.cas.acceptors) > 1 {
+		t.Fatalf("expected the state of the timed out rounds to be dropped, got: %d", len(svc.cas.acceptors))
+	}
+
+	proposal := models.Proposal{Ballot: ballot, Item: models.CacheItem{Key: "key:1", Value: "value"}}
+	if res := svc.Propose(models.ProposeRequest{Proposal: proposal}); res.Accepted {
+		t.Fatalf("expected the timed out proposal to be refused, got: %+v", res)
+	}
+	if res = svc.Prepare(models.PrepareRequest{Key: "key:0", Ballot: models.Ballot{Time: time.Now().UnixNano(), Node: testOtherNode}}); !res.Promised {
+		t.Fatalf("expected a new round to be promised, got: %+v", res)
+	}
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+const (
+	decommissionRetryPeriod = time.Second
+	// how long the node may take to leave when the request gives no timeout
+	defaultDecommissionTimeout = time.Hour
+)
+
+const (
+	decommissionRunning = "running"
+	decommissionDone    = "done"
+	decommissionFailed  = "failed"
+)
+
+// decommission keeps the progress of the current node leaving the cluster
+type decommission struct {
+	mu        sync.Mutex
+	status    string
+	startedAt time.Time
+	items     int
+	remaining int
+	err       string
+	cancel    context.CancelFunc
+	left      chan struct{}
+}
+
+func (d *decommission) response() models.DecommissionResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res := models.DecommissionResponse{Status: d.status, Items: d.items, Remaining: d.remaining, Error: d.err}
+	if !d.startedAt.IsZero() {
+		res.Duration = time.Since(d.startedAt).String()
+	}
+	return res
+}
+
+// Decommission takes the current node out of the cluster. The node is marked
+// as leaving in gossip, so its token ranges go to the next nodes of the ring,
+// and all of its items are streamed to their new owners. The hints it keeps for
+// other nodes are handed over too. Once every item and every hint was acknowledged,
+// the node is marked as left and Decommissioned is closed. When that takes longer
+// than the timeout, or the decommission gets aborted, the node is marked as up again
+// and keeps what it could not hand over. It runs in the background, calling it again
+// only returns the progress, unless the previous decommission failed
+func (svc CacheSvc) Decommission(req models.DecommissionRequest) (models.DecommissionResponse, error) {
+	timeout := time.Duration(req.Timeout)
+	if timeout < 0 {
+		return models.DecommissionResponse{}, fmt.Errorf("%w: the timeout can't be negative", models.ErrInvalidRequest)
+	}
+	if timeout == 0 {
+		timeout = defaultDecommissionTimeout
+	}
+
+	d := svc.decommission
+	d.mu.Lock()
+	if d.status == decommissionRunning || d.status == decommissionDone {
+		d.mu.Unlock()
+		return d.response(), nil
+	}
+
+	others := 0
+	for node, status := range svc.tokens.Nodes.Map() {
+		if node != svc.tokens.Nodes.Current() && status != models.NodeStatusLeaving && status != models.NodeStatusLeft {
+			others++
+		}
+	}
+	if others == 0 {
+		d.mu.Unlock()
+		return models.DecommissionResponse{}, fmt.Errorf("%w: there is no other node to take over the data", models.ErrUnavailable)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	items := len(svc.cacheRepo.Scan(math.MinInt, math.MaxInt))
+	d.status, d.startedAt, d.items, d.remaining, d.err, d.cancel = decommissionRunning, time.Now().UTC(), items, items, "", cancel
+	d.mu.Unlock()
+
+	go svc.leave(ctx, cancel)
+	return d.response(), nil
+}
+
+// AbortDecommission stops the running decommission, the node stays in the cluster
+func (svc CacheSvc) AbortDecommission() (models.DecommissionResponse, error) {
+	d := svc.decommission
+	d.mu.Lock()
+	if d.status != decommissionRunning {
+		d.mu.Unlock()
+		return models.DecommissionResponse{}, fmt.Errorf("%w: no decommission is running", models.ErrInvalidRequest)
+	}
+	d.cancel()
+	d.mu.Unlock()
+
+	return d.response(), nil
+}
+
+// DecommissionStatus returns the progress of the decommission
+func (svc CacheSvc) DecommissionStatus() models.DecommissionResponse {
+	return svc.decommission.response()
+}
+
+// Decommissioned is closed once the current node left the cluster
+func (svc CacheSvc) Decommissioned() <-chan struct{} {
+	return svc.decommission.left
+}
+
+func (svc CacheSvc) leave(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+	d := svc.decommission
+	log.Println("decommissioning the node")
+	svc.tokens.Nodes.SetStatus(models.NodeStatusLeaving)
+	svc.announce()
+
+	d.mu.Lock()
+	items := d.items
+	d.mu.Unlock()
+
+	// the streamer worker may pick up some of the items too,
+	// the node is done once nothing is left locally.
+	// Hints are other nodes' writes, they wait for their node to come back up
+	retryBatches := map[string]map[int]models.CacheItem{}
+	for {
+		svc.tokens.MarkMoved(models.TokenRange{From: math.MinInt, To: math.MaxInt})
+		retryBatches = svc.Stream(retryBatches)
+		svc.ReplayHints()
+
+		remaining, hinted := len(svc.cacheRepo.Scan(math.MinInt, math.MaxInt)), svc.hintedNodes()
+		d.mu.Lock()
+		d.remaining = remaining
+		d.mu.Unlock()
+		log.Printf("decommission: %d item(s) left to stream out of %d, hints left for %d node(s)", remaining, items, len(hinted))
+
+		if remaining == 0 && len(retryBatches) == 0 && len(hinted) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			reason := "timed out"
+			if errors.Is(ctx.Err(), context.Canceled) {
+				reason = "aborted"
+			}
+			svc.stay(fmt.Errorf("decommission %s with %d item(s) left to stream, hints left for node(s): %s",
+				reason, remaining, strings.Join(hinted, ",")))
+			return
+		case <-time.After(decommissionRetryPeriod):
+		}
+	}
+
+	svc.tokens.Nodes.SetStatus(models.NodeStatusLeft)
+	svc.announce()
+
+	d.mu.Lock()
+	d.status = decommissionDone
+	d.mu.Unlock()
+	log.Printf("decommissioned the node in %v", time.Since(d.startedAt))
+	close(d.left)
+}
+
+// stay takes the current node back into the cluster after a failed decommission.
+// Its ranges go back to it, the items it already streamed out are streamed back by their holders
+func (svc CacheSvc) stay(err error) {
+	log.Printf("could not decommission the node: %v", err)
+	svc.tokens.Nodes.SetStatus(models.NodeStatusUp)
+	svc.announce()
+
+	d := svc.decommission
+	d.mu.Lock()
+	d.status, d.err = decommissionFailed, err.Error()
+	d.mu.Unlock()
+}
+
+// hintedNodes returns the nodes still in the cluster which have hints waiting for them
+func (svc CacheSvc) hintedNodes() []string {
+	nodes, hinted := svc.tokens.Nodes.Map(), make([]string, 0)
+	for _, node := range svc.hintsRepo.Nodes() {
+		if status, ok := nodes[node]; ok && status != models.NodeStatusLeft {
+			hinted = append(hinted, node)
+		}
+	}
+	sort.Strings(hinted)
+	return hinted
+}
+
+// announce gossips to every active node at once, instead of waiting for the status
+// of the current node to spread. It is a full gossip round, so the nodes keep
+// looking up the stolen tokens the current node still holds
+func (svc CacheSvc) announce() {
+	status := models.NodeStatusText(svc.tokens.Nodes.Status())
+	for _, node := range svc.tokens.Nodes.ListActive(math.MaxInt) {
+		err := svc.gossip(node)
+		if err != nil {
+			log.Printf("could not announce the node is %s to node: %s, %v", status, node, err)
+			continue
+		}
+		log.Printf("node: %s acknowledged the node is %s", node, status)
+	}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// peerClient delivers the gossip of a node straight to the service of its peer
+type peerClient struct {
+	*fakeClient
+	from string
+	peer CacheSvc
+}
+
+func (c *peerClient) Gossip(node string, req models.GossipRequest) (models.GossipResponse, error) {
+	return c.peer.UpdateTokens(c.from, req)
+}
+
+// TestAnnounceKeepsForeignTokens announces the status of a leaving node which still
+// holds the items of stolen tokens. Its peer must keep looking them up on it,
+// and learn the keyspaces it did not know yet
+func TestAnnounceKeepsForeignTokens(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	peer := newTestNode(t, testOtherNode, []string{testCurrentNode}, newFakeClient(), 1)
+	client := &peerClient{fakeClient: newFakeClient(), from: testCurrentNode, peer: peer}
+	svc := newTestNode(t, testCurrentNode, []string{testOtherNode}, client, 1)
+
+	items := map[int]models.CacheItem{42: {Key: "stolen", Value: "value"}}
+	svc.tokens.SetForeignTokens(items, testCurrentNode)
+	peer.tokens.SetForeignTokens(items, testCurrentNode)
+	err := svc.keyspacesRepo.Merge([]models.Keyspace{{Name: "orders", UpdatedAt: time.Now().UTC()}})
+	if err != nil {
+		t.Fatalf("could not create the keyspace: %v", err)
+	}
+
+	svc.tokens.Nodes.SetStatus(models.NodeStatusLeaving)
+	svc.announce()
+
+	if holder, ok := peer.tokens.ForeignNode(42); !ok || holder != testCurrentNode {
+		t.Fatalf("expected the peer to look the stolen token up on the leaving node, got: %s, %v", holder, ok)
+	}
+	if _, err = peer.keyspace("orders"); err != nil {
+		t.Fatalf("expected the peer to learn the keyspace: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"distributed-db/models"
+)
+
+// Keyspaces lists the keyspaces known by the node
+func (svc CacheSvc) Keyspaces() []models.Keyspace {
+	return svc.keyspacesRepo.List()
+}
+
+// CreateKeyspace creates the keyspace, or replaces the defaults of an existing one.
+// The keyspace is pushed to the reachable nodes right away, the others learn about
+// it through gossip. Until they do, they reject the requests of a new keyspace
+func (svc CacheSvc) CreateKeyspace(keyspace models.Keyspace) (models.Keyspace, error) {
+	err := keyspace.Validate()
+	if err != nil {
+		return models.Keyspace{}, err
+	}
+
+	keyspace.UpdatedAt = time.Now().UTC()
+	err = svc.keyspacesRepo.Merge([]models.Keyspace{keyspace})
+	if err != nil {
+		return models.Keyspace{}, err
+	}
+	log.Printf("keyspace: %s updated, replication factor: %d, consistency level: %s, ttl: %v",
+		keyspace.Name, keyspace.ReplicationFactor, keyspace.ConsistencyLevel, time.Duration(keyspace.TTL))
+
+	for _, node := range svc.tokens.Nodes.ListActive(len(svc.tokens.Nodes.ListAll())) {
+		err = svc.gossip(node)
+		if err != nil {
+			log.Printf("could not push keyspace: %s to node: %s, %v", keyspace.Name, node, err)
+		}
+	}
+	return keyspace, nil
+}
+
+// KeyspaceStats returns the number and the size of the items of the keyspace stored on the current node
+func (svc CacheSvc) KeyspaceStats(name string) (models.KeyspaceStats, error) {
+	keyspace, err := svc.keyspace(name)
+	if err != nil {
+		return models.KeyspaceStats{}, err
+	}
+
+	keys, bytes := svc.cacheRepo.CountKeys(keyspace.Name)
+	return models.KeyspaceStats{Name: keyspace.Name, Keys: keys, Bytes: bytes}, nil
+}
+
+// keyspace returns the keyspace of the request, the default one when the request names none.
+// The default keyspace exists even when it was never created, without defaults of its own
+func (svc CacheSvc) keyspace(name string) (models.Keyspace, error) {
+	if name == "" {
+		name = models.DefaultKeyspace
+	}
+	keyspace, ok := svc.keyspacesRepo.Get(name)
+	if !ok && name != models.DefaultKeyspace {
+		return models.Keyspace{}, fmt.Errorf("%w: unknown keyspace: %s", models.ErrInvalidRequest, name)
+	}
+	keyspace.Name = name
+	return keyspace, nil
+}
+
+func (svc CacheSvc) mergeKeyspaces(keyspaces []models.Keyspace) {
+	err := svc.keyspacesRepo.Merge(keyspaces)
+	if err != nil {
+		log.Printf("could not merge keyspaces: %v", err)
+	}
+}
+
+// storedKey returns the key the key of the client is stored under
+func storedKey(keyspace models.Keyspace, key string) (string, error) {
+	if !models.ValidKey(key) {
+		return "", fmt.Errorf("%w: key: %q can't contain a NUL byte", models.ErrInvalidRequest, key)
+	}
+	return models.KeyspaceKey(keyspace.Name, key), nil
+}
+
+func storedKeys(keyspace models.Keyspace, keys []string) ([]string, error) {
+	stored := make([]string, 0, len(keys))
+	for _, key := range keys {
+		s, err := storedKey(keyspace, key)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, s)
+	}
+	return stored, nil
+}
+
+// inKeyspace tells whether the stored key belongs to the keyspace
+func inKeyspace(keyspace models.Keyspace, key string) bool {
+	ks, _ := models.SplitKeyspaceKey(key)
+	return ks == keyspace.Name
+}
+
+// clientItem returns the stored item as the clients of the keyspace see it
+func clientItem(keyspace models.Keyspace, item models.CacheItem) models.CacheItem {
+	if keyspace.Name == models.DefaultKeyspace {
+		return item
+	}
+	_, item.Key = models.SplitKeyspaceKey(item.Key)
+	item.Keyspace = keyspace.Name
+	return item
+}
+
+// clientKeys returns the keys of the clients the stored keys are made of, for the error messages
+func clientKeys(keys []string) string {
+	client := make([]string, 0, len(keys))
+	for _, key := range keys {
+		_, k := models.SplitKeyspaceKey(key)
+		client = append(client, k)
+	}
+	return strings.Join(client, ",")
+}
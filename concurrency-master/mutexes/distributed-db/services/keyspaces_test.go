@@ -0,0 +1,115 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestKeyspaces writes the same key in the default keyspace and in a named one.
+// The keys don't collide, the defaults of the keyspace apply to its writes and
+// the scans and the stats only see the keys of their keyspace
+func TestKeyspaces(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	svc := newTestService(t, 1)
+
+	_, err := svc.Set(models.SetRequest{Keyspace: "orders", Key: "order:1", Value: "paid"})
+	if !errors.Is(err, models.ErrInvalidRequest) {
+		t.Fatalf("expected the unknown keyspace to be rejected, got: %v", err)
+	}
+	_, err = svc.CreateKeyspace(models.Keyspace{Name: "orders", ReplicationFactor: 2, TTL: models.Duration(time.Hour)})
+	if err != nil {
+		t.Fatalf("could not create the keyspace: %v", err)
+	}
+
+	item, err := svc.Set(models.SetRequest{Keyspace: "orders", Key: "order:1", Value: "paid"})
+	if err != nil {
+		t.Fatalf("could not set the key of the keyspace: %v", err)
+	}
+	if item.Key != "order:1" || item.Keyspace != "orders" || item.ReplicationFactor != 2 || item.ExpiresAt.IsZero() {
+		t.Fatalf("expected the defaults of the keyspace, got: %+v", item)
+	}
+	item, err = svc.Set(models.SetRequest{Key: "order:1", Value: "pending"})
+	if err != nil {
+		t.Fatalf("could not set the key: %v", err)
+	}
+	if item.ReplicationFactor != 1 || !item.ExpiresAt.IsZero() {
+		t.Fatalf("expected the defaults of the node, got: %+v", item)
+	}
+	_, err = svc.Set(models.SetRequest{Key: "orders\x00order:2", Value: "paid"})
+	if !errors.Is(err, models.ErrInvalidRequest) {
+		t.Fatalf("expected the stored form of the key to be rejected, got: %v", err)
+	}
+
+	for keyspace, value := range map[string]string{"": "pending", "orders": "paid"} {
+		res, err := svc.Get(models.GetRequest{Keyspace: keyspace, Keys: []string{"order:1"}})
+		if err != nil || len(res.Items) != 1 || res.Items[0].Value != value {
+			t.Fatalf("expected value: %s in keyspace: %q, got: %+v, %v", value, keyspace, res.Items, err)
+		}
+		scan, err := svc.Scan(models.ScanRequest{Keyspace: keyspace})
+		if err != nil || len(scan.Items) != 1 || scan.Items[0].Key != "order:1" || scan.Items[0].Value != value {
+			t.Fatalf("expected value: %s in the scan of keyspace: %q, got: %+v, %v", value, keyspace, scan.Items, err)
+		}
+	}
+
+	stats, err := svc.KeyspaceStats("orders")
+	if err != nil || stats.Keys != 1 || stats.Bytes == 0 {
+		t.Fatalf("unexpected stats: %+v, %v", stats, err)
+	}
+}
+
+// TestScanDefaultKeyspace lists the default keyspace a key at a time while the keys
+// of a named keyspace sort between its keys. The named keys must not use up the
+// pages, and the cursor must resume after the stored key, not the key of the client
+func TestScanDefaultKeyspace(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	svc := newTestService(t, 1)
+
+	_, err := svc.CreateKeyspace(models.Keyspace{Name: "orders"})
+	if err != nil {
+		t.Fatalf("could not create the keyspace: %v", err)
+	}
+	for _, req := range []models.SetRequest{
+		{Key: "a", Value: "value"},
+		{Keyspace: "orders", Key: "zzz", Value: "value"},
+		{Key: "p", Value: "value"},
+	} {
+		if _, err = svc.Set(req); err != nil {
+			t.Fatalf("could not set key: %s, %v", req.Key, err)
+		}
+	}
+
+	keys, cursor := make([]string, 0), ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("the scan does not end, cursor: %q", cursor)
+		}
+		res, err := svc.Scan(models.ScanRequest{Cursor: cursor, Limit: 1})
+		if err != nil {
+			t.Fatalf("could not scan: %v", err)
+		}
+		if len(res.Items) == 0 && res.Cursor != "" {
+			t.Fatalf("got an empty page with cursor: %q", res.Cursor)
+		}
+		for _, item := range res.Items {
+			keys = append(keys, item.Key)
+		}
+		if res.Cursor == "" {
+			break
+		}
+		cursor = res.Cursor
+	}
+	if strings.Join(keys, ",") != "a,p" {
+		t.Fatalf("expected the keys of the default keyspace, got: %v", keys)
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"distributed-db/models"
+)
+
+// Probe pings the next node of the probing round. When the node does not
+// answer in time, up to indirectProbes other nodes are asked to ping it,
+// so a slow link between 2 nodes does not get the node suspected.
+// Suspect nodes which don't refute the suspicion are declared down
+func (svc CacheSvc) Probe(timeout, suspicionTimeout time.Duration, indirectProbes int) {
+	defer svc.tokens.Nodes.Expire(suspicionTimeout)
+
+	node, ok := svc.tokens.Nodes.NextProbe()
+	if !ok {
+		return
+	}
+	member, _ := svc.tokens.Nodes.Member(node)
+
+	res, err := svc.httpClient.Ping(node, models.PingRequest{Member: member}, timeout)
+	if err == nil {
+		svc.tokens.Nodes.Alive(node, res.Incarnation)
+		return
+	}
+
+	helpers := make([]string, 0, indirectProbes)
+	for _, helper := range svc.tokens.Nodes.ListActive(indirectProbes + 1) {
+		if helper != node && len(helpers) < indirectProbes {
+			helpers = append(helpers, helper)
+		}
+	}
+
+	acks := make(chan models.PingResponse, len(helpers))
+	var wg sync.WaitGroup
+	for _, helper := range helpers {
+		wg.Add(1)
+		go func(helper string) {
+			defer wg.Done()
+
+			req := models.IndirectPingRequest{Target: node, Member: member, Timeout: models.Duration(timeout)}
+			res, err := svc.httpClient.IndirectPing(helper, req, 2*timeout)
+			if err != nil {
+				return
+			}
+			acks <- res
+		}(helper)
+	}
+	wg.Wait()
+	close(acks)
+
+	if res, ok := <-acks; ok {
+		svc.tokens.Nodes.Alive(node, res.Incarnation)
+		return
+	}
+
+	// down nodes and nodes which left are only probed to notice them coming back
+	if member.Status == models.NodeStatusUp {
+		log.Printf("node: %s did not answer the direct and %d indirect ping(s): %v", node, len(helpers), err)
+		svc.tokens.Nodes.Suspect(node)
+	}
+}
+
+// Ping answers a probe with the incarnation of the current node,
+// refuting the suspicion of the sender if there is one
+func (svc CacheSvc) Ping(req models.PingRequest) models.PingResponse {
+	return models.PingResponse{Incarnation: svc.tokens.Nodes.Refute(req.Member)}
+}
+
+// IndirectPing probes the target on behalf of another node
+func (svc CacheSvc) IndirectPing(req models.IndirectPingRequest) (models.PingResponse, error) {
+	res, err := svc.httpClient.Ping(req.Target, models.PingRequest{Member: req.Member}, time.Duration(req.Timeout))
+	if err != nil {
+		return models.PingResponse{}, fmt.Errorf("%w: could not ping node: %s, %v", models.ErrUnavailable, req.Target, err)
+	}
+
+	return res, nil
+}
+
+// NodeStatusChanged is subscribed to the node status changes. The hints
+// of a node which is back up are replayed right away
+func (svc CacheSvc) NodeStatusChanged(node string, status int) {
+	log.Printf("node: %s is %s", node, models.NodeStatusText(status))
+	svc.metrics.StatusChanged(status)
+	if status == models.NodeStatusUp {
+		go svc.ReplayHints()
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// pingNet connects the nodes of a test cluster for the probes,
+// the links can be cut and the nodes taken down
+type pingNet struct {
+	mu       sync.Mutex
+	nodes    map[string]CacheSvc
+	cut      map[[2]string]bool
+	down     map[string]bool
+	indirect int
+}
+
+func (n *pingNet) reach(from, to string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.down[to] || n.cut[[2]string{from, to}] || n.cut[[2]string{to, from}] {
+		return fmt.Errorf("node: %s can't reach node: %s", from, to)
+	}
+	return nil
+}
+
+// pingClient sends the pings of a node over the pingNet
+type pingClient struct {
+	*fakeClient
+	from string
+	net  *pingNet
+}
+
+func (c *pingClient) Ping(node string, req models.PingRequest, timeout time.Duration) (models.PingResponse, error) {
+	if err := c.net.reach(c.from, node); err != nil {
+		return models.PingResponse{}, err
+	}
+	return c.net.nodes[node].Ping(req), nil
+}
+
+func (c *pingClient) IndirectPing(node string, req models.IndirectPingRequest, timeout time.Duration) (models.PingResponse, error) {
+	if err := c.net.reach(c.from, node); err != nil {
+		return models.PingResponse{}, err
+	}
+	c.net.mu.Lock()
+	c.net.indirect++
+	c.net.mu.Unlock()
+	return c.net.nodes[node].IndirectPing(req)
+}
+
+// newPingNet returns the services of 3 nodes which probe each other over a pingNet
+func newPingNet(t *testing.T) (*pingNet, []CacheSvc) {
+	addrs := []string{testCurrentNode, testOtherNode, "localhost:9002"}
+	net := &pingNet{nodes: map[string]CacheSvc{}, cut: map[[2]string]bool{}, down: map[string]bool{}}
+	svcs := make([]CacheSvc, 0, len(addrs))
+	for _, addr := range addrs {
+		others := make([]string, 0, len(addrs)-1)
+		for _, other := range addrs {
+			if other != addr {
+				others = append(others, other)
+			}
+		}
+		svc := newTestNode(t, addr, others, &pingClient{fakeClient: newFakeClient(), from: addr, net: net}, 1)
+		net.nodes[addr] = svc
+		svcs = append(svcs, svc)
+	}
+	return net, svcs
+}
+
+// probeRound probes every other node once
+func probeRound(svc CacheSvc, suspicionTimeout time.Duration) {
+	for range svc.tokens.Nodes.ListAll() {
+		svc.Probe(10*time.Millisecond, suspicionTimeout, 1)
+	}
+}
+
+// TestProbeIndirect cuts the link between the current node and a node which is
+// still up. The direct ping fails, the node must be reached through the other node
+// and stay up. Once the node is down as well, it must only be suspected
+func TestProbeIndirect(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	net, svcs := newPingNet(t)
+	nodes := svcs[0].tokens.Nodes
+
+	net.cut[[2]string{testCurrentNode, testOtherNode}] = true
+	probeRound(svcs[0], time.Hour)
+	if m, _ := nodes.Member(testOtherNode); m.Status != models.NodeStatusUp || net.indirect == 0 {
+		t.Fatalf("expected the node to be reached indirectly, got: %s after %d indirect ping(s)", models.NodeStatusText(m.Status), net.indirect)
+	}
+
+	net.down[testOtherNode] = true
+	probeRound(svcs[0], time.Hour)
+	if m, _ := nodes.Member(testOtherNode); m.Status != models.NodeStatusSuspect {
+		t.Fatalf("expected the node to be suspected, got: %s", models.NodeStatusText(m.Status))
+	}
+	if m, _ := nodes.Member("localhost:9002"); m.Status != models.NodeStatusUp {
+		t.Fatalf("expected the other node to stay up, got: %s", models.NodeStatusText(m.Status))
+	}
+}
+
+// TestProbeSuspicion suspects a node which does not answer any ping. A node which
+// comes back must refute the suspicion with a higher incarnation, a node which
+// does not must be declared down once the suspicion times out
+func TestProbeSuspicion(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	net, svcs := newPingNet(t)
+	nodes := svcs[0].tokens.Nodes
+
+	net.down[testOtherNode] = true
+	probeRound(svcs[0], time.Hour)
+	suspected, _ := nodes.Member(testOtherNode)
+	if suspected.Status != models.NodeStatusSuspect {
+		t.Fatalf("expected the node to be suspected, got: %s", models.NodeStatusText(suspected.Status))
+	}
+
+	net.down[testOtherNode] = false
+	probeRound(svcs[0], time.Hour)
+	m, _ := nodes.Member(testOtherNode)
+	if m.Status != models.NodeStatusUp || m.Incarnation <= suspected.Incarnation {
+		t.Fatalf("expected the node to refute the suspicion with a higher incarnation, got: %+v", m)
+	}
+
+	net.down[testOtherNode] = true
+	probeRound(svcs[0], time.Hour)
+	probeRound(svcs[0], 0)
+	if m, _ = nodes.Member(testOtherNode); m.Status != models.NodeStatusDown {
+		t.Fatalf("expected the node to be declared down, got: %s", models.NodeStatusText(m.Status))
+	}
+}
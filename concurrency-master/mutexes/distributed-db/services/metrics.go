@@ -0,0 +1,75 @@
+package services
+
+import (
+	"math"
+	"sort"
+
+	"distributed-db/models"
+)
+
+// Metrics returns the counters of the node along with the state of its storage and of the ring
+func (svc CacheSvc) Metrics() models.MetricsResponse {
+	ring := map[string]int{}
+	for _, node := range svc.tokens.Mappings() {
+		ring[node]++
+	}
+	return models.MetricsResponse{
+		Node:     svc.tokens.Nodes.Current(),
+		Keys:     svc.cacheRepo.KeyCount(),
+		Memory:   svc.cacheRepo.Stats(),
+		Members:  svc.tokens.Nodes.Members(),
+		Ring:     ring,
+		Counters: svc.metrics.Snapshot(),
+	}
+}
+
+func (svc CacheSvc) RingChecksum() string {
+	return svc.tokens.Checksum()
+}
+
+// Ring returns the tokens of the ring in order and what the node knows about their owners.
+// Every token owns the tokens after the previous one, the first one wraps around the ring
+func (svc CacheSvc) Ring() models.RingResponse {
+	// the checksum is read first, a ring rebuilt in between only makes the callers read it again
+	checksum := svc.tokens.Checksum()
+	mappings := svc.tokens.Mappings()
+	res := models.RingResponse{
+		Node:     svc.tokens.Nodes.Current(),
+		Checksum: checksum,
+		Nodes:    make([]models.RingMember, 0),
+		Tokens:   make([]models.RingToken, 0, len(mappings)),
+	}
+	for token, node := range mappings {
+		res.Tokens = append(res.Tokens, models.RingToken{Token: token, Node: node})
+	}
+	sort.Slice(res.Tokens, func(i, j int) bool {
+		return res.Tokens[i].Token < res.Tokens[j].Token
+	})
+
+	tokens, owned := map[string]int{}, map[string]float64{}
+	for i, t := range res.Tokens {
+		var size float64
+		if i == 0 {
+			size = float64(t.Token) - math.MinInt64 + math.MaxInt64 - float64(res.Tokens[len(res.Tokens)-1].Token)
+		} else {
+			size = float64(t.Token) - float64(res.Tokens[i-1].Token)
+		}
+		tokens[t.Node]++
+		owned[t.Node] += size
+	}
+
+	for node, m := range svc.tokens.Nodes.Members() {
+		res.Nodes = append(res.Nodes, models.RingMember{
+			Node:          node,
+			Status:        models.NodeStatusText(m.Status),
+			Incarnation:   m.Incarnation,
+			Tokens:        tokens[node],
+			Ownership:     owned[node] / (math.MaxInt64 - math.MinInt64),
+			ForeignTokens: len(svc.tokens.ForeignTokens(node)),
+		})
+	}
+	sort.Slice(res.Nodes, func(i, j int) bool {
+		return res.Nodes[i].Node < res.Nodes[j].Node
+	})
+	return res
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"log"
+
+	"distributed-db/models"
+)
+
+// keyRead tracks the responses of the replicas for a single key
+type keyRead struct {
+	token     int
+	replicas  []string
+	acks      int
+	next      int
+	responses int
+	// the replica the full item was read from
+	hasData    bool
+	dataNode   string
+	dataDigest string
+	item       models.CacheItem
+	found      bool
+	// the digests returned by the other replicas
+	digests map[string]string
+}
+
+type readResult struct {
+	node   string
+	keys   []string
+	digest bool
+	items  []models.CacheItem
+	err    error
+}
+
+// readReplicas reads the full items and the digests from all the nodes concurrently
+func (svc CacheSvc) readReplicas(dataKeys, digestKeys map[string][]string, replicationFactor int) []readResult {
+	results := make(chan readResult, len(dataKeys)+len(digestKeys))
+	read := func(node string, keys []string, digest bool) {
+		items, err := svc.getReplica(node, keys, replicationFactor, digest)
+		results <- readResult{node: node, keys: keys, digest: digest, items: items, err: err}
+	}
+	for node, keys := range dataKeys {
+		go read(node, keys, false)
+	}
+	for node, keys := range digestKeys {
+		go read(node, keys, true)
+	}
+
+	res := make([]readResult, 0, len(dataKeys)+len(digestKeys))
+	for i := 0; i < len(dataKeys)+len(digestKeys); i++ {
+		res = append(res, <-results)
+	}
+	return res
+}
+
+// readRepair makes a full read from the replicas whose digest differs from the data read,
+// picks the newest version and writes it back to the stale replicas in the background.
+// It returns the number of write backs which were triggered
+func (svc CacheSvc) readRepair(reads map[string]*keyRead, replicationFactor int) int {
+	nodeToKeys := map[string][]string{}
+	for key, read := range reads {
+		if read.found {
+			read.dataDigest = models.Digest(read.item)
+		}
+		for node, digest := range read.digests {
+			if digest != read.dataDigest {
+				nodeToKeys[node] = append(nodeToKeys[node], key)
+			}
+		}
+	}
+	if len(nodeToKeys) == 0 {
+		return 0
+	}
+
+	for _, res := range svc.readReplicas(nodeToKeys, nil, replicationFactor) {
+		if res.err != nil {
+			log.Printf("could not get cache items for read repair from node: %s, %v", res.node, res.err)
+			continue
+		}
+		for _, item := range res.items {
+			read, ok := reads[item.Key]
+			if !ok || (read.found && !item.UpdatedAt.After(read.item.UpdatedAt)) {
+				continue
+			}
+			item.Node = res.node
+			read.item, read.found = item, true
+		}
+	}
+
+	repairs := 0
+	for _, read := range reads {
+		if !read.found {
+			continue
+		}
+
+		newest, stale := models.Digest(read.item), make([]string, 0)
+		if read.dataDigest != newest {
+			stale = append(stale, read.dataNode)
+		}
+		for node, digest := range read.digests {
+			if digest != newest {
+				stale = append(stale, node)
+			}
+		}
+
+		item := read.item
+		item.Node, item.Replicas, item.Digest = "", nil, ""
+		for _, node := range stale {
+			repairs++
+			go func(node string, token int) {
+				err := svc.setReplica(node, token, item)
+				if err != nil {
+					log.Printf("could not repair key: %s on node: %s, %v", item.Key, node, err)
+				}
+			}(node, read.token)
+		}
+	}
+	return repairs
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestReadRepair reads a key one of its replicas missed the last write of,
+// once through the stale replica and once through an up to date one. The read
+// must return the newest value, whether the stale copy was the data or a digest,
+// and write it back to the stale replica
+func TestReadRepair(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, coordinator := range []int{2, 0} {
+		_, svcs := newTestCluster(t, 3, 3)
+		stale := svcs[2]
+
+		_, err := svcs[0].Set(models.SetRequest{Key: "key", Value: "old", ConsistencyLevel: models.ConsistencyLevelAll})
+		if err != nil {
+			t.Fatalf("could not set the key: %v", err)
+		}
+		token := int(models.HashKey("key"))
+		item := models.CacheItem{Key: "key", Value: "new", UpdatedAt: time.Now().UTC(), ReplicationFactor: 3}
+		for _, svc := range svcs[:2] {
+			if _, err = svc.cacheRepo.Set(map[int]models.CacheItem{token: item}); err != nil {
+				t.Fatalf("could not write the new value: %v", err)
+			}
+		}
+
+		res, err := svcs[coordinator].Get(models.GetRequest{Keys: []string{"key"}, ConsistencyLevel: models.ConsistencyLevelAll})
+		if err != nil || len(res.Items) != 1 || res.Items[0].Value != "new" {
+			t.Fatalf("coordinator: %d, expected the new value, got: %+v, %v", coordinator, res.Items, err)
+		}
+		if res.ReadRepairs != 1 {
+			t.Fatalf("coordinator: %d, expected the stale replica to be repaired, got: %d repair(s)", coordinator, res.ReadRepairs)
+		}
+
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			if item, ok := stored(stale, "key"); ok && item.Value == "new" {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("coordinator: %d, the stale replica was not repaired", coordinator)
+			}
+		}
+	}
+}
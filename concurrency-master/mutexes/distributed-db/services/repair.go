@@ -0,0 +1,136 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"distributed-db/models"
+)
+
+// Repair compares the Merkle trees of every token range with the other replicas
+// of the range and exchanges only the items of the leaves which differ.
+// Items are sent both ways and the newest version of an item wins on both sides
+func (svc CacheSvc) Repair() models.RepairResponse {
+	start, res := time.Now(), models.RepairResponse{}
+	for _, r := range svc.tokens.Ranges() {
+		items := svc.cacheRepo.Scan(r.From, r.To)
+		for _, peer := range svc.rangePeers(r, items) {
+			res.Ranges++
+			local := models.NewMerkleTree(r, svc.sharedItems(peer, items))
+			remote, err := svc.httpClient.MerkleTree(peer, models.MerkleRequest{Range: r, Root: local.Root()})
+			if err != nil {
+				log.Printf("could not get merkle tree from node: %s, %v", peer, err)
+				res.FailedRanges++
+				continue
+			}
+
+			diff := local.Diff(remote)
+			if len(diff) == 0 {
+				continue
+			}
+			sent, received, err := svc.repairRanges(peer, diff, items)
+			res.ItemsSent += sent
+			res.ItemsReceived += received
+			if err != nil {
+				log.Printf("could not repair range: %d:%d with node: %s, %v", r.From, r.To, peer, err)
+				res.FailedRanges++
+				continue
+			}
+			res.RepairedRanges++
+		}
+	}
+
+	res.Duration = time.Since(start).String()
+	if res.RepairedRanges > 0 || res.FailedRanges > 0 {
+		log.Printf(
+			"repaired %d out of %d range(s), %d failed, sent %d item(s), received %d item(s)",
+			res.RepairedRanges, res.Ranges, res.FailedRanges, res.ItemsSent, res.ItemsReceived,
+		)
+	}
+	return res
+}
+
+// MerkleTree builds the tree of the items the current node shares with the given node
+func (svc CacheSvc) MerkleTree(node string, req models.MerkleRequest) models.MerkleTree {
+	items := svc.cacheRepo.Scan(req.Range.From, req.Range.To)
+	tree := models.NewMerkleTree(req.Range, svc.sharedItems(node, items))
+	if req.Root != "" && req.Root == tree.Root() {
+		tree.Hashes = tree.Hashes[:1]
+	}
+	return tree
+}
+
+// RangeItems returns the items within the ranges the current node shares with the given node
+func (svc CacheSvc) RangeItems(node string, ranges []models.TokenRange) map[int]models.CacheItem {
+	items := map[int]models.CacheItem{}
+	for _, r := range ranges {
+		for token, item := range svc.sharedItems(node, svc.cacheRepo.Scan(r.From, r.To)) {
+			items[token] = item
+		}
+	}
+	return items
+}
+
+func (svc CacheSvc) repairRanges(peer string, ranges []models.TokenRange, items map[int]models.CacheItem) (int, int, error) {
+	shared, toSend := svc.sharedItems(peer, items), map[int]models.CacheItem{}
+	for token, item := range shared {
+		for _, r := range ranges {
+			if r.Contains(token) {
+				toSend[token] = item
+				break
+			}
+		}
+	}
+	if len(toSend) > 0 {
+		_, err := svc.httpClient.SetBatch(peer, toSend)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	received, err := svc.httpClient.RangeItems(peer, ranges)
+	if err != nil {
+		return len(toSend), 0, err
+	}
+	err = svc.store(svc.sharedItems(peer, received))
+	if err != nil {
+		return len(toSend), 0, err
+	}
+
+	return len(toSend), len(received), nil
+}
+
+// rangePeers returns the other replicas of the range, based on the default
+// replication factor and on the replication factor of the items within the range
+func (svc CacheSvc) rangePeers(r models.TokenRange, items map[int]models.CacheItem) []string {
+	current, peers := svc.tokens.Nodes.Current(), make([]string, 0)
+	addPeers := func(replicas []string) {
+		if !contains(replicas, current) {
+			return
+		}
+		for _, node := range replicas {
+			if node != current && !contains(peers, node) {
+				peers = append(peers, node)
+			}
+		}
+	}
+
+	addPeers(svc.replicas(r.To, svc.replicationFactor))
+	for token, item := range items {
+		addPeers(svc.replicas(token, item.ReplicationFactor))
+	}
+	return peers
+}
+
+// sharedItems filters the items which are supposed to be stored
+// both on the current node and on the given node
+func (svc CacheSvc) sharedItems(node string, items map[int]models.CacheItem) map[int]models.CacheItem {
+	shared := map[int]models.CacheItem{}
+	for token, item := range items {
+		replicas := svc.replicas(token, item.ReplicationFactor)
+		if contains(replicas, node) && contains(replicas, svc.tokens.Nodes.Current()) {
+			shared[token] = item
+		}
+	}
+	return shared
+}
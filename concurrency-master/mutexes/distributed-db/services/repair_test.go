@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// repairClient delivers the repair requests of a node straight to the services of the other nodes
+type repairClient struct {
+	*fakeClient
+	from  string
+	nodes map[string]CacheSvc
+}
+
+func (c *repairClient) MerkleTree(node string, req models.MerkleRequest) (models.MerkleTree, error) {
+	return c.nodes[node].MerkleTree(c.from, req), nil
+}
+
+func (c *repairClient) RangeItems(node string, ranges []models.TokenRange) (map[int]models.CacheItem, error) {
+	return c.nodes[node].RangeItems(c.from, ranges), nil
+}
+
+func (c *repairClient) SetBatch(node string, items map[int]models.CacheItem) ([]models.CacheItem, error) {
+	return c.nodes[node].SetBatch(items)
+}
+
+// TestRepair repairs 2 replicas which each missed some writes, and disagree on the
+// version of a key. Only the items of the leaves which differ must be exchanged,
+// both replicas must end up with the newest version of every item, and a second
+// repair must find nothing to do
+func TestRepair(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	nodes := map[string]CacheSvc{}
+	for _, addr := range []string{testCurrentNode, testOtherNode} {
+		other := testOtherNode
+		if addr == testOtherNode {
+			other = testCurrentNode
+		}
+		nodes[addr] = newTestNode(t, addr, []string{other}, &repairClient{fakeClient: newFakeClient(), from: addr, nodes: nodes}, 2)
+	}
+	local, remote := nodes[testCurrentNode], nodes[testOtherNode]
+
+	now := time.Now().UTC()
+	write := func(svc CacheSvc, item models.CacheItem) {
+		if _, err := svc.cacheRepo.Set(map[int]models.CacheItem{int(models.HashKey(item.Key)): item}); err != nil {
+			t.Fatalf("could not write key: %s, %v", item.Key, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		item := models.CacheItem{Key: fmt.Sprintf("key:%d", i), Value: "value", UpdatedAt: now, ReplicationFactor: 2}
+		write(local, item)
+		write(remote, item)
+	}
+	missing := []models.CacheItem{
+		{Key: "local only", Value: "value", UpdatedAt: now, ReplicationFactor: 2},
+		{Key: "remote only", Value: "value", UpdatedAt: now, ReplicationFactor: 2},
+	}
+	write(local, missing[0])
+	write(remote, missing[1])
+	newer := models.CacheItem{Key: "key:0", Value: "newer", UpdatedAt: now.Add(time.Second), ReplicationFactor: 2}
+	write(remote, newer)
+
+	res := local.Repair()
+	if res.FailedRanges != 0 || res.RepairedRanges == 0 || res.RepairedRanges > 3 {
+		t.Fatalf("expected at most the 3 ranges of the changed items to be repaired, got: %+v", res)
+	}
+	if res.ItemsSent+res.ItemsReceived >= 100 {
+		t.Fatalf("expected only the items of the leaves which differ to be exchanged, got: %+v", res)
+	}
+
+	for _, svc := range []CacheSvc{local, remote} {
+		node := svc.tokens.Nodes.Current()
+		for _, item := range append(missing, newer) {
+			if got, ok := stored(svc, item.Key); !ok || got.Value != item.Value {
+				t.Fatalf("expected key: %s with value: %s on node: %s, got: %+v, %v", item.Key, item.Value, node, got, ok)
+			}
+		}
+	}
+	if res = local.Repair(); res.RepairedRanges != 0 || res.ItemsSent != 0 || res.ItemsReceived != 0 {
+		t.Fatalf("expected the replicas to be in sync, got: %+v", res)
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"distributed-db/models"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// Scan lists the items whose keys start with the prefix, in key order, a page at a time.
+// Every node returns its first keys after the cursor, so merging them gives the first
+// keys of the whole cluster. The copies of the replicas are merged keeping the newest one,
+// which is dropped when it is a tombstone. Pages can be shorter than the limit.
+// The nodes only list the keys of the keyspace, and the cursor is the stored key
+// of the last item, the clients pass it back as is
+func (svc CacheSvc) Scan(req models.ScanRequest) (models.ScanResponse, error) {
+	if req.Limit == 0 {
+		req.Limit = defaultScanLimit
+	}
+	if req.Limit < 0 || req.Limit > maxScanLimit {
+		return models.ScanResponse{}, fmt.Errorf("%w: the limit must be between 1 and %d", models.ErrInvalidRequest, maxScanLimit)
+	}
+	if req.Local {
+		return models.ScanResponse{Items: svc.scanLocal(req)}, nil
+	}
+
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+	req.Keyspace = keyspace.Name
+	req.Prefix, err = storedKey(keyspace, req.Prefix)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+
+	res, err := svc.scan(req)
+	if err != nil {
+		return models.ScanResponse{}, err
+	}
+	for i, item := range res.Items {
+		res.Items[i] = clientItem(keyspace, item)
+	}
+	return res, nil
+}
+
+// scanLocal lists the keys of the keyspace stored on the current node
+func (svc CacheSvc) scanLocal(req models.ScanRequest) []models.CacheItem {
+	keyspace := models.Keyspace{Name: req.Keyspace}
+	if keyspace.Name == "" {
+		keyspace.Name = models.DefaultKeyspace
+	}
+	return svc.cacheRepo.ScanKeys(req.Prefix, req.Cursor, req.Limit, func(key string) bool {
+		return inKeyspace(keyspace, key)
+	})
+}
+
+func (svc CacheSvc) scan(req models.ScanRequest) (models.ScanResponse, error) {
+
+	// down nodes are asked as well, the listing can't be complete without them
+	nodes := []string{svc.tokens.Nodes.Current()}
+	for _, node := range svc.tokens.Nodes.ListAll() {
+		if member, _ := svc.tokens.Nodes.Member(node); member.Status != models.NodeStatusLeft {
+			nodes = append(nodes, node)
+		}
+	}
+
+	type result struct {
+		node  string
+		items []models.CacheItem
+		err   error
+	}
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			items, err := svc.scanNode(node, req)
+			results <- result{node: node, items: items, err: err}
+		}(node)
+	}
+
+	newest, more, unavailable := map[string]models.CacheItem{}, false, make([]string, 0)
+	for range nodes {
+		res := <-results
+		if res.err != nil {
+			log.Printf("could not scan keys of node: %s, %v", res.node, res.err)
+			unavailable = append(unavailable, res.node)
+			continue
+		}
+		// a full page means the node may have more keys
+		if len(res.items) == req.Limit {
+			more = true
+		}
+		for _, item := range res.items {
+			item.Node = res.node
+			if old, ok := newest[item.Key]; !ok || item.UpdatedAt.After(old.UpdatedAt) {
+				newest[item.Key] = item
+			}
+		}
+	}
+	if len(unavailable) > 0 {
+		return models.ScanResponse{}, fmt.Errorf("%w: could not scan the keys of node(s): %s", models.ErrUnavailable, strings.Join(unavailable, ","))
+	}
+
+	keys := make([]string, 0, len(newest))
+	for key := range newest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > req.Limit {
+		keys, more = keys[:req.Limit], true
+	}
+
+	res := models.ScanResponse{Items: make([]models.CacheItem, 0, len(keys))}
+	for _, key := range keys {
+		if item := newest[key]; !item.Deleted {
+			res.Items = append(res.Items, item)
+		}
+	}
+	if more {
+		res.Cursor = keys[len(keys)-1]
+	}
+	return res, nil
+}
+
+func (svc CacheSvc) scanNode(node string, req models.ScanRequest) ([]models.CacheItem, error) {
+	if node == svc.tokens.Nodes.Current() {
+		return svc.scanLocal(req), nil
+	}
+
+	req.Local = true
+	res, err := svc.httpClient.Scan(node, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Items, nil
+}
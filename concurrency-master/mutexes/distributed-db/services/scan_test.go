@@ -0,0 +1,74 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestScanPagination lists the keys split over both nodes page by page,
+// the copies of the replicas must be merged and deleted keys left out
+func TestScanPagination(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client := newFakeClient()
+	svc := newTestNode(t, testCurrentNode, []string{testOtherNode}, client, 1)
+
+	now := time.Now().UTC()
+	local, other := map[int]models.CacheItem{}, map[int]models.CacheItem{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		item := models.CacheItem{Key: key, Value: "value", UpdatedAt: now}
+		// every third key has a copy on both nodes
+		if i%2 == 0 || i%3 == 0 {
+			local[int(models.HashKey(key))] = item
+		}
+		if i%2 == 1 || i%3 == 0 {
+			other[int(models.HashKey(key))] = item
+		}
+	}
+	// the newer tombstone hides the value of the other node
+	deleted := models.CacheItem{Key: "user:03", UpdatedAt: now.Add(time.Second), Deleted: true}
+	local[int(models.HashKey(deleted.Key))] = deleted
+	local[int(models.HashKey("session:01"))] = models.CacheItem{Key: "session:01", Value: "value", UpdatedAt: now}
+	if _, err := svc.cacheRepo.Set(local); err != nil {
+		t.Fatalf("could not set the items: %v", err)
+	}
+	_, _ = client.SetBatch(testOtherNode, other)
+
+	keys, cursor := make([]string, 0), ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("the scan does not end, cursor: %s", cursor)
+		}
+
+		res, err := svc.Scan(models.ScanRequest{Prefix: "user:", Cursor: cursor, Limit: 3})
+		if err != nil {
+			t.Fatalf("could not scan: %v", err)
+		}
+		for _, item := range res.Items {
+			keys = append(keys, item.Key)
+		}
+		if res.Cursor == "" {
+			break
+		}
+		cursor = res.Cursor
+	}
+
+	expected := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		if i != 3 {
+			expected = append(expected, fmt.Sprintf("user:%02d", i))
+		}
+	}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
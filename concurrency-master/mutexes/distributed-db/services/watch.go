@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"distributed-db/models"
+)
+
+const (
+	// how long a node holds a poll for changes which has none to return yet
+	watchPollWait = 10 * time.Second
+	// how long before polling a node which could not be reached again,
+	// and how often the new nodes start being polled
+	watchRetryDelay = time.Second
+)
+
+// Watch streams the changes of the key, or of the keys starting with the prefix,
+// until the context is done. Every node only logs the changes of the keys it owns,
+// so the change logs of all the nodes are polled and merged. Every event carries
+// the cursor to resume from: the position reached in the change log of every node.
+// A reset event tells the changes of a node were missed, because they were dropped
+// from its ring or lost with a restart. Items moved to a new owner by a ring change
+// show up as changes of the new owner
+func (svc CacheSvc) Watch(ctx context.Context, req models.WatchRequest) (<-chan models.WatchEvent, error) {
+	keyspace, err := svc.keyspace(req.Keyspace)
+	if err != nil {
+		return nil, err
+	}
+	if req.Key != "" {
+		req.Key, err = storedKey(keyspace, req.Key)
+	} else {
+		req.Prefix, err = storedKey(keyspace, req.Prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	type polled struct {
+		node string
+		res  models.ChangesResponse
+	}
+	results, events := make(chan polled), make(chan models.WatchEvent)
+
+	poll := func(node string, position models.WatchPosition) {
+		failing := false
+		for {
+			changesReq := models.ChangesRequest{
+				Key:    req.Key,
+				Prefix: req.Prefix,
+				Epoch:  position.Epoch,
+				After:  position.Seq,
+				Wait:   models.Duration(watchPollWait),
+			}
+			res, err := svc.pollChanges(ctx, node, changesReq)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// the node is polled again until it comes back, only the first failure is logged
+				if !failing {
+					log.Printf("could not poll the changes of node: %s, %v", node, err)
+				}
+				failing = true
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetryDelay):
+					continue
+				}
+			}
+
+			failing, position = false, models.WatchPosition{Epoch: res.Epoch, Seq: res.Seq}
+			select {
+			case results <- polled{node: node, res: res}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	go func() {
+		defer close(events)
+
+		cursor, polling := models.WatchCursor{}, map[string]bool{}
+		for node, position := range req.Cursor {
+			cursor[node] = position
+		}
+		pollNodes := func() {
+			for _, node := range append(svc.tokens.Nodes.ListAll(), svc.tokens.Nodes.Current()) {
+				if !polling[node] {
+					polling[node] = true
+					go poll(node, cursor[node])
+				}
+			}
+		}
+		pollNodes()
+
+		ticker := time.NewTicker(watchRetryDelay)
+		defer ticker.Stop()
+		emit := func(e models.WatchEvent) bool {
+			e.Cursor = cursor.String()
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pollNodes()
+			case p := <-results:
+				position, known := cursor[p.node]
+				cursor[p.node] = models.WatchPosition{Epoch: p.res.Epoch}
+				if known && (position.Epoch != p.res.Epoch || p.res.Truncated) {
+					if !emit(models.WatchEvent{Type: models.ChangeReset, Node: p.node}) {
+						return
+					}
+				}
+				for _, change := range p.res.Changes {
+					cursor[p.node] = models.WatchPosition{Epoch: p.res.Epoch, Seq: change.Seq}
+					// the prefix of the default keyspace matches the keys of the named ones too
+					if !inKeyspace(keyspace, change.Item.Key) {
+						continue
+					}
+					if !emit(models.WatchEvent{Type: change.Type, Node: p.node, Item: clientItem(keyspace, change.Item)}) {
+						return
+					}
+				}
+				cursor[p.node] = models.WatchPosition{Epoch: p.res.Epoch, Seq: p.res.Seq}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// Changes returns the changes of the watched keys logged by the current node
+// after the position, waiting for the next ones when there are none yet, until
+// the context is done. Without a position the newest one is returned right away,
+// so the watcher has a position in the change log of every node from the start
+func (svc CacheSvc) Changes(ctx context.Context, req models.ChangesRequest) models.ChangesResponse {
+	epoch := svc.changes.Epoch()
+	if req.Epoch == 0 {
+		return models.ChangesResponse{Epoch: epoch, Seq: svc.changes.Seq(), Changes: make([]models.Change, 0)}
+	}
+	after, truncated := req.After, false
+	if req.Epoch != epoch {
+		after, truncated = 0, true
+	}
+
+	timer := time.NewTimer(time.Duration(req.Wait))
+	defer timer.Stop()
+	for {
+		changes, seq, dropped, next := svc.changes.Since(after)
+		res := models.ChangesResponse{Epoch: epoch, Seq: seq, Truncated: truncated || dropped, Changes: make([]models.Change, 0)}
+		for _, change := range changes {
+			if watched(req, change.Item.Key) {
+				res.Changes = append(res.Changes, change)
+			}
+		}
+		if len(res.Changes) > 0 || res.Truncated {
+			return res
+		}
+
+		after = seq
+		select {
+		case <-next:
+		case <-timer.C:
+			return res
+		case <-ctx.Done():
+			return res
+		}
+	}
+}
+
+func (svc CacheSvc) pollChanges(ctx context.Context, node string, req models.ChangesRequest) (models.ChangesResponse, error) {
+	if node == svc.tokens.Nodes.Current() {
+		return svc.Changes(ctx, req), nil
+	}
+	return svc.httpClient.Changes(ctx, node, req)
+}
+
+func watched(req models.ChangesRequest, key string) bool {
+	if req.Key != "" {
+		return key == req.Key
+	}
+	return strings.HasPrefix(key, req.Prefix)
+}
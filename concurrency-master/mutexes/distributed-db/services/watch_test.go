@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-db/models"
+)
+
+// TestWatchResume watches the keys owned by the current node,
+// the stream resumed from the cursor of an event continues after it
+func TestWatchResume(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	svc := newTestService(t, 1)
+	tokens, changes := svc.tokens, svc.changes
+
+	keys := make([]string, 0, 3)
+	for i := 0; len(keys) < 3; i++ {
+		key := fmt.Sprintf("config/%d", i)
+		if tokens.GetNodes(int(models.HashKey(key)), 1)[0] == testCurrentNode {
+			keys = append(keys, key)
+		}
+	}
+
+	next := func(events <-chan models.WatchEvent) models.WatchEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return models.WatchEvent{}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	start := models.WatchCursor{testCurrentNode: {Epoch: changes.Epoch()}}
+	events, err := svc.Watch(ctx, models.WatchRequest{Prefix: "config/", Cursor: start})
+	if err != nil {
+		t.Fatalf("could not watch: %v", err)
+	}
+	for _, key := range keys {
+		_, err = svc.Set(models.SetRequest{Key: key, Value: "value"})
+		if err != nil {
+			t.Fatalf("could not set key: %s, %v", key, err)
+		}
+	}
+	first := next(events)
+	if first.Type != models.ChangeSet || first.Item.Key != keys[0] {
+		t.Fatalf("unexpected event: %+v", first)
+	}
+	cancel()
+
+	cursor, err := models.ParseWatchCursor(first.Cursor)
+	if err != nil {
+		t.Fatalf("could not parse cursor: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events, err = svc.Watch(ctx, models.WatchRequest{Prefix: "config/", Cursor: cursor})
+	if err != nil {
+		t.Fatalf("could not watch: %v", err)
+	}
+	for _, key := range keys[1:] {
+		if e := next(events); e.Item.Key != key {
+			t.Fatalf("expected key: %s, got event: %+v", key, e)
+		}
+	}
+}
+
+// pollingClient holds the polls for changes like a node with no changes to return
+type pollingClient struct {
+	*fakeClient
+	polling int32
+}
+
+func (c *pollingClient) Changes(ctx context.Context, node string, req models.ChangesRequest) (models.ChangesResponse, error) {
+	atomic.AddInt32(&c.polling, 1)
+	defer atomic.AddInt32(&c.polling, -1)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(req.Wait)):
+	}
+	return models.ChangesResponse{Epoch: 1, Changes: []models.Change{}}, nil
+}
+
+// TestWatchCancelEndsPolls stops watching while the other node holds a poll,
+// the poll must not outlive the watch
+func TestWatchCancelEndsPolls(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	client := &pollingClient{fakeClient: newFakeClient()}
+	svc := newTestNode(t, testCurrentNode, []string{testOtherNode}, client, 1)
+
+	waitPolls := func(n int32) {
+		for i := 0; i < 100; i++ {
+			if atomic.LoadInt32(&client.polling) == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d poll(s) of the other node, got: %d", n, atomic.LoadInt32(&client.polling))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := svc.Watch(ctx, models.WatchRequest{Prefix: "config/"})
+	if err != nil {
+		t.Fatalf("could not watch: %v", err)
+	}
+	waitPolls(1)
+	cancel()
+	waitPolls(0)
+}
@@ -0,0 +1,41 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const compactionPeriod = 30 * time.Second
+
+type compacter interface {
+	Compact(grace time.Duration, bytesPerSecond int64)
+}
+
+func NewCompactor(svc compacter, grace time.Duration, bytesPerSecond int64) Compactor {
+	return Compactor{
+		svc:            svc,
+		grace:          grace,
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+type Compactor struct {
+	svc            compacter
+	grace          time.Duration
+	bytesPerSecond int64
+}
+
+func (c *Compactor) Start(ctx context.Context) {
+	log.Println("compactor worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the compactor worker")
+			return
+		case <-time.NewTicker(compactionPeriod).C:
+			c.svc.Compact(c.grace, c.bytesPerSecond)
+		}
+	}
+}
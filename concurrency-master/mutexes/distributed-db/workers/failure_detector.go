@@ -0,0 +1,43 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const probePeriod = time.Second
+
+type prober interface {
+	Probe(timeout, suspicionTimeout time.Duration, indirectProbes int)
+}
+
+func NewFailureDetector(svc prober, timeout, suspicionTimeout time.Duration, indirectProbes int) FailureDetector {
+	return FailureDetector{
+		svc:              svc,
+		timeout:          timeout,
+		suspicionTimeout: suspicionTimeout,
+		indirectProbes:   indirectProbes,
+	}
+}
+
+type FailureDetector struct {
+	svc              prober
+	timeout          time.Duration
+	suspicionTimeout time.Duration
+	indirectProbes   int
+}
+
+func (f *FailureDetector) Start(ctx context.Context) {
+	log.Println("failure detector worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the failure detector worker")
+			return
+		case <-time.NewTicker(probePeriod).C:
+			f.svc.Probe(f.timeout, f.suspicionTimeout, f.indirectProbes)
+		}
+	}
+}
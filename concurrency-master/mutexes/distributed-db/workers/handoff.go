@@ -0,0 +1,37 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const handoffPeriod = 10 * time.Second
+
+type hintsReplayer interface {
+	ReplayHints()
+}
+
+func NewHandoff(svc hintsReplayer) Handoff {
+	return Handoff{
+		svc: svc,
+	}
+}
+
+type Handoff struct {
+	svc hintsReplayer
+}
+
+func (h *Handoff) Start(ctx context.Context) {
+	log.Println("handoff worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the handoff worker")
+			return
+		case <-time.NewTicker(handoffPeriod).C:
+			h.svc.ReplayHints()
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const reapPeriod = 5 * time.Second
+
+type expiredPurger interface {
+	PurgeExpired()
+}
+
+func NewReaper(svc expiredPurger) Reaper {
+	return Reaper{
+		svc: svc,
+	}
+}
+
+type Reaper struct {
+	svc expiredPurger
+}
+
+func (r *Reaper) Start(ctx context.Context) {
+	log.Println("reaper worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the reaper worker")
+			return
+		case <-time.NewTicker(reapPeriod).C:
+			r.svc.PurgeExpired()
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"distributed-db/models"
+)
+
+const repairPeriod = 10 * time.Minute
+
+type repairer interface {
+	Repair() models.RepairResponse
+}
+
+func NewRepairer(svc repairer) Repairer {
+	return Repairer{
+		svc: svc,
+	}
+}
+
+type Repairer struct {
+	svc repairer
+}
+
+func (r *Repairer) Start(ctx context.Context) {
+	log.Println("repairer worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the repairer worker")
+			return
+		case <-time.NewTicker(repairPeriod).C:
+			r.svc.Repair()
+		}
+	}
+}
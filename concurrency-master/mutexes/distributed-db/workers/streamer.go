@@ -41,6 +41,7 @@ func (s *Streamer) Start(ctx context.Context) {
 			}
 
 			failedBatches, failedItems := s.svc.Stream(s.retryStreams), 0
+			s.retryStreams = map[string]map[int]models.CacheItem{}
 			for node, batchItems := range failedBatches {
 				if s.retryStreams[node] == nil {
 					s.retryStreams[node] = map[int]models.CacheItem{}
@@ -0,0 +1,39 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const sweepPeriod = time.Minute
+
+type tombstonePurger interface {
+	PurgeTombstones(grace time.Duration)
+}
+
+func NewSweeper(svc tombstonePurger, grace time.Duration) Sweeper {
+	return Sweeper{
+		svc:   svc,
+		grace: grace,
+	}
+}
+
+type Sweeper struct {
+	svc   tombstonePurger
+	grace time.Duration
+}
+
+func (s *Sweeper) Start(ctx context.Context) {
+	log.Println("sweeper worker started successfully")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stopping the sweeper worker")
+			return
+		case <-time.NewTicker(sweepPeriod).C:
+			s.svc.PurgeTombstones(s.grace)
+		}
+	}
+}